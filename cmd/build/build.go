@@ -1,26 +1,57 @@
 package build
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
+	"github.com/errordeveloper/imagine/pkg/attest"
 	"github.com/errordeveloper/imagine/pkg/buildx"
 	"github.com/errordeveloper/imagine/pkg/config"
+	"github.com/errordeveloper/imagine/pkg/export"
 	"github.com/errordeveloper/imagine/pkg/git"
+	"github.com/errordeveloper/imagine/pkg/imagesize"
+	"github.com/errordeveloper/imagine/pkg/imagetest"
 	"github.com/errordeveloper/imagine/pkg/rebuilder"
 	"github.com/errordeveloper/imagine/pkg/recipe"
 	"github.com/errordeveloper/imagine/pkg/registry"
+	"github.com/errordeveloper/imagine/pkg/sign"
 )
 
 type Flags struct {
 	*config.CommonFlags
+	*config.BuilderFlags
+	*config.RegistryFlags
+	*config.LintFlags
+	*config.SizeFlags
 
-	Builder string
-	Force   bool
-	Debug   bool
+	Builder         string
+	CreateBuilder   bool
+	KeepBuilder     bool
+	BuildKitAddress string
+	BuildKitTLS     buildx.TLSConfig
+	Progress        string
+	Force           bool
+	Debug           bool
+	Annotations     bool
+
+	NormaliseTimestamps bool
+	VerifyReproducible  bool
+
+	Provenance      bool
+	SBOM            bool
+	AttestationsDir string
+
+	Sign       bool
+	SigningKey string
+
+	Verify string
 
 	Args map[string]string
 }
@@ -28,7 +59,11 @@ type Flags struct {
 func BuildCmd() *cobra.Command {
 
 	flags := &Flags{
-		CommonFlags: &config.CommonFlags{},
+		CommonFlags:   &config.CommonFlags{},
+		BuilderFlags:  &config.BuilderFlags{},
+		RegistryFlags: &config.RegistryFlags{},
+		LintFlags:     &config.LintFlags{},
+		SizeFlags:     &config.SizeFlags{},
 	}
 
 	cmd := &cobra.Command{
@@ -43,11 +78,31 @@ func BuildCmd() *cobra.Command {
 	}
 
 	flags.CommonFlags.Register(cmd)
+	flags.BuilderFlags.Register(cmd)
+	flags.RegistryFlags.Register(cmd)
+	flags.LintFlags.Register(cmd)
+	flags.SizeFlags.Register(cmd)
 
-	cmd.Flags().StringVar(&flags.Builder, "builder", "", "name of buildx builder")
-	cmd.MarkFlagRequired("builder")
+	cmd.Flags().StringVar(&flags.Builder, "builder", "", "name of buildx builder (uses docker CLI)")
+	cmd.Flags().BoolVar(&flags.CreateBuilder, "create-builder", false, "create the builder unless it exists already (a random name is used when --builder is not set)")
+	cmd.Flags().BoolVar(&flags.KeepBuilder, "keep-builder", false, "do not remove the builder created with --create-builder on exit")
+	cmd.Flags().StringVar(&flags.BuildKitAddress, "buildkit-address", "", "address of BuildKit daemon to use in-process build driver with (e.g. 'tcp://buildkitd:1234' or 'docker-container://<name>')")
+	cmd.Flags().StringVar(&flags.BuildKitTLS.CACert, "buildkit-tls-ca-cert", "", "CA certificate for validating BuildKit daemon certificate (enables TLS)")
+	cmd.Flags().StringVar(&flags.BuildKitTLS.Cert, "buildkit-tls-cert", "", "client certificate to use for TLS with BuildKit daemon")
+	cmd.Flags().StringVar(&flags.BuildKitTLS.Key, "buildkit-tls-key", "", "client key to use for TLS with BuildKit daemon")
+	cmd.Flags().StringVar(&flags.BuildKitTLS.ServerName, "buildkit-tls-server-name", "", "server name for validating BuildKit daemon certificate")
+	cmd.Flags().StringVar(&flags.Progress, "progress", "auto", "type of progress output for in-process build driver ('auto', 'plain' or 'tty')")
 
 	cmd.Flags().BoolVar(&flags.Force, "force", false, "force rebuild the image")
+	cmd.Flags().BoolVar(&flags.Annotations, "annotations", false, "whether to also set labels as manifest annotations (pushed images are re-tagged once annotated)")
+	cmd.Flags().BoolVar(&flags.NormaliseTimestamps, "normalise-timestamps", false, "whether to set creation time in image config and history to the time of the last commit")
+	cmd.Flags().BoolVar(&flags.VerifyReproducible, "verify-reproducible", false, "build the image twice without cache and fail if digests differ (usually requires --normalise-timestamps)")
+	cmd.Flags().BoolVar(&flags.Provenance, "provenance", false, "whether to generate SLSA provenance attestation and attach it to the pushed image")
+	cmd.Flags().BoolVar(&flags.SBOM, "sbom", false, "whether to generate SPDX SBOM attestation for each platform and attach it to the pushed image")
+	cmd.Flags().StringVar(&flags.AttestationsDir, "attestations-dir", "", "directory to write attestations to (in addition to attaching them to the pushed image)")
+	cmd.Flags().BoolVar(&flags.Sign, "sign", false, "whether to sign the pushed image, existing images that are not signed get signed instead of being rebuilt")
+	cmd.Flags().StringVar(&flags.SigningKey, "signing-key", "", "path to PEM-encoded ECDSA, ed25519 or RSA private key to sign images with")
+	cmd.Flags().StringVar(&flags.Verify, "verify", "", "path to JSON file with assertions to check before the image is pushed or exported (same as 'imagine test --spec')")
 	cmd.Flags().BoolVar(&flags.Debug, "debug", false, "print debuging info and keep generated buildx manifest file")
 
 	cmd.Flags().StringToStringVar(&flags.Args, "args", nil, "build args")
@@ -56,7 +111,98 @@ func BuildCmd() *cobra.Command {
 }
 
 func (f *Flags) InitBuildCmd(cmd *cobra.Command) error {
-	return nil
+	if f.Builder == "" && f.BuildKitAddress == "" && !f.CreateBuilder {
+		return fmt.Errorf("either --builder, --create-builder or --buildkit-address must be set")
+	}
+	if (f.Builder != "" || f.CreateBuilder) && f.BuildKitAddress != "" {
+		return fmt.Errorf("--builder and --create-builder cannot be used together with --buildkit-address")
+	}
+	if (f.Provenance || f.SBOM) && !f.Push && !f.Export {
+		return fmt.Errorf("--provenance and --sbom require either --push or --export")
+	}
+	if f.AttestationsDir != "" && !f.Provenance && !f.SBOM {
+		return fmt.Errorf("--attestations-dir requires --provenance or --sbom")
+	}
+	if f.Sign && (!f.Push || f.SigningKey == "") {
+		return fmt.Errorf("--sign requires --push and --signing-key")
+	}
+	if f.SigningKey != "" && !f.Sign {
+		return fmt.Errorf("--signing-key requires --sign")
+	}
+	if f.Verify != "" && !f.Push && !f.Export {
+		return fmt.Errorf("--verify requires either --push or --export")
+	}
+	if err := f.SizeFlags.Validate(); err != nil {
+		return err
+	}
+	if f.SizeReport && !f.Push && !f.Export {
+		return fmt.Errorf("--size-report, --size-budget and --layer-budget require either --push or --export")
+	}
+	return f.LintFlags.Validate()
+}
+
+// baker returns a function that should be deferred to clean up
+// the builder, if one was created, as well as docker config with
+// registry credentials, these are also cleaned up on interrupt
+func (f *Flags) baker(regConfig *registry.Config) (buildx.Baker, func(), error) {
+	cleanup := func() {}
+
+	dockerConfigDir := ""
+	if regConfig != nil {
+		dir, cleanupDockerConfig, err := regConfig.WriteDockerConfig()
+		if err != nil {
+			cleanupDockerConfig()
+			return nil, cleanup, fmt.Errorf("unable to write docker config: %w", err)
+		}
+		dockerConfigDir, cleanup = dir, cleanupDockerConfig
+	}
+
+	if f.BuildKitAddress != "" {
+		bx := buildx.NewNative(f.BuildKitAddress)
+		bx.Progress = f.Progress
+		bx.Debug = f.Debug
+		bx.DockerConfigDir = dockerConfigDir
+		if f.BuildKitTLS != (buildx.TLSConfig{}) {
+			bx.TLS = &f.BuildKitTLS
+		}
+		return bx, buildx.CleanupOnExit(cleanup), nil
+	}
+
+	bx := &buildx.Buildx{
+		Builder:         f.Builder,
+		Debug:           f.Debug,
+		DockerConfigDir: dockerConfigDir,
+	}
+
+	if f.CreateBuilder {
+		if bx.Builder == "" {
+			bx.Builder = buildx.New().Builder
+		}
+		bx.Driver = f.Driver
+		bx.DriverOpts = f.DriverOpts
+
+		configFile, cleanupConfigFile, err := regConfig.WriteBuildKitConfig(f.ConfigFile)
+		defer cleanupConfigFile()
+		if err != nil {
+			return nil, cleanup, err
+		}
+		bx.ConfigFile = configFile
+
+		created, err := bx.EnsureBuilder()
+		if err != nil {
+			return nil, cleanup, err
+		}
+		if created {
+			fmt.Printf("created builder %q\n", bx.Builder)
+			if !f.KeepBuilder {
+				return bx, bx.DeleteOnExit(cleanup), nil
+			}
+		} else {
+			fmt.Printf("reusing builder %q\n", bx.Builder)
+		}
+	}
+
+	return bx, buildx.CleanupOnExit(cleanup), nil
 }
 
 func (f *Flags) RunBuildCmd() error {
@@ -72,63 +218,121 @@ func (f *Flags) RunBuildCmd() error {
 
 	ir := &recipe.ImagineRecipe{
 		Name:            f.Name,
-		HasTests:        f.Test,
 		Push:            f.Push,
 		Export:          f.Export,
+		ExportFormat:    f.ExportFormat,
+		ExportDir:       f.ExportDir,
 		Platforms:       f.Platforms,
 		Args:            f.Args,
 		BaseDir:         initialWD,
+		WithoutLabels:   f.WithoutLabels,
+		Annotations:     f.Annotations,
 		CustomTagSuffix: f.CustomTagSuffix,
-	}
+		TestReports:     f.TestReports,
+		TestReportsDir:  f.TestReportsDir,
+		TestStatus:      f.TestStatus,
 
-	if f.Root {
-		ir.Scope = &recipe.ImageScopeRootDir{
-			Git:     g,
-			BaseDir: initialWD,
+		NormaliseTimestamps: f.NormaliseTimestamps,
+		// the image is only pushed once assertions pass
+		// and it fits in size budget, if that's enforced
+		PushFromArchive: f.Verify != "" || (f.SizeReport && f.SizeBudgetMode == imagesize.ModeError),
+	}
 
-			RelativeDockerfilePath: filepath.Join(f.Dir, f.Dockerfile),
+	ir.Scope = f.ImageScope(g, initialWD)
 
-			WithoutSuffix: f.WithoutSuffix,
-			BaseBranch:    f.UpstreamBranch,
-		}
-	} else {
-		ir.Scope = &recipe.ImageScopeSubDir{
-			Git:     g,
-			BaseDir: initialWD,
+	if ir.TestStages, err = f.TestStages(ir.Scope); err != nil {
+		return err
+	}
+	ir.HasTests = len(ir.TestStages) != 0
 
-			RelativeImageDirPath: f.Dir,
-			Dockerfile:           f.Dockerfile,
+	if ir.Cache, err = f.CacheConfig(g); err != nil {
+		return err
+	}
 
-			WithoutSuffix: f.WithoutSuffix,
-			BaseBranch:    f.UpstreamBranch,
-		}
+	regConfig, err := f.RegistryConfig()
+	if err != nil {
+		return err
 	}
 
-	// TODO implement usefull cheks:
-	// - presence of Dockerfile.dockerignore in the same direcory
+	ir.InsecureRegistries = regConfig.InsecureHosts()
+
+	// test stages are not passed, as TestStages fails already
+	// when any of them is required, but not defined; base image
+	// digests are not resolved to avoid extra lookups on each build
+	if err := f.LintDockerfile(os.Stdout, ir.Scope, nil, f.Args, nil); err != nil {
+		return err
+	}
 
 	m, err := ir.ToBakeManifest(f.Registries...)
 	if err != nil {
 		return err
 	}
 
+	reg := &registry.Registry{Config: regConfig}
+
+	var signer *sign.Signer
+	if f.Sign {
+		if signer, err = sign.LoadSigner(f.SigningKey); err != nil {
+			return err
+		}
+	}
+
+	var spec *imagetest.Spec
+	if f.Verify != "" {
+		if spec, err = imagetest.LoadSpec(f.Verify); err != nil {
+			return err
+		}
+	}
+
+	var base *recipe.ImagineRecipe
+	if f.SizeReport {
+		if base, err = f.baseRecipe(g, ir); err != nil {
+			fmt.Printf("image size is not compared to base image: %s\n", err)
+		}
+	}
+
 	rb := rebuilder.Rebuilder{
-		RegistryAPI: &registry.Registry{},
+		RegistryAPI: reg,
+		Concurrency: f.RegistryConcurrency,
+	}
+	if signer != nil {
+		rb.Signatures = &sign.SignatureChecker{Registry: reg, Verifier: signer.Verifier()}
 	}
 
 	rebuild, reason, err := rb.ShouldRebuild(m)
 	if err != nil {
 		return err
 	}
-	if f.Export {
+	if f.Export || f.ExportDir != "" {
 		rebuild = true
 		reason = "forcing image rebuild due to export option being set"
 	}
+	if f.VerifyReproducible {
+		rebuild = true
+		reason = "forcing image rebuild due to verify-reproducible option being set"
+	}
 	if f.Force {
 		rebuild = true
 		reason = "forcing image rebuild due to force option being set"
 	}
 	if !rebuild {
+		if spec != nil && len(m.RegistryTags()) != 0 {
+			// the existing image may have been pushed with different
+			// assertions or without any, so these are checked again
+			if err := f.checkPushedImage(reg, base, m.RegistryTags()[0], spec); err != nil {
+				return err
+			}
+		}
+		if signer != nil {
+			unsigned, err := rb.UnsignedRefs(m.RegistryTags()...)
+			if err != nil {
+				return err
+			}
+			if len(unsigned) != 0 {
+				fmt.Println("no need to rebuild, signing existing images")
+				return signer.SignRefs(reg, unsigned...)
+			}
+		}
 		fmt.Println("no need to rebuild")
 		return nil
 	}
@@ -141,12 +345,117 @@ func (f *Flags) RunBuildCmd() error {
 		return err
 	}
 
-	bx := buildx.Buildx{
-		Builder: f.Builder,
+	bx, cleanup, err := f.baker(regConfig)
+	defer cleanup()
+	if err != nil {
+		return err
 	}
-	if err := bx.Bake(filename); err != nil {
+	// tests are built separately, as bake doesn't guarantee any
+	// ordering of targets and the image must only be pushed once
+	// all of the tests pass
+	if testTargets := m.TestTargets(); len(testTargets) != 0 {
+		for _, testReportExport := range m.TestReportExports() {
+			if err := os.RemoveAll(testReportExport.Source); err != nil {
+				return err
+			}
+		}
+		results := buildx.RunTests(bx, filename, testTargets...)
+		checkTestStatus(results, m.TestReportExports())
+		testErr := buildx.ReportTestResults(os.Stdout, results)
+		if err := copyTestReports(m.TestReportExports()); err != nil {
+			return err
+		}
+		if testErr != nil {
+			return testErr
+		}
+	}
+	if f.VerifyReproducible {
+		if err := f.verifyReproducible(ir, bx); err != nil {
+			return err
+		}
+	}
+	startedOn := time.Now()
+	if err := bx.Bake(filename, m.ImageTargets()); err != nil {
 		return err
 	}
+	finishedOn := time.Now()
+	// digests that were looked up before the build are out of
+	// date once BuildKit pushes, e.g. when rebuild is forced
+	reg.Forget(m.RegistryTags()...)
+	if m.PushArchive() != "" {
+		if err := f.checkAndPush(reg, base, m, spec); err != nil {
+			return err
+		}
+	} else if created := m.NormaliseTimestamps(); f.Push && !created.IsZero() && len(m.RegistryTags()) != 0 {
+		if err := normalisePushedImage(reg, m.RegistryTags(), created); err != nil {
+			return err
+		}
+	}
+	if f.Push {
+		for _, ref := range m.RegistryTags() {
+			err := reg.Annotate(ref, m.Annotations())
+			if errors.Is(err, registry.ErrAnnotationsNotSupported) {
+				fmt.Printf("%s, the image is left as is\n", err)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("unable to annotate %q: %w", ref, err)
+			}
+		}
+	}
+	pushed := f.Push && len(m.RegistryTags()) != 0
+	if (spec != nil || f.SizeReport) && pushed && m.PushArchive() == "" {
+		// all of the tags refer to the same image
+		if err := f.checkPushedImage(reg, base, m.RegistryTags()[0], spec); err != nil {
+			return err
+		}
+	}
+	var attestArchive func(*export.Artifact, []string) error
+	if f.Provenance || f.SBOM {
+		buildInfo, err := newBuildInfo(g, ir)
+		if err != nil {
+			return err
+		}
+		buildInfo.BuilderID = builderID(bx)
+		buildInfo.StartedOn, buildInfo.FinishedOn = startedOn, finishedOn
+		buildInfo.Reproducible = f.VerifyReproducible
+
+		if pushed {
+			if err := f.attestPushedImage(reg, buildInfo, m.RegistryTags()); err != nil {
+				return err
+			}
+		} else {
+			if f.AttestationsDir == "" {
+				f.AttestationsDir = initialWD
+			}
+			attestArchive = func(artifact *export.Artifact, refNames []string) error {
+				_, err := f.attest(artifact, buildInfo, refNames)
+				return err
+			}
+		}
+	}
+	if signer != nil {
+		if err := signer.SignRefs(reg, m.RegistryTags()...); err != nil {
+			return err
+		}
+	}
+	checkArchive := attestArchive
+	if (spec != nil || f.SizeReport) && !pushed {
+		checkArchive = func(artifact *export.Artifact, refNames []string) error {
+			if err := f.checkImage(reg, base, f.Name, artifact, spec); err != nil {
+				return err
+			}
+			if attestArchive != nil {
+				return attestArchive(artifact, refNames)
+			}
+			return nil
+		}
+	}
+	for _, postBuildExport := range m.PostBuildExports() {
+		if err := runPostBuildExport(reg, postBuildExport, checkArchive); err != nil {
+			return err
+		}
+	}
 	if !f.Debug {
 		if err := os.RemoveAll(filename); err != nil {
 			return err
@@ -156,3 +465,377 @@ func (f *Flags) RunBuildCmd() error {
 	}
 	return nil
 }
+
+// verifyReproducible builds the image twice without cache and
+// compares digests
+func (f *Flags) verifyReproducible(ir *recipe.ImagineRecipe, bx buildx.Baker) error {
+	digests := []string{}
+	for n := 1; n <= 2; n++ {
+		fmt.Printf("building image for reproducibility check (%d/2)\n", n)
+		digest, err := f.reproducibilityCheckBuild(ir, bx, n)
+		if err != nil {
+			return err
+		}
+		digests = append(digests, digest)
+	}
+	if digests[0] != digests[1] {
+		hint := ""
+		if !ir.NormaliseTimestamps {
+			hint = " (timestamps were not normalised, --normalise-timestamps may help)"
+		}
+		return fmt.Errorf("image is not reproducible, digests of two builds differ: %q and %q%s", digests[0], digests[1], hint)
+	}
+	fmt.Printf("image is reproducible, both builds have digest %q\n", digests[0])
+	return nil
+}
+
+func (f *Flags) reproducibilityCheckBuild(ir *recipe.ImagineRecipe, bx buildx.Baker, n int) (string, error) {
+	archive := ir.ReproducibilityCheckArchivePath(n)
+	defer os.RemoveAll(archive)
+
+	m, err := ir.ToReproducibilityCheckBakeManifest(archive)
+	if err != nil {
+		return "", err
+	}
+	filename := filepath.Join(ir.BaseDir, fmt.Sprintf("buildx-%s-reproducibility-check-%d.json", ir.Name, n))
+	if err := m.WriteFile(filename); err != nil {
+		return "", err
+	}
+	if !f.Debug {
+		defer os.RemoveAll(filename)
+	}
+	if err := bx.Bake(filename, nil); err != nil {
+		return "", err
+	}
+
+	artifact, cleanup, err := export.FromArchive(archive)
+	defer cleanup()
+	if err != nil {
+		return "", err
+	}
+	if created := m.NormaliseTimestamps(); !created.IsZero() {
+		if artifact, err = export.NormaliseTimestamps(artifact, created); err != nil {
+			return "", err
+		}
+	}
+	digest, err := artifact.Digest()
+	if err != nil {
+		return "", err
+	}
+	return digest.String(), nil
+}
+
+// checkTestStatus marks tests as failed based on status files, as test
+// stages write these and succeed when tests fail, so that buildx
+// exports reports of failing tests
+func checkTestStatus(results []buildx.TestResult, testReportExports []recipe.TestReportExport) {
+	for _, testReportExport := range testReportExports {
+		for i := range results {
+			if results[i].Target != testReportExport.Target || results[i].Err != nil {
+				continue
+			}
+			for _, statusPath := range testReportExport.StatusPaths {
+				data, err := ioutil.ReadFile(filepath.Join(testReportExport.Source, filepath.FromSlash(statusPath)))
+				if err != nil {
+					results[i].Err = fmt.Errorf("unable to read test status: %w", err)
+					break
+				}
+				if status := strings.TrimSpace(string(data)); status != "0" {
+					results[i].Err = fmt.Errorf("tests exited with status %q (%s)", status, statusPath)
+					break
+				}
+			}
+		}
+	}
+}
+
+// copyTestReports copies reports from filesystems of test stages, test
+// stages that failed are skipped, as buildx doesn't export anything,
+// reports that don't exist are skipped as well, as not every test stage
+// produces all of them
+func copyTestReports(testReportExports []recipe.TestReportExport) error {
+	for _, testReportExport := range testReportExports {
+		if _, err := os.Stat(testReportExport.Source); os.IsNotExist(err) {
+			fmt.Printf("no test reports exported for %q\n", testReportExport.Target)
+			continue
+		}
+		missing, err := export.CopyFiles(testReportExport.Source, testReportExport.Dest, testReportExport.Paths...)
+		for _, p := range missing {
+			fmt.Printf("test report %q not found in %q\n", p, testReportExport.Target)
+		}
+		if cleanupErr := os.RemoveAll(testReportExport.Source); err == nil {
+			err = cleanupErr
+		}
+		if err != nil {
+			return fmt.Errorf("unable to copy test reports of %q: %w", testReportExport.Target, err)
+		}
+		fmt.Printf("copied test reports of %q to %q\n", testReportExport.Target, testReportExport.Dest)
+	}
+	return nil
+}
+
+// normalisePushedImage rewrites image configs of the pushed image, as
+// all of the refs point to the same image, it is only fetched once
+func normalisePushedImage(reg *registry.Registry, refs []string, created time.Time) error {
+	desc, err := reg.Get(refs[0])
+	if err != nil {
+		return fmt.Errorf("unable to fetch pushed image %q: %w", refs[0], err)
+	}
+	artifact, err := export.FromRemote(desc)
+	if err != nil {
+		return err
+	}
+	if artifact, err = export.NormaliseTimestamps(artifact, created); err != nil {
+		return fmt.Errorf("unable to normalise timestamps of %q: %w", refs[0], err)
+	}
+	for _, ref := range refs {
+		if err := reg.Push(ref, artifact); err != nil {
+			return fmt.Errorf("unable to push %q: %w", ref, err)
+		}
+	}
+	return nil
+}
+
+// newBuildInfo returns build parameters and source metadata that are
+// recorded in provenance, builder and timing info is not set
+func newBuildInfo(g *git.GitRepo, ir *recipe.ImagineRecipe) (*attest.BuildInfo, error) {
+	sourceInfo, err := ir.Scope.SourceInfo()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get source info: %w", err)
+	}
+	args, err := ir.BuildArgs()
+	if err != nil {
+		return nil, err
+	}
+	// the path is recorded relative to the repository, so that
+	// it doesn't depend on where it was checked out or built from
+	dockerfile, err := filepath.Rel(g.TopLevel, ir.Scope.DockerfilePath())
+	if err != nil {
+		return nil, err
+	}
+	return &attest.BuildInfo{
+		Source:     sourceInfo.Source,
+		Revision:   sourceInfo.Revision,
+		Dockerfile: filepath.ToSlash(dockerfile),
+		Args:       args,
+		Platforms:  ir.Platforms,
+	}, nil
+}
+
+func builderID(bx buildx.Baker) string {
+	switch bx := bx.(type) {
+	case *buildx.Native:
+		return bx.Address
+	case *buildx.Buildx:
+		return "docker-buildx://" + bx.Builder
+	default:
+		return ""
+	}
+}
+
+// attest generates attestations and writes them to attestations
+// directory, if one is set
+func (f *Flags) attest(artifact *export.Artifact, buildInfo *attest.BuildInfo, refs []string) (*attest.Attestations, error) {
+	options := attest.Options{
+		Provenance: f.Provenance,
+		SBOM:       f.SBOM,
+		BuildInfo:  buildInfo,
+	}
+	attestations, err := attest.Generate(artifact, options, refs...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate attestations: %w", err)
+	}
+	if f.AttestationsDir != "" {
+		filenames, err := attestations.WriteFiles(f.AttestationsDir, f.Name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to write attestations: %w", err)
+		}
+		for _, filename := range filenames {
+			fmt.Printf("wrote attestation %q\n", filename)
+		}
+	}
+	return attestations, nil
+}
+
+func (f *Flags) attestPushedImage(reg *registry.Registry, buildInfo *attest.BuildInfo, refs []string) error {
+	desc, err := reg.Get(refs[0])
+	if err != nil {
+		return fmt.Errorf("unable to fetch pushed image %q: %w", refs[0], err)
+	}
+	artifact, err := export.FromRemote(desc)
+	if err != nil {
+		return err
+	}
+	attestations, err := f.attest(artifact, buildInfo, refs)
+	if err != nil {
+		return err
+	}
+	attachmentRefs, err := attest.Attach(reg, desc.Digest, attestations.Statements(), refs...)
+	if err != nil {
+		return err
+	}
+	for _, attachmentRef := range attachmentRefs {
+		fmt.Printf("attached attestations to %q\n", attachmentRef)
+	}
+	return nil
+}
+
+// checkPushedImage runs image tests and size report for the
+// image pushed to ref
+func (f *Flags) checkPushedImage(reg *registry.Registry, base *recipe.ImagineRecipe, ref string, spec *imagetest.Spec) error {
+	desc, err := reg.Get(ref)
+	if err != nil {
+		return fmt.Errorf("unable to fetch pushed image %q: %w", ref, err)
+	}
+	artifact, err := export.FromRemote(desc)
+	if err != nil {
+		return err
+	}
+	return f.checkImage(reg, base, ref, artifact, spec)
+}
+
+// checkAndPush checks the image that buildx wrote to the push archive
+// and pushes it to all of the registry tags, so that nothing is pushed
+// unless the checks pass
+func (f *Flags) checkAndPush(reg *registry.Registry, base *recipe.ImagineRecipe, m *recipe.BakeManifest, spec *imagetest.Spec) error {
+	defer os.RemoveAll(m.PushArchive())
+	artifact, cleanup, err := export.FromArchive(m.PushArchive())
+	defer cleanup()
+	if err != nil {
+		return err
+	}
+	if created := m.NormaliseTimestamps(); !created.IsZero() {
+		if artifact, err = export.NormaliseTimestamps(artifact, created); err != nil {
+			return err
+		}
+	}
+	if err := f.checkImage(reg, base, m.RegistryTags()[0], artifact, spec); err != nil {
+		return err
+	}
+	for _, ref := range m.RegistryTags() {
+		if err := reg.Push(ref, artifact); err != nil {
+			return fmt.Errorf("unable to push %q: %w", ref, err)
+		}
+		fmt.Printf("pushed %q\n", ref)
+	}
+	return nil
+}
+
+// checkImage runs image tests when spec is set, and reports image
+// size when it's enabled, comparing it to the base image if it's set
+func (f *Flags) checkImage(reg *registry.Registry, base *recipe.ImagineRecipe, name string, artifact *export.Artifact, spec *imagetest.Spec) error {
+	if spec != nil {
+		if err := imagetest.Test(os.Stdout, name, artifact, spec); err != nil {
+			return err
+		}
+	}
+	if !f.SizeReport {
+		return nil
+	}
+	current, err := imagesize.Measure(artifact)
+	if err != nil {
+		return err
+	}
+	budget, err := f.Budget()
+	if err != nil {
+		return err
+	}
+	baseRef, baseStats, err := f.baseImageSize(reg, base)
+	if err != nil {
+		return err
+	}
+	return imagesize.Report(os.Stdout, name, baseRef, f.SizeBudgetMode, imagesize.Compare(current, baseStats, budget))
+}
+
+// baseRecipe returns recipe of the image published from the base
+// branch before the current changes, its tags are made for the
+// base revision the same way as for the image itself
+func (f *Flags) baseRecipe(g git.Git, ir *recipe.ImagineRecipe) (*recipe.ImagineRecipe, error) {
+	rev, err := recipe.BaseRevision(g, f.UpstreamBranch)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find base revision: %w", err)
+	}
+	return &recipe.ImagineRecipe{
+		Name:            ir.Name,
+		CustomTagSuffix: ir.CustomTagSuffix,
+		Scope:           f.ImageScopeForRevision(g, ir.BaseDir, rev),
+	}, nil
+}
+
+// baseImageSize measures the base image, it returns nil stats when
+// there is no base image to compare to
+func (f *Flags) baseImageSize(reg *registry.Registry, base *recipe.ImagineRecipe) (string, []imagesize.Stats, error) {
+	if base == nil {
+		return "", nil, nil
+	}
+	baseRefs, err := base.RegistryTags(f.Registries...)
+	if err != nil {
+		fmt.Printf("image size is not compared to base image: %s\n", err)
+		return "", nil, nil
+	}
+	for _, ref := range baseRefs {
+		desc, err := reg.Get(ref)
+		if registry.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("unable to fetch base image %q: %w", ref, err)
+		}
+		artifact, err := export.FromRemote(desc)
+		if err != nil {
+			return "", nil, err
+		}
+		stats, err := imagesize.Measure(artifact)
+		return ref, stats, err
+	}
+	if len(baseRefs) != 0 {
+		fmt.Printf("image size is not compared to base image: %q not found\n", baseRefs[0])
+	}
+	return "", nil, nil
+}
+
+// runPostBuildExport writes the export, attestArtifact is called with
+// the exported artifact unless it's nil
+func runPostBuildExport(reg *registry.Registry, postBuildExport recipe.PostBuildExport, attestArtifact func(*export.Artifact, []string) error) error {
+	var artifact *export.Artifact
+
+	if postBuildExport.Ref != "" {
+		fmt.Printf("exporting %q to %q\n", postBuildExport.Ref, postBuildExport.Dest)
+		desc, err := reg.Get(postBuildExport.Ref)
+		if err != nil {
+			return fmt.Errorf("unable to fetch pushed image %q: %w", postBuildExport.Ref, err)
+		}
+		artifact, err = export.FromRemote(desc)
+		if err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("exporting to %q\n", postBuildExport.Dest)
+		defer os.RemoveAll(postBuildExport.Archive)
+		var (
+			cleanup func()
+			err     error
+		)
+		artifact, cleanup, err = export.FromArchive(postBuildExport.Archive)
+		defer cleanup()
+		if err != nil {
+			return err
+		}
+	}
+
+	if created := postBuildExport.NormaliseTimestamps; !created.IsZero() {
+		var err error
+		if artifact, err = export.NormaliseTimestamps(artifact, created); err != nil {
+			return err
+		}
+	}
+	artifact.Annotations = postBuildExport.Annotations
+
+	if attestArtifact != nil {
+		if err := attestArtifact(artifact, postBuildExport.RefNames); err != nil {
+			return err
+		}
+	}
+
+	return export.Write(postBuildExport.Format, postBuildExport.Dest, artifact, postBuildExport.RefNames...)
+}
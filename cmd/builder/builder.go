@@ -0,0 +1,169 @@
+package builder
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/errordeveloper/imagine/pkg/buildx"
+	"github.com/errordeveloper/imagine/pkg/config"
+)
+
+type Flags struct {
+	*config.BuilderFlags
+	*config.RegistryFlags
+
+	Name      string
+	All       bool
+	Debug     bool
+	OlderThan time.Duration
+}
+
+func BuilderCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "builder",
+		Short: "manage buildx builders created by imagine",
+	}
+
+	cmd.AddCommand(listCmd())
+	cmd.AddCommand(createCmd())
+	cmd.AddCommand(pruneCmd())
+
+	return cmd
+}
+
+func listCmd() *cobra.Command {
+	flags := &Flags{}
+
+	cmd := &cobra.Command{
+		Use:  "list",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return flags.RunListCmd()
+		},
+	}
+
+	cmd.Flags().BoolVar(&flags.All, "all", false, "list all builders, not only those managed by imagine")
+
+	return cmd
+}
+
+func createCmd() *cobra.Command {
+	flags := &Flags{
+		BuilderFlags:  &config.BuilderFlags{},
+		RegistryFlags: &config.RegistryFlags{},
+	}
+
+	cmd := &cobra.Command{
+		Use:  "create",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return flags.RunCreateCmd()
+		},
+	}
+
+	flags.BuilderFlags.Register(cmd)
+	flags.RegistryFlags.Register(cmd)
+
+	cmd.Flags().StringVar(&flags.Name, "name", "", "name of the builder (a random name with '"+buildx.ManagedBuilderPrefix+"' prefix is used by default)")
+	cmd.Flags().BoolVar(&flags.Debug, "debug", false, "print debuging info")
+
+	return cmd
+}
+
+func pruneCmd() *cobra.Command {
+	flags := &Flags{}
+
+	cmd := &cobra.Command{
+		Use:   "prune [<name>...]",
+		Short: "delete builders that imagine created some time ago, or the given builders",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return flags.RunPruneCmd(args)
+		},
+	}
+
+	cmd.Flags().DurationVar(&flags.OlderThan, "older-than", 24*time.Hour, "only delete builders created longer than this ago, as newer ones may be in use")
+
+	return cmd
+}
+
+func (f *Flags) RunListCmd() error {
+	builders, err := buildx.List()
+	if err != nil {
+		return err
+	}
+	for _, builder := range builders {
+		if builder.Managed || f.All {
+			fmt.Printf("%s\t%s\n", builder.Name, builder.Driver)
+		}
+	}
+	return nil
+}
+
+func (f *Flags) RunCreateCmd() error {
+	bx := buildx.New()
+	if f.Name != "" {
+		bx.Builder = f.Name
+	}
+	bx.Debug = f.Debug
+	bx.Driver = f.Driver
+	bx.DriverOpts = f.DriverOpts
+
+	regConfig, err := f.RegistryConfig()
+	if err != nil {
+		return err
+	}
+	configFile, cleanup, err := regConfig.WriteBuildKitConfig(f.ConfigFile)
+	defer cleanup()
+	if err != nil {
+		return err
+	}
+	bx.ConfigFile = configFile
+
+	created, err := bx.EnsureBuilder()
+	if err != nil {
+		return err
+	}
+	if !created {
+		return fmt.Errorf("builder %q already exists", bx.Builder)
+	}
+	fmt.Println(bx.Builder)
+	return nil
+}
+
+func (f *Flags) RunPruneCmd(names []string) error {
+	builders, err := buildx.List()
+	if err != nil {
+		return err
+	}
+
+	var prunable []buildx.BuilderInfo
+	if len(names) == 0 {
+		prunable = buildx.Prunable(builders, time.Now().Add(-f.OlderThan))
+	} else {
+		known := map[string]buildx.BuilderInfo{}
+		for _, builder := range builders {
+			known[builder.Name] = builder
+		}
+		for _, name := range names {
+			builder, ok := known[name]
+			if !ok {
+				return fmt.Errorf("builder %q does not exist", name)
+			}
+			if !builder.Managed {
+				return fmt.Errorf("builder %q was not created by imagine", name)
+			}
+			prunable = append(prunable, builder)
+		}
+	}
+
+	for _, builder := range prunable {
+		bx := &buildx.Buildx{Builder: builder.Name}
+		fmt.Printf("deleting builder %q\n", bx.Builder)
+		if err := bx.Delete(); err != nil {
+			return fmt.Errorf("unable to delete builder %q: %w", bx.Builder, err)
+		}
+	}
+	return nil
+}
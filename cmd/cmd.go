@@ -4,8 +4,16 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/errordeveloper/imagine/cmd/build"
+	"github.com/errordeveloper/imagine/cmd/builder"
+	"github.com/errordeveloper/imagine/cmd/diff"
 	"github.com/errordeveloper/imagine/cmd/generate"
 	"github.com/errordeveloper/imagine/cmd/image"
+	"github.com/errordeveloper/imagine/cmd/lint"
+	"github.com/errordeveloper/imagine/cmd/promote"
+	"github.com/errordeveloper/imagine/cmd/pusharchive"
+	"github.com/errordeveloper/imagine/cmd/test"
+	"github.com/errordeveloper/imagine/cmd/verify"
+	"github.com/errordeveloper/imagine/cmd/which"
 )
 
 type Command = cobra.Command
@@ -16,4 +24,12 @@ func Root(root *Command) {
 	root.AddCommand(generate.GenerateCmd())
 	root.AddCommand(build.BuildCmd())
 	root.AddCommand(image.ImageCmd())
+	root.AddCommand(lint.LintCmd())
+	root.AddCommand(builder.BuilderCmd())
+	root.AddCommand(pusharchive.PushArchiveCmd())
+	root.AddCommand(promote.PromoteCmd())
+	root.AddCommand(verify.VerifyCmd())
+	root.AddCommand(test.TestCmd())
+	root.AddCommand(diff.DiffCmd())
+	root.AddCommand(which.WhichCmd())
 }
@@ -0,0 +1,120 @@
+package diff
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/errordeveloper/imagine/pkg/config"
+	"github.com/errordeveloper/imagine/pkg/export"
+	"github.com/errordeveloper/imagine/pkg/git"
+	"github.com/errordeveloper/imagine/pkg/imagediff"
+	"github.com/errordeveloper/imagine/pkg/recipe"
+	"github.com/errordeveloper/imagine/pkg/registry"
+)
+
+type Flags struct {
+	*config.BasicFlags
+	*config.RegistryFlags
+}
+
+func DiffCmd() *cobra.Command {
+
+	flags := &Flags{
+		BasicFlags:    &config.BasicFlags{},
+		RegistryFlags: &config.RegistryFlags{},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "diff <rev1> <rev2>",
+		Short: "show differences between images built at two git revisions",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := flags.InitDiffCmd(cmd); err != nil {
+				return err
+			}
+			return flags.RunDiffCmd(args[0], args[1])
+		},
+	}
+
+	flags.BasicFlags.Register(cmd)
+	flags.RegistryFlags.Register(cmd)
+
+	return cmd
+}
+
+func (f *Flags) InitDiffCmd(cmd *cobra.Command) error {
+	if len(f.Registries) == 0 {
+		return fmt.Errorf("at least one --registry must be set")
+	}
+	return nil
+}
+
+func (f *Flags) RunDiffCmd(oldRev, newRev string) error {
+	initialWD, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	g, err := git.New(initialWD)
+	if err != nil {
+		return err
+	}
+
+	regConfig, err := f.RegistryConfig()
+	if err != nil {
+		return err
+	}
+
+	reg := &registry.Registry{Config: regConfig}
+
+	oldRef, oldArtifact, err := f.imageForRevision(reg, g, initialWD, oldRev)
+	if err != nil {
+		return err
+	}
+	newRef, newArtifact, err := f.imageForRevision(reg, g, initialWD, newRev)
+	if err != nil {
+		return err
+	}
+
+	diffs, err := imagediff.Compare(oldArtifact, newArtifact)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("--- %s\n+++ %s\n", oldRef, newRef)
+	imagediff.Write(os.Stdout, diffs)
+	return nil
+}
+
+// imageForRevision computes tags for the revision and fetches
+// the image from the first registry that has it
+func (f *Flags) imageForRevision(reg *registry.Registry, g git.Git, baseDir, rev string) (string, *export.Artifact, error) {
+	ir := &recipe.ImagineRecipe{
+		Name:            f.Name,
+		CustomTagSuffix: f.CustomTagSuffix,
+		Scope:           f.ImageScopeForRevision(g, baseDir, rev),
+	}
+
+	refs, err := ir.RegistryTags(f.Registries...)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, ref := range refs {
+		desc, err := reg.Get(ref)
+		if registry.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("unable to fetch %q: %w", ref, err)
+		}
+		artifact, err := export.FromRemote(desc)
+		if err != nil {
+			return "", nil, err
+		}
+		return ref, artifact, nil
+	}
+	return "", nil, fmt.Errorf("image for revision %q not found (tried %q)", rev, refs)
+}
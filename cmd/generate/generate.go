@@ -3,7 +3,6 @@ package generate
 import (
 	"fmt"
 	"os"
-	"path/filepath"
 
 	"github.com/spf13/cobra"
 
@@ -55,35 +54,28 @@ func (f *Flags) RunGenerateCmd() error {
 
 	ir := &recipe.ImagineRecipe{
 		Name:            f.Name,
-		HasTests:        f.Test,
 		Push:            f.Push,
 		Export:          f.Export,
+		ExportFormat:    f.ExportFormat,
+		ExportDir:       f.ExportDir,
 		Platforms:       f.Platforms,
 		BaseDir:         initialWD,
+		WithoutLabels:   f.WithoutLabels,
 		CustomTagSuffix: f.CustomTagSuffix,
+		TestReports:     f.TestReports,
+		TestReportsDir:  f.TestReportsDir,
+		TestStatus:      f.TestStatus,
 	}
 
-	if f.Root {
-		ir.Scope = &recipe.ImageScopeRootDir{
-			Git:     g,
-			BaseDir: initialWD,
+	ir.Scope = f.ImageScope(g, initialWD)
 
-			RelativeDockerfilePath: filepath.Join(f.Dir, f.Dockerfile),
-
-			WithoutSuffix: f.WithoutSuffix,
-			BaseBranch:    f.UpstreamBranch,
-		}
-	} else {
-		ir.Scope = &recipe.ImageScopeSubDir{
-			Git:     g,
-			BaseDir: initialWD,
-
-			RelativeImageDirPath: f.Dir,
-			Dockerfile:           f.Dockerfile,
+	if ir.TestStages, err = f.TestStages(ir.Scope); err != nil {
+		return err
+	}
+	ir.HasTests = len(ir.TestStages) != 0
 
-			WithoutSuffix: f.WithoutSuffix,
-			BaseBranch:    f.UpstreamBranch,
-		}
+	if ir.Cache, err = f.CacheConfig(g); err != nil {
+		return err
 	}
 
 	// TODO implement usefull cheks:
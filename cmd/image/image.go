@@ -3,7 +3,6 @@ package image
 import (
 	"fmt"
 	"os"
-	"path/filepath"
 
 	"github.com/spf13/cobra"
 
@@ -14,6 +13,8 @@ import (
 
 type Flags struct {
 	*config.BasicFlags
+
+	Revision string
 }
 
 func ImageCmd() *cobra.Command {
@@ -35,6 +36,8 @@ func ImageCmd() *cobra.Command {
 
 	flags.BasicFlags.Register(cmd)
 
+	cmd.Flags().StringVar(&flags.Revision, "rev", "", "git revision to print tags for instead of HEAD (e.g. a commit hash, branch or tag), uncommitted changes are not taken into account")
+
 	return cmd
 }
 
@@ -58,28 +61,7 @@ func (f *Flags) RunImageCmd() error {
 		CustomTagSuffix: f.CustomTagSuffix,
 	}
 
-	if f.Root {
-		ir.Scope = &recipe.ImageScopeRootDir{
-			Git:     g,
-			BaseDir: initialWD,
-
-			RelativeDockerfilePath: filepath.Join(f.Dir, f.Dockerfile),
-
-			WithoutSuffix: f.WithoutSuffix,
-			BaseBranch:    f.UpstreamBranch,
-		}
-	} else {
-		ir.Scope = &recipe.ImageScopeSubDir{
-			Git:     g,
-			BaseDir: initialWD,
-
-			RelativeImageDirPath: f.Dir,
-			Dockerfile:           f.Dockerfile,
-
-			WithoutSuffix: f.WithoutSuffix,
-			BaseBranch:    f.UpstreamBranch,
-		}
-	}
+	ir.Scope = f.ImageScopeForRevision(g, initialWD, f.Revision)
 
 	tags, err := ir.RegistryTags(f.Registries...)
 	if err != nil {
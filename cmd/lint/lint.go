@@ -0,0 +1,86 @@
+package lint
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/errordeveloper/imagine/pkg/config"
+	"github.com/errordeveloper/imagine/pkg/dockerfile"
+	"github.com/errordeveloper/imagine/pkg/git"
+	"github.com/errordeveloper/imagine/pkg/registry"
+)
+
+type Flags struct {
+	*config.BasicFlags
+	*config.LintFlags
+	*config.RegistryFlags
+
+	Test       bool
+	TestStages []string
+	Args       map[string]string
+
+	ResolveDigests bool
+}
+
+func LintCmd() *cobra.Command {
+
+	flags := &Flags{
+		BasicFlags:    &config.BasicFlags{},
+		LintFlags:     &config.LintFlags{Lint: dockerfile.LintModeError},
+		RegistryFlags: &config.RegistryFlags{},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "lint",
+		Short: "check Dockerfile for common problems without building the image",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			if err := flags.InitLintCmd(cmd); err != nil {
+				return err
+			}
+			return flags.RunLintCmd()
+		},
+	}
+
+	flags.BasicFlags.Register(cmd)
+	flags.LintFlags.Register(cmd)
+	flags.RegistryFlags.Register(cmd)
+
+	cmd.Flags().BoolVar(&flags.Test, "test", false, "whether the image is going to be tested, reports any of the test stages that is not defined (same as 'imagine build --test' fails)")
+	cmd.Flags().StringArrayVar(&flags.TestStages, "test-stage", []string{dockerfile.TestStage}, "names of build stages to use for tests, only checked when --test is set")
+	cmd.Flags().StringToStringVar(&flags.Args, "args", nil, "build args")
+	cmd.Flags().BoolVar(&flags.ResolveDigests, "resolve-digests", false, "look up current digests of unpinned base images (through registry mirrors, if any are configured) and include them in the findings")
+
+	return cmd
+}
+
+func (f *Flags) InitLintCmd(cmd *cobra.Command) error {
+	return f.LintFlags.Validate()
+}
+
+func (f *Flags) RunLintCmd() error {
+	initialWD, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	g, err := git.New(initialWD)
+	if err != nil {
+		return err
+	}
+
+	var testStages []string
+	if f.Test {
+		testStages = f.TestStages
+	}
+	var resolveDigest func(string) (string, error)
+	if f.ResolveDigests {
+		regConfig, err := f.RegistryConfig()
+		if err != nil {
+			return err
+		}
+		resolveDigest = (&registry.Registry{Config: regConfig}).BaseImageDigest
+	}
+	return f.LintDockerfile(os.Stdout, f.ImageScope(g, initialWD), testStages, f.Args, resolveDigest)
+}
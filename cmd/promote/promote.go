@@ -0,0 +1,137 @@
+package promote
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/spf13/cobra"
+
+	"github.com/errordeveloper/imagine/pkg/config"
+	"github.com/errordeveloper/imagine/pkg/git"
+	"github.com/errordeveloper/imagine/pkg/promoter"
+	"github.com/errordeveloper/imagine/pkg/recipe"
+	"github.com/errordeveloper/imagine/pkg/registry"
+)
+
+type Flags struct {
+	*config.BasicFlags
+	*config.RegistryFlags
+
+	ToRegistries []string
+	ToTags       []string
+	Force        bool
+}
+
+func PromoteCmd() *cobra.Command {
+
+	flags := &Flags{
+		BasicFlags:    &config.BasicFlags{},
+		RegistryFlags: &config.RegistryFlags{},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "promote",
+		Short: "copy an image that was already built to other registries or tags",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			if err := flags.InitPromoteCmd(cmd); err != nil {
+				return err
+			}
+			return flags.RunPromoteCmd()
+		},
+	}
+
+	flags.BasicFlags.Register(cmd)
+	flags.RegistryFlags.Register(cmd)
+
+	cmd.Flags().StringArrayVar(&flags.ToRegistries, "to-registry", []string{}, "registry prefixes to copy the image to (defaults to source registry)")
+	cmd.Flags().StringArrayVar(&flags.ToTags, "to-tag", []string{}, "tags to copy the image to (defaults to source tag)")
+	cmd.Flags().BoolVar(&flags.Force, "force", false, "allow promoting images with '-dev' or '-wip' suffix")
+
+	return cmd
+}
+
+func (f *Flags) InitPromoteCmd(cmd *cobra.Command) error {
+	if len(f.Registries) != 1 {
+		return fmt.Errorf("exactly one --registry must be set to use as the source")
+	}
+	if len(f.ToRegistries) == 0 && len(f.ToTags) == 0 {
+		return fmt.Errorf("at least one --to-registry or --to-tag must be set")
+	}
+	return nil
+}
+
+func (f *Flags) RunPromoteCmd() error {
+	initialWD, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	g, err := git.New(initialWD)
+	if err != nil {
+		return err
+	}
+
+	ir := &recipe.ImagineRecipe{
+		Name:            f.Name,
+		CustomTagSuffix: f.CustomTagSuffix,
+	}
+
+	ir.Scope = f.ImageScope(g, initialWD)
+
+	srcRefs, err := ir.RegistryTags(f.Registries...)
+	if err != nil {
+		return err
+	}
+	src := srcRefs[0]
+
+	dsts, err := f.destinations(src)
+	if err != nil {
+		return err
+	}
+
+	regConfig, err := f.RegistryConfig()
+	if err != nil {
+		return err
+	}
+
+	p := &promoter.Promoter{
+		RegistryAPI: &registry.Registry{Config: regConfig},
+		Force:       f.Force,
+	}
+
+	fmt.Printf("promoting %q\n", src)
+	digest, err := p.Promote(src, dsts...)
+	if err != nil {
+		return err
+	}
+	for _, dst := range dsts {
+		fmt.Printf("promoted to %q with digest %q\n", dst, digest)
+	}
+	return nil
+}
+
+func (f *Flags) destinations(src string) ([]string, error) {
+	srcTag, err := name.NewTag(src)
+	if err != nil {
+		return nil, err
+	}
+
+	registries := f.ToRegistries
+	if len(registries) == 0 {
+		registries = f.Registries
+	}
+	tags := f.ToTags
+	if len(tags) == 0 {
+		tags = []string{srcTag.TagStr()}
+	}
+
+	dsts := []string{}
+	for _, registry := range registries {
+		for _, tag := range tags {
+			dsts = append(dsts, fmt.Sprintf("%s/%s:%s", registry, f.Name, tag))
+		}
+	}
+	return dsts, nil
+}
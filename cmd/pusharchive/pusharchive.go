@@ -0,0 +1,170 @@
+package pusharchive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/spf13/cobra"
+
+	"github.com/errordeveloper/imagine/pkg/config"
+	"github.com/errordeveloper/imagine/pkg/export"
+	"github.com/errordeveloper/imagine/pkg/git"
+	"github.com/errordeveloper/imagine/pkg/rebuilder"
+	"github.com/errordeveloper/imagine/pkg/recipe"
+	"github.com/errordeveloper/imagine/pkg/registry"
+)
+
+type Flags struct {
+	*config.BasicFlags
+	*config.RegistryFlags
+
+	Archive         string
+	TagsFromArchive bool
+	Force           bool
+}
+
+func PushArchiveCmd() *cobra.Command {
+
+	flags := &Flags{
+		BasicFlags:    &config.BasicFlags{},
+		RegistryFlags: &config.RegistryFlags{},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "push-archive",
+		Short: "push an image archive exported by imagine to registries",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			if err := flags.InitPushArchiveCmd(cmd); err != nil {
+				return err
+			}
+			return flags.RunPushArchiveCmd()
+		},
+	}
+
+	flags.BasicFlags.Register(cmd)
+	flags.RegistryFlags.Register(cmd)
+
+	cmd.Flags().StringVar(&flags.Archive, "archive", "", "path to OCI image layout (tarball or directory) or docker tarball (defaults to 'image-<name>.oci')")
+	cmd.Flags().BoolVar(&flags.TagsFromArchive, "tags-from-archive", false, "use tags recorded in the archive instead of computing them from git")
+	cmd.Flags().BoolVar(&flags.Force, "force", false, "force pushing the image")
+
+	return cmd
+}
+
+func (f *Flags) InitPushArchiveCmd(cmd *cobra.Command) error {
+	if len(f.Registries) == 0 {
+		return fmt.Errorf("at least one --registry must be set")
+	}
+	return nil
+}
+
+func (f *Flags) RunPushArchiveCmd() error {
+	initialWD, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	if f.Archive == "" {
+		f.Archive = fmt.Sprintf("image-%s.oci", f.Name)
+	}
+	archive, err := filepath.Abs(f.Archive)
+	if err != nil {
+		return err
+	}
+
+	artifact, cleanup, err := export.FromArchive(archive)
+	defer cleanup()
+	if err != nil {
+		return fmt.Errorf("unable to read archive %q: %w", archive, err)
+	}
+
+	var refs []string
+	if f.TagsFromArchive {
+		refs, err = f.refsFromArchive(artifact)
+	} else {
+		refs, err = f.refsFromGit(initialWD)
+	}
+	if err != nil {
+		return err
+	}
+
+	regConfig, err := f.RegistryConfig()
+	if err != nil {
+		return err
+	}
+
+	reg := &registry.Registry{Config: regConfig}
+
+	rb := rebuilder.Rebuilder{
+		RegistryAPI: reg,
+		Concurrency: f.RegistryConcurrency,
+	}
+
+	push, reason, err := rb.ShouldPush(refs...)
+	if err != nil {
+		return err
+	}
+	if f.Force {
+		push = true
+		reason = "forcing push due to force option being set"
+	}
+	if !push {
+		fmt.Println("no need to push")
+		return nil
+	}
+	fmt.Println(reason)
+
+	for _, ref := range refs {
+		fmt.Printf("pushing %q\n", ref)
+		if err := reg.Push(ref, artifact); err != nil {
+			return fmt.Errorf("unable to push %q: %w", ref, err)
+		}
+	}
+	return nil
+}
+
+func (f *Flags) refsFromGit(initialWD string) ([]string, error) {
+	g, err := git.New(initialWD)
+	if err != nil {
+		return nil, err
+	}
+
+	ir := &recipe.ImagineRecipe{
+		Name:            f.Name,
+		CustomTagSuffix: f.CustomTagSuffix,
+	}
+
+	ir.Scope = f.ImageScope(g, initialWD)
+
+	return ir.RegistryTags(f.Registries...)
+}
+
+func (f *Flags) refsFromArchive(artifact *export.Artifact) ([]string, error) {
+	tags := []string{}
+	seen := map[string]struct{}{}
+	for _, refName := range artifact.RefNames {
+		tag, err := name.NewTag(refName)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse tag %q recorded in the archive: %w", refName, err)
+		}
+		if _, ok := seen[tag.TagStr()]; ok {
+			continue
+		}
+		seen[tag.TagStr()] = struct{}{}
+		tags = append(tags, tag.TagStr())
+	}
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("no tags recorded in the archive")
+	}
+
+	refs := []string{}
+	for _, registry := range f.Registries {
+		for _, tag := range tags {
+			refs = append(refs, fmt.Sprintf("%s/%s:%s", registry, f.Name, tag))
+		}
+	}
+	return refs, nil
+}
@@ -0,0 +1,137 @@
+package test
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/errordeveloper/imagine/pkg/config"
+	"github.com/errordeveloper/imagine/pkg/export"
+	"github.com/errordeveloper/imagine/pkg/git"
+	"github.com/errordeveloper/imagine/pkg/imagetest"
+	"github.com/errordeveloper/imagine/pkg/recipe"
+	"github.com/errordeveloper/imagine/pkg/registry"
+)
+
+type Flags struct {
+	*config.BasicFlags
+	*config.RegistryFlags
+
+	Spec    string
+	Archive string
+}
+
+func TestCmd() *cobra.Command {
+
+	flags := &Flags{
+		BasicFlags:    &config.BasicFlags{},
+		RegistryFlags: &config.RegistryFlags{},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "test",
+		Short: "check assertions about config and filesystem of an image that was already built",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			if err := flags.InitTestCmd(cmd); err != nil {
+				return err
+			}
+			return flags.RunTestCmd()
+		},
+	}
+
+	flags.BasicFlags.Register(cmd)
+	flags.RegistryFlags.Register(cmd)
+
+	// --name and --base are only needed to compute tags of images in
+	// registries, so these are checked in InitTestCmd instead
+	for _, name := range []string{"name", "base"} {
+		_ = cmd.Flags().SetAnnotation(name, cobra.BashCompOneRequiredFlag, []string{"false"})
+	}
+
+	cmd.Flags().StringVar(&flags.Spec, "spec", "", "path to JSON file with image assertions")
+	cmd.Flags().StringVar(&flags.Archive, "archive", "", "path to OCI or docker archive to test instead of the image in registry")
+
+	return cmd
+}
+
+func (f *Flags) InitTestCmd(cmd *cobra.Command) error {
+	if f.Spec == "" {
+		return fmt.Errorf("--spec must be set")
+	}
+	if f.Archive == "" && len(f.Registries) == 0 {
+		return fmt.Errorf("either --archive or at least one --registry must be set")
+	}
+	if f.Archive != "" && len(f.Registries) != 0 {
+		return fmt.Errorf("--archive cannot be used together with --registry")
+	}
+	if f.Archive == "" && (f.Name == "" || f.Dir == "") {
+		return fmt.Errorf("--name and --base must be set unless --archive is used")
+	}
+	return nil
+}
+
+func (f *Flags) RunTestCmd() error {
+	spec, err := imagetest.LoadSpec(f.Spec)
+	if err != nil {
+		return err
+	}
+
+	if f.Archive != "" {
+		artifact, cleanup, err := export.FromArchive(f.Archive)
+		defer cleanup()
+		if err != nil {
+			return err
+		}
+		return imagetest.Test(os.Stdout, f.Archive, artifact, spec)
+	}
+
+	initialWD, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	g, err := git.New(initialWD)
+	if err != nil {
+		return err
+	}
+
+	ir := &recipe.ImagineRecipe{
+		Name:            f.Name,
+		CustomTagSuffix: f.CustomTagSuffix,
+	}
+
+	ir.Scope = f.ImageScope(g, initialWD)
+
+	refs, err := ir.RegistryTags(f.Registries...)
+	if err != nil {
+		return err
+	}
+
+	regConfig, err := f.RegistryConfig()
+	if err != nil {
+		return err
+	}
+
+	reg := &registry.Registry{Config: regConfig}
+
+	for _, ref := range refs {
+		if err := testRemote(reg, ref, spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func testRemote(reg *registry.Registry, ref string, spec *imagetest.Spec) error {
+	desc, err := reg.Get(ref)
+	if err != nil {
+		return fmt.Errorf("unable to get %q: %w", ref, err)
+	}
+	artifact, err := export.FromRemote(desc)
+	if err != nil {
+		return err
+	}
+	return imagetest.Test(os.Stdout, ref, artifact, spec)
+}
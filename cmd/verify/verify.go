@@ -0,0 +1,102 @@
+package verify
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/errordeveloper/imagine/pkg/config"
+	"github.com/errordeveloper/imagine/pkg/git"
+	"github.com/errordeveloper/imagine/pkg/recipe"
+	"github.com/errordeveloper/imagine/pkg/registry"
+	"github.com/errordeveloper/imagine/pkg/sign"
+)
+
+type Flags struct {
+	*config.BasicFlags
+	*config.RegistryFlags
+
+	Key string
+}
+
+func VerifyCmd() *cobra.Command {
+
+	flags := &Flags{
+		BasicFlags:    &config.BasicFlags{},
+		RegistryFlags: &config.RegistryFlags{},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "verify",
+		Short: "verify signatures of an image that was already built",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			if err := flags.InitVerifyCmd(cmd); err != nil {
+				return err
+			}
+			return flags.RunVerifyCmd()
+		},
+	}
+
+	flags.BasicFlags.Register(cmd)
+	flags.RegistryFlags.Register(cmd)
+
+	cmd.Flags().StringVar(&flags.Key, "key", "", "path to PEM-encoded public key to verify signatures with")
+
+	return cmd
+}
+
+func (f *Flags) InitVerifyCmd(cmd *cobra.Command) error {
+	if f.Key == "" {
+		return fmt.Errorf("--key must be set")
+	}
+	if len(f.Registries) == 0 {
+		return fmt.Errorf("at least one --registry must be set")
+	}
+	return nil
+}
+
+func (f *Flags) RunVerifyCmd() error {
+	initialWD, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	g, err := git.New(initialWD)
+	if err != nil {
+		return err
+	}
+
+	ir := &recipe.ImagineRecipe{
+		Name:            f.Name,
+		CustomTagSuffix: f.CustomTagSuffix,
+	}
+
+	ir.Scope = f.ImageScope(g, initialWD)
+
+	refs, err := ir.RegistryTags(f.Registries...)
+	if err != nil {
+		return err
+	}
+
+	verifier, err := sign.LoadVerifier(f.Key)
+	if err != nil {
+		return err
+	}
+
+	regConfig, err := f.RegistryConfig()
+	if err != nil {
+		return err
+	}
+
+	reg := &registry.Registry{Config: regConfig}
+
+	for _, ref := range refs {
+		if err := verifier.Verify(reg, ref); err != nil {
+			return err
+		}
+		fmt.Printf("verified signature of %q\n", ref)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package which
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/spf13/cobra"
+
+	"github.com/errordeveloper/imagine/pkg/config"
+	"github.com/errordeveloper/imagine/pkg/git"
+	"github.com/errordeveloper/imagine/pkg/recipe"
+)
+
+type Flags struct {
+	*config.BasicFlags
+}
+
+func WhichCmd() *cobra.Command {
+
+	flags := &Flags{
+		BasicFlags: &config.BasicFlags{},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "which <ref>",
+		Short: "find commits that produced the given image tag",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := flags.InitWhichCmd(cmd); err != nil {
+				return err
+			}
+			return flags.RunWhichCmd(args[0])
+		},
+	}
+
+	flags.BasicFlags.Register(cmd)
+
+	return cmd
+}
+
+func (f *Flags) InitWhichCmd(cmd *cobra.Command) error {
+	return nil
+}
+
+func (f *Flags) RunWhichCmd(ref string) error {
+	initialWD, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	g, err := git.New(initialWD)
+	if err != nil {
+		return err
+	}
+
+	ir := &recipe.ImagineRecipe{
+		Name:            f.Name,
+		CustomTagSuffix: f.CustomTagSuffix,
+	}
+
+	ir.Scope = f.ImageScope(g, initialWD)
+
+	tag, devSuffix, err := ir.ParseRegistryTag(ref)
+	if err != nil {
+		return err
+	}
+
+	revisions, err := ir.Scope.FindRevisions(tag)
+	if err != nil {
+		return err
+	}
+	if len(revisions) == 0 {
+		return fmt.Errorf("no commits found that produce %q", ref)
+	}
+
+	fmt.Printf("%q was produced by:\n", ref)
+	for _, r := range revisions {
+		if err := printRevisions(g, r); err != nil {
+			return err
+		}
+	}
+
+	if strings.Contains(devSuffix, "-dev") {
+		fmt.Printf("'-dev' suffix means that the image was built from a commit that was not on %q at the time\n", f.UpstreamBranch)
+	}
+	if strings.Contains(devSuffix, "-wip") {
+		fmt.Println("'-wip' suffix means that the image was built with uncommitted changes on top of the commit")
+	}
+	return nil
+}
+
+func printRevisions(g git.Git, r recipe.TagRevisions) error {
+	created, err := g.CommitTime(r.From, "")
+	if err != nil {
+		return err
+	}
+	switch {
+	case r.Single:
+		fmt.Printf("- commit %s (%s)\n", r.From, created.Format(time.RFC3339))
+	case len(r.Until) == 0:
+		fmt.Printf("- commit %s (%s) and all of its descendants\n", r.From, created.Format(time.RFC3339))
+	default:
+		fmt.Printf("- commit %s (%s) and its descendants up to %s (exclusive)\n", r.From, created.Format(time.RFC3339), strings.Join(r.Until, ", "))
+	}
+
+	branches, err := g.BranchesContaining(r.From)
+	if err != nil {
+		return err
+	}
+	if len(branches) != 0 {
+		fmt.Printf("  branches: %s\n", strings.Join(branches, ", "))
+	} else {
+		fmt.Println("  branches: none")
+	}
+
+	releases, err := g.ReleasesContaining(r.From)
+	if err != nil {
+		return err
+	}
+	// releases that include any of the next changes have a different tag
+	for _, until := range r.Until {
+		laterReleases, err := g.ReleasesContaining(until)
+		if err != nil {
+			return err
+		}
+		releases = excludeReleases(releases, laterReleases)
+	}
+	versions := []string{}
+	for _, release := range releases {
+		versions = append(versions, release.Original())
+	}
+	if len(versions) != 0 {
+		fmt.Printf("  releases: %s\n", strings.Join(versions, ", "))
+	} else {
+		fmt.Println("  releases: none")
+	}
+	return nil
+}
+
+func excludeReleases(releases, excluded []*semver.Version) []*semver.Version {
+	result := []*semver.Version{}
+	for _, release := range releases {
+		found := false
+		for _, e := range excluded {
+			found = found || release.Original() == e.Original()
+		}
+		if !found {
+			result = append(result, release)
+		}
+	}
+	return result
+}
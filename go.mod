@@ -1,11 +1,17 @@
 module github.com/errordeveloper/imagine
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/Masterminds/semver v1.5.0
 	github.com/docker/buildx v0.5.1
+	github.com/docker/cli v20.10.0-beta1.0.20201029214301-1d20b15adc38+incompatible
+	github.com/docker/docker v20.10.0-beta1.0.20201110211921-af34b94a78a1+incompatible
+	github.com/docker/go-units v0.4.0
 	github.com/google/go-containerregistry v0.1.2
+	github.com/moby/buildkit v0.8.1-0.20201205083753-0af7b1b9c693
 	github.com/onsi/gomega v1.9.0
 	github.com/spf13/cobra v1.0.0
+	google.golang.org/grpc v1.29.1
 )
 
 // based on https://github.com/docker/buildx/blob/v0.5.1/go.mod#L61-L68
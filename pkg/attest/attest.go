@@ -0,0 +1,574 @@
+package attest
+
+// Provenance and SBOM attestations in in-toto format, these are
+// attached to pushed images using 'sha256-<digest>.att' tag convention
+// or written to files
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/errordeveloper/imagine/pkg/export"
+	"github.com/errordeveloper/imagine/pkg/registry"
+)
+
+const (
+	StatementType = "https://in-toto.io/Statement/v0.1"
+
+	ProvenancePredicateType = "https://slsa.dev/provenance/v0.2"
+	SBOMPredicateType       = "https://spdx.dev/Document"
+
+	BuildType = "https://github.com/errordeveloper/imagine/build@v1"
+
+	PayloadType = "application/vnd.in-toto+json"
+
+	EnvelopeMediaType types.MediaType = "application/vnd.dsse.envelope.v1+json"
+
+	PredicateTypeAnnotation = "predicateType"
+
+	AttachmentTagSuffix = ".att"
+)
+
+type Subject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// Statement is an in-toto statement, predicate is either Provenance
+// or SPDXDocument
+type Statement struct {
+	Type          string      `json:"_type"`
+	PredicateType string      `json:"predicateType"`
+	Subject       []Subject   `json:"subject"`
+	Predicate     interface{} `json:"predicate"`
+}
+
+// Envelope is a DSSE envelope, signatures are not set at present
+type Envelope struct {
+	PayloadType string      `json:"payloadType"`
+	Payload     []byte      `json:"payload"`
+	Signatures  []Signature `json:"signatures"`
+}
+
+type Signature struct {
+	KeyID string `json:"keyid,omitempty"`
+	Sig   []byte `json:"sig"`
+}
+
+// Envelope returns statement wrapped in a DSSE envelope
+func (s *Statement) Envelope() (*Envelope, error) {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{
+		PayloadType: PayloadType,
+		Payload:     payload,
+		Signatures:  []Signature{},
+	}, nil
+}
+
+// BuildInfo describes how an image was built, it is recorded
+// in provenance
+type BuildInfo struct {
+	BuilderID string
+
+	Source     string
+	Revision   string
+	Dockerfile string
+	Args       map[string]string
+	Platforms  []string
+
+	StartedOn    time.Time
+	FinishedOn   time.Time
+	Reproducible bool
+}
+
+type Provenance struct {
+	Builder    ProvenanceBuilder    `json:"builder"`
+	BuildType  string               `json:"buildType"`
+	Invocation ProvenanceInvocation `json:"invocation"`
+	Metadata   ProvenanceMetadata   `json:"metadata"`
+	Materials  []ProvenanceMaterial `json:"materials,omitempty"`
+}
+
+type ProvenanceBuilder struct {
+	ID string `json:"id"`
+}
+
+type ProvenanceInvocation struct {
+	ConfigSource ProvenanceConfigSource `json:"configSource"`
+	Parameters   ProvenanceParameters   `json:"parameters"`
+}
+
+type ProvenanceConfigSource struct {
+	URI        string            `json:"uri,omitempty"`
+	Digest     map[string]string `json:"digest,omitempty"`
+	EntryPoint string            `json:"entryPoint"`
+}
+
+type ProvenanceParameters struct {
+	Args      map[string]string `json:"args,omitempty"`
+	Platforms []string          `json:"platforms,omitempty"`
+}
+
+type ProvenanceMetadata struct {
+	BuildStartedOn  *time.Time                 `json:"buildStartedOn,omitempty"`
+	BuildFinishedOn *time.Time                 `json:"buildFinishedOn,omitempty"`
+	Completeness    ProvenanceMetadataComplete `json:"completeness"`
+	Reproducible    bool                       `json:"reproducible"`
+}
+
+type ProvenanceMetadataComplete struct {
+	Parameters  bool `json:"parameters"`
+	Environment bool `json:"environment"`
+	Materials   bool `json:"materials"`
+}
+
+type ProvenanceMaterial struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+// NewProvenance returns SLSA provenance statement for the given subjects
+func NewProvenance(info *BuildInfo, subjects ...Subject) *Statement {
+	provenance := &Provenance{
+		Builder:   ProvenanceBuilder{ID: info.BuilderID},
+		BuildType: BuildType,
+		Invocation: ProvenanceInvocation{
+			ConfigSource: ProvenanceConfigSource{
+				EntryPoint: info.Dockerfile,
+			},
+			Parameters: ProvenanceParameters{
+				Args:      info.Args,
+				Platforms: info.Platforms,
+			},
+		},
+		Metadata: ProvenanceMetadata{
+			BuildStartedOn:  optionalTime(info.StartedOn),
+			BuildFinishedOn: optionalTime(info.FinishedOn),
+			Completeness: ProvenanceMetadataComplete{
+				Parameters: true,
+			},
+			Reproducible: info.Reproducible,
+		},
+	}
+
+	if info.Source != "" {
+		material := ProvenanceMaterial{URI: "git+" + info.Source}
+		if info.Revision != "" {
+			material.Digest = map[string]string{"sha1": info.Revision}
+		}
+		provenance.Invocation.ConfigSource.URI = material.URI
+		provenance.Invocation.ConfigSource.Digest = material.Digest
+		provenance.Materials = append(provenance.Materials, material)
+	}
+
+	return &Statement{
+		Type:          StatementType,
+		PredicateType: ProvenancePredicateType,
+		Subject:       subjects,
+		Predicate:     provenance,
+	}
+}
+
+// RepoName strips tag or digest from ref, it doesn't parse the ref,
+// so that local names are kept as they are
+func RepoName(ref string) string {
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref = ref[:i]
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		ref = ref[:i]
+	}
+	return ref
+}
+
+// Subjects returns subjects for each of the refs, tags and digests
+// are stripped from the names, duplicate names are omitted
+func Subjects(digest v1.Hash, refs ...string) []Subject {
+	subjects := []Subject{}
+	seen := map[string]bool{}
+	for _, ref := range refs {
+		repo := RepoName(ref)
+		if seen[repo] {
+			continue
+		}
+		seen[repo] = true
+		subjects = append(subjects, Subject{
+			Name:   repo,
+			Digest: map[string]string{digest.Algorithm: digest.Hex},
+		})
+	}
+	return subjects
+}
+
+// Attestations holds statements generated for an image, SBOMs are
+// keyed by platform
+type Attestations struct {
+	Provenance *Statement
+	SBOMs      map[string]*Statement
+}
+
+// Options define which attestations are generated
+type Options struct {
+	Provenance bool
+	SBOM       bool
+
+	BuildInfo *BuildInfo
+}
+
+// Generate returns attestations for the artifact, refs are used as
+// subject names, digests of the artifact and platform-specific images
+// are used as subject digests
+func Generate(artifact *export.Artifact, options Options, refs ...string) (*Attestations, error) {
+	attestations := &Attestations{
+		SBOMs: map[string]*Statement{},
+	}
+
+	digest, err := artifact.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Provenance {
+		attestations.Provenance = NewProvenance(options.BuildInfo, Subjects(digest, refs...)...)
+	}
+
+	if !options.SBOM {
+		return attestations, nil
+	}
+
+	var created time.Time
+	if options.BuildInfo != nil {
+		created = options.BuildInfo.FinishedOn
+	}
+
+	images, err := artifact.PlatformImages()
+	if err != nil {
+		return nil, err
+	}
+	for platform, img := range images {
+		imgDigest, err := img.Digest()
+		if err != nil {
+			return nil, err
+		}
+		subjects := Subjects(imgDigest, refs...)
+		docName := platform
+		if len(subjects) != 0 {
+			docName = subjects[0].Name + "@" + imgDigest.String()
+		}
+		doc, err := NewSBOM(img, docName, created)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate SBOM for %s: %w", platform, err)
+		}
+		attestations.SBOMs[platform] = &Statement{
+			Type:          StatementType,
+			PredicateType: SBOMPredicateType,
+			Subject:       subjects,
+			Predicate:     doc,
+		}
+	}
+
+	return attestations, nil
+}
+
+// Statements returns all statements, provenance comes first
+// followed by SBOMs sorted by platform
+func (a *Attestations) Statements() []*Statement {
+	statements := []*Statement{}
+	if a.Provenance != nil {
+		statements = append(statements, a.Provenance)
+	}
+	for _, platform := range a.platforms() {
+		statements = append(statements, a.SBOMs[platform])
+	}
+	return statements
+}
+
+func (a *Attestations) platforms() []string {
+	platforms := make([]string, 0, len(a.SBOMs))
+	for platform := range a.SBOMs {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	return platforms
+}
+
+// WriteFiles writes each of the statements to a file in dir, file
+// names are '<prefix>.provenance.json' and '<prefix>.sbom.<platform>.json'
+func (a *Attestations) WriteFiles(dir, prefix string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	files := map[string]*Statement{}
+	if a.Provenance != nil {
+		files[filepath.Join(dir, prefix+".provenance.json")] = a.Provenance
+	}
+	for platform, statement := range a.SBOMs {
+		files[filepath.Join(dir, prefix+".sbom."+platform+".json")] = statement
+	}
+
+	filenames := []string{}
+	for filename, statement := range files {
+		data, err := json.MarshalIndent(statement, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+			return nil, err
+		}
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	return filenames, nil
+}
+
+// AttachmentRef returns ref of the image that holds attachments of the
+// given kind (e.g. '.att') for the image with the given digest in the
+// same repository as ref
+func AttachmentRef(ref string, digest v1.Hash, suffix string) (string, error) {
+	parsedRef, err := name.ParseReference(ref)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%s-%s%s", parsedRef.Context().Name(), digest.Algorithm, digest.Hex, suffix), nil
+}
+
+// Attachment is a blob that is stored as a layer of attachment image
+type Attachment struct {
+	Data        []byte
+	MediaType   types.MediaType
+	Annotations map[string]string
+	Comment     string
+}
+
+// AppendAttachments appends attachments as layers to base, which
+// is either an existing attachment image or nil; existing statements
+// that have the same predicate type as any of the attachments are
+// replaced, so that rebuilds don't accumulate outdated statements
+func AppendAttachments(base v1.Image, attachments ...Attachment) (v1.Image, error) {
+	predicateTypes := map[string]bool{}
+	for _, attachment := range attachments {
+		if predicateType := attachment.Annotations[PredicateTypeAnnotation]; predicateType != "" {
+			predicateTypes[predicateType] = true
+		}
+	}
+
+	addenda := []mutate.Addendum{}
+	if base != nil {
+		existing, err := existingAttachments(base, predicateTypes)
+		if err != nil {
+			return nil, err
+		}
+		addenda = append(addenda, existing...)
+	}
+
+	for _, attachment := range attachments {
+		layer, err := newBlobLayer(attachment.Data, attachment.MediaType)
+		if err != nil {
+			return nil, err
+		}
+		addenda = append(addenda, mutate.Addendum{
+			Layer: layer,
+			History: v1.History{
+				CreatedBy: "imagine",
+				Comment:   attachment.Comment,
+			},
+			Annotations: attachment.Annotations,
+		})
+	}
+	return mutate.Append(mutate.MediaType(empty.Image, types.OCIManifestSchema1), addenda...)
+}
+
+// existingAttachments returns layers of attachment image along with
+// their annotations and history, except for statements of the given
+// predicate types
+func existingAttachments(img v1.Image, skipPredicateTypes map[string]bool) ([]mutate.Addendum, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	history := configFile.History
+	if len(history) != len(layers) || len(manifest.Layers) != len(layers) {
+		return nil, fmt.Errorf("unexpected attachment image with %d layers and %d history entries", len(layers), len(history))
+	}
+
+	addenda := make([]mutate.Addendum, 0, len(layers))
+	for i, layer := range layers {
+		annotations := manifest.Layers[i].Annotations
+		if skipPredicateTypes[annotations[PredicateTypeAnnotation]] {
+			continue
+		}
+		addenda = append(addenda, mutate.Addendum{
+			Layer:       layer,
+			History:     history[i],
+			Annotations: annotations,
+		})
+	}
+	return addenda, nil
+}
+
+// Attachments returns statements as DSSE envelope attachments
+func Attachments(statements ...*Statement) ([]Attachment, error) {
+	attachments := make([]Attachment, 0, len(statements))
+	for _, statement := range statements {
+		envelope, err := statement.Envelope()
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(envelope)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, Attachment{
+			Data:      data,
+			MediaType: EnvelopeMediaType,
+			Annotations: map[string]string{
+				PredicateTypeAnnotation: statement.PredicateType,
+			},
+			Comment: statement.PredicateType,
+		})
+	}
+	return attachments, nil
+}
+
+// blobLayer is an uncompressed layer, it is used for storing
+// arbitrary blobs in images
+type blobLayer struct {
+	data      []byte
+	digest    v1.Hash
+	mediaType types.MediaType
+}
+
+var _ v1.Layer = &blobLayer{}
+
+func newBlobLayer(data []byte, mediaType types.MediaType) (*blobLayer, error) {
+	digest, _, err := v1.SHA256(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return &blobLayer{data: data, digest: digest, mediaType: mediaType}, nil
+}
+
+func (l *blobLayer) Digest() (v1.Hash, error) { return l.digest, nil }
+
+func (l *blobLayer) DiffID() (v1.Hash, error) { return l.digest, nil }
+
+func (l *blobLayer) Compressed() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(l.data)), nil
+}
+
+func (l *blobLayer) Uncompressed() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(l.data)), nil
+}
+
+func (l *blobLayer) Size() (int64, error) { return int64(len(l.data)), nil }
+
+func (l *blobLayer) MediaType() (types.MediaType, error) { return l.mediaType, nil }
+
+// Registry is used for fetching and pushing attachment images
+type Registry interface {
+	Get(ref string) (*remote.Descriptor, error)
+	Push(ref string, artifact *export.Artifact) error
+}
+
+// Attach pushes statements to attachment image of the image with the
+// given digest in each of the repositories refs belong to, statements
+// are added to existing attachment image, if there is one, replacing
+// any statements of the same predicate types
+func Attach(reg Registry, digest v1.Hash, statements []*Statement, refs ...string) ([]string, error) {
+	attachments, err := Attachments(statements...)
+	if err != nil {
+		return nil, err
+	}
+	return AttachTo(reg, digest, AttachmentTagSuffix, func(string) ([]Attachment, error) {
+		return attachments, nil
+	}, refs...)
+}
+
+// AttachTo appends attachments returned by makeAttachments for each of
+// the repositories refs belong to, attachment image is created unless
+// it exists already; repositories makeAttachments returns no attachments
+// for are left as is, and their refs are not returned
+func AttachTo(reg Registry, digest v1.Hash, suffix string, makeAttachments func(repo string) ([]Attachment, error), refs ...string) ([]string, error) {
+	attachmentRefs := []string{}
+	seen := map[string]bool{}
+	for _, ref := range refs {
+		attachmentRef, err := AttachmentRef(ref, digest, suffix)
+		if err != nil {
+			return nil, err
+		}
+		if seen[attachmentRef] {
+			continue
+		}
+		seen[attachmentRef] = true
+
+		base, err := GetAttachmentImage(reg, attachmentRef)
+		if err != nil {
+			return nil, err
+		}
+
+		attachments, err := makeAttachments(RepoName(ref))
+		if err != nil {
+			return nil, err
+		}
+		if len(attachments) == 0 {
+			continue
+		}
+		img, err := AppendAttachments(base, attachments...)
+		if err != nil {
+			return nil, err
+		}
+		if err := reg.Push(attachmentRef, &export.Artifact{Image: img}); err != nil {
+			return nil, fmt.Errorf("unable to push attachment image %q: %w", attachmentRef, err)
+		}
+		attachmentRefs = append(attachmentRefs, attachmentRef)
+	}
+	return attachmentRefs, nil
+}
+
+// GetAttachmentImage returns attachment image, or nil if it doesn't exist
+func GetAttachmentImage(reg Registry, attachmentRef string) (v1.Image, error) {
+	desc, err := reg.Get(attachmentRef)
+	switch {
+	case err == nil:
+		return desc.Image()
+	case registry.IsNotFound(err):
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unable to check attachment image %q: %w", attachmentRef, err)
+	}
+}
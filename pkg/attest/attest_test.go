@@ -0,0 +1,271 @@
+package attest_test
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+
+	. "github.com/errordeveloper/imagine/pkg/attest"
+	"github.com/errordeveloper/imagine/pkg/export"
+	"github.com/errordeveloper/imagine/pkg/internal/testutil"
+	"github.com/errordeveloper/imagine/pkg/registry"
+)
+
+const (
+	dpkgStatus = `Package: base-files
+Status: install ok installed
+Architecture: amd64
+Version: 10.3+deb10u7
+Description: Debian base system miscellaneous files
+ This package contains the basic filesystem hierarchy.
+
+Package: removed-package
+Status: deinstall ok config-files
+Architecture: amd64
+Version: 1.0
+
+Package: libc6
+Status: install ok installed
+Architecture: amd64
+Version: 2.28-10
+`
+	osRelease = `PRETTY_NAME="Debian GNU/Linux 10 (buster)"
+NAME="Debian GNU/Linux"
+ID=debian
+`
+)
+
+func newTestImage(t *testing.T, files map[string]string) v1.Image {
+	layerFiles := []testutil.File{}
+	for name, content := range files {
+		layerFiles = append(layerFiles, testutil.File{Name: name, Typeflag: tar.TypeReg, Content: content})
+	}
+	return testutil.NewImage(t, v1.Config{}, mutate.Addendum{Layer: testutil.NewLayer(t, layerFiles...)})
+}
+
+func TestProvenance(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	digest, err := v1.NewHash("sha256:16c315243fd31c00b80c188123099501ae2ccf9116c315243fd31c00b80c1881")
+	g.Expect(err).ToNot(HaveOccurred())
+
+	subjects := Subjects(digest,
+		"reg1.example.com/imagine/image-1:16c315",
+		"reg1.example.com/imagine/image-1:buildcache",
+		"localhost:5000/imagine/image-1@"+digest.String(),
+		"image-1:16c315",
+	)
+	g.Expect(subjects).To(HaveLen(3))
+	g.Expect(subjects[0].Name).To(Equal("reg1.example.com/imagine/image-1"))
+	g.Expect(subjects[1].Name).To(Equal("localhost:5000/imagine/image-1"))
+	g.Expect(subjects[2].Name).To(Equal("image-1"))
+	g.Expect(subjects[2].Digest).To(Equal(map[string]string{"sha256": digest.Hex}))
+
+	statement := NewProvenance(&BuildInfo{
+		BuilderID:  "docker-buildx://imagine_16c315243fd3",
+		Source:     "https://github.com/errordeveloper/imagine",
+		Revision:   "16c315243fd31c00b80c188123099501ae2ccf91",
+		Dockerfile: "examples/image-1/Dockerfile",
+		Args:       map[string]string{"SOURCE_DATE_EPOCH": "1606818600"},
+		Platforms:  []string{"linux/amd64"},
+		StartedOn:  time.Date(2020, 12, 1, 10, 30, 0, 0, time.UTC),
+	}, subjects[0])
+
+	data, err := json.Marshal(statement)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(data).To(MatchJSON(`{
+		"_type": "https://in-toto.io/Statement/v0.1",
+		"predicateType": "https://slsa.dev/provenance/v0.2",
+		"subject": [
+			{
+				"name": "reg1.example.com/imagine/image-1",
+				"digest": {"sha256": "16c315243fd31c00b80c188123099501ae2ccf9116c315243fd31c00b80c1881"}
+			}
+		],
+		"predicate": {
+			"builder": {"id": "docker-buildx://imagine_16c315243fd3"},
+			"buildType": "https://github.com/errordeveloper/imagine/build@v1",
+			"invocation": {
+				"configSource": {
+					"uri": "git+https://github.com/errordeveloper/imagine",
+					"digest": {"sha1": "16c315243fd31c00b80c188123099501ae2ccf91"},
+					"entryPoint": "examples/image-1/Dockerfile"
+				},
+				"parameters": {
+					"args": {"SOURCE_DATE_EPOCH": "1606818600"},
+					"platforms": ["linux/amd64"]
+				}
+			},
+			"metadata": {
+				"buildStartedOn": "2020-12-01T10:30:00Z",
+				"completeness": {"parameters": true, "environment": false, "materials": false},
+				"reproducible": false
+			},
+			"materials": [
+				{
+					"uri": "git+https://github.com/errordeveloper/imagine",
+					"digest": {"sha1": "16c315243fd31c00b80c188123099501ae2ccf91"}
+				}
+			]
+		}
+	}`))
+}
+
+func TestSBOM(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	img := newTestImage(t, map[string]string{
+		"var/lib/dpkg/status":                 dpkgStatus,
+		"./usr/lib/os-release":                osRelease,
+		"var/lib/dpkg/status.d/distroless-go": "Package: tzdata\nVersion: 2021a-0+deb10u1\nArchitecture: all\n",
+		"usr/bin/foo":                         "foo",
+	})
+	created := time.Date(2020, 12, 1, 10, 30, 0, 0, time.UTC)
+
+	doc, err := NewSBOM(img, "image-1", created)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	g.Expect(doc.SPDXVersion).To(Equal("SPDX-2.2"))
+	g.Expect(doc.CreationInfo.Created).To(Equal("2020-12-01T10:30:00Z"))
+	g.Expect(doc.Packages).To(HaveLen(4))
+	g.Expect(doc.Packages[0].Name).To(Equal("image-1"))
+
+	purls := []string{}
+	for _, pkg := range doc.Packages[1:] {
+		g.Expect(pkg.ExternalRefs).To(HaveLen(1))
+		purls = append(purls, pkg.ExternalRefs[0].ReferenceLocator)
+	}
+	g.Expect(purls).To(Equal([]string{
+		"pkg:deb/debian/base-files@10.3+deb10u7?arch=amd64",
+		"pkg:deb/debian/libc6@2.28-10?arch=amd64",
+		"pkg:deb/debian/tzdata@2021a-0+deb10u1?arch=all",
+	}))
+	g.Expect(doc.Relationships).To(HaveLen(4))
+	g.Expect(doc.Relationships[0].RelationshipType).To(Equal("DESCRIBES"))
+
+	alpine := newTestImage(t, map[string]string{
+		"etc/os-release":       "ID=alpine\n",
+		"lib/apk/db/installed": "C:Q1abc=\nP:musl\nV:1.2.2-r0\nA:x86_64\n\nP:busybox\nV:1.32.1-r3\nA:x86_64\n",
+	})
+	doc, err = NewSBOM(alpine, "image-2", created)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(doc.Packages).To(HaveLen(3))
+	g.Expect(doc.Packages[1].ExternalRefs[0].ReferenceLocator).To(Equal("pkg:apk/alpine/musl@1.2.2-r0?arch=x86_64"))
+	g.Expect(doc.Packages[2].ExternalRefs[0].ReferenceLocator).To(Equal("pkg:apk/alpine/busybox@1.32.1-r3?arch=x86_64"))
+}
+
+func TestGenerateAndAttach(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	host := testutil.StartRegistry(t)
+
+	img := newTestImage(t, map[string]string{
+		"var/lib/dpkg/status": dpkgStatus,
+		"etc/os-release":      osRelease,
+	})
+	digest, err := img.Digest()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	idx := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add: img,
+		Descriptor: v1.Descriptor{
+			Platform: &v1.Platform{OS: "linux", Architecture: "arm64"},
+		},
+	})
+	idxDigest, err := idx.Digest()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	refs := []string{host + "/imagine/image-1:16c315", host + "/release/image-1:16c315"}
+	options := Options{
+		Provenance: true,
+		SBOM:       true,
+		BuildInfo:  &BuildInfo{BuilderID: "tcp://buildkitd:1234"},
+	}
+
+	{
+		attestations, err := Generate(&export.Artifact{Image: img}, options, refs...)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(attestations.SBOMs).To(HaveKey("linux-amd64"))
+	}
+
+	attestations, err := Generate(&export.Artifact{Index: idx}, options, refs...)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	g.Expect(attestations.Provenance.Subject).To(HaveLen(2))
+	g.Expect(attestations.Provenance.Subject[0].Digest).To(HaveKeyWithValue("sha256", idxDigest.Hex))
+	g.Expect(attestations.SBOMs).To(HaveLen(1))
+	g.Expect(attestations.SBOMs).To(HaveKey("linux-arm64"))
+	g.Expect(attestations.SBOMs["linux-arm64"].Subject[0].Digest).To(HaveKeyWithValue("sha256", digest.Hex))
+	g.Expect(attestations.Statements()).To(HaveLen(2))
+
+	dir := t.TempDir()
+	filenames, err := attestations.WriteFiles(dir, "image-1")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(filenames).To(Equal([]string{
+		filepath.Join(dir, "image-1.provenance.json"),
+		filepath.Join(dir, "image-1.sbom.linux-arm64.json"),
+	}))
+
+	reg := &registry.Registry{}
+
+	attachmentRefs, err := Attach(reg, idxDigest, attestations.Statements(), refs...)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(attachmentRefs).To(Equal([]string{
+		host + "/imagine/image-1:sha256-" + idxDigest.Hex + ".att",
+		host + "/release/image-1:sha256-" + idxDigest.Hex + ".att",
+	}))
+
+	_, err = Attach(reg, idxDigest, []*Statement{attestations.Provenance}, refs[0])
+	g.Expect(err).ToNot(HaveOccurred())
+
+	desc, err := reg.Get(attachmentRefs[0])
+	g.Expect(err).ToNot(HaveOccurred())
+	attachment, err := desc.Image()
+	g.Expect(err).ToNot(HaveOccurred())
+	manifest, err := attachment.Manifest()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// provenance is replaced, rather than added again
+	g.Expect(manifest.Layers).To(HaveLen(2))
+	predicateTypes := []string{}
+	for _, layer := range manifest.Layers {
+		g.Expect(layer.MediaType).To(BeEquivalentTo(EnvelopeMediaType))
+		predicateTypes = append(predicateTypes, layer.Annotations[PredicateTypeAnnotation])
+	}
+	g.Expect(predicateTypes).To(Equal([]string{SBOMPredicateType, ProvenancePredicateType}))
+
+	configFile, err := attachment.ConfigFile()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(configFile.History).To(HaveLen(2))
+	g.Expect(configFile.History[0].Comment).To(Equal(SBOMPredicateType))
+	g.Expect(configFile.History[1].Comment).To(Equal(ProvenancePredicateType))
+
+	layers, err := attachment.Layers()
+	g.Expect(err).ToNot(HaveOccurred())
+	rc, err := layers[1].Compressed()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer rc.Close()
+	envelope := &Envelope{}
+	g.Expect(json.NewDecoder(rc).Decode(envelope)).To(Succeed())
+	g.Expect(envelope.PayloadType).To(Equal(PayloadType))
+	statement := &Statement{}
+	g.Expect(json.Unmarshal(envelope.Payload, statement)).To(Succeed())
+	g.Expect(statement.PredicateType).To(Equal(ProvenancePredicateType))
+	g.Expect(statement.Subject).To(Equal(attestations.Provenance.Subject))
+
+	desc, err = reg.Get(attachmentRefs[1])
+	g.Expect(err).ToNot(HaveOccurred())
+	attachment, err = desc.Image()
+	g.Expect(err).ToNot(HaveOccurred())
+	layers, err = attachment.Layers()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(layers).To(HaveLen(2))
+}
@@ -0,0 +1,283 @@
+package attest
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/errordeveloper/imagine/pkg/export"
+)
+
+// SPDXDocument is a minimal SPDX 2.2 document, it describes the image
+// and OS packages that are installed in it
+type SPDXDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      SPDXCreationInfo   `json:"creationInfo"`
+	Packages          []SPDXPackage      `json:"packages"`
+	Relationships     []SPDXRelationship `json:"relationships"`
+}
+
+type SPDXCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type SPDXPackage struct {
+	SPDXID           string            `json:"SPDXID"`
+	Name             string            `json:"name"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	CopyrightText    string            `json:"copyrightText"`
+	ExternalRefs     []SPDXExternalRef `json:"externalRefs,omitempty"`
+}
+
+type SPDXExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type SPDXRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+const (
+	spdxNoAssertion = "NOASSERTION"
+	spdxImageID     = "SPDXRef-Image"
+
+	dpkgStatusFile    = "var/lib/dpkg/status"
+	dpkgStatusDir     = "var/lib/dpkg/status.d"
+	apkInstalledFile  = "lib/apk/db/installed"
+	osReleaseFile     = "etc/os-release"
+	usrOSReleaseFile  = "usr/lib/os-release"
+	dpkgInstalledMark = "installed"
+)
+
+// Package is an OS package found in an image
+type Package struct {
+	Type         string
+	Name         string
+	Version      string
+	Architecture string
+}
+
+func (p *Package) purl(distro string) string {
+	purl := fmt.Sprintf("pkg:%s/%s/%s@%s", p.Type, distro, p.Name, p.Version)
+	if p.Architecture != "" {
+		purl += "?arch=" + p.Architecture
+	}
+	return purl
+}
+
+// NewSBOM scans image filesystem for OS package databases (dpkg and apk)
+// and returns an SPDX document that lists all of the packages
+func NewSBOM(img v1.Image, docName string, created time.Time) (*SPDXDocument, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := readFiles(img, func(name string) bool {
+		switch name {
+		case dpkgStatusFile, apkInstalledFile, osReleaseFile, usrOSReleaseFile:
+			return true
+		}
+		return path.Dir(name) == dpkgStatusDir
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	distro := "unknown"
+	for _, name := range []string{osReleaseFile, usrOSReleaseFile} {
+		if data, ok := files[name]; ok {
+			if id := osReleaseID(data); id != "" {
+				distro = id
+				break
+			}
+		}
+	}
+
+	packages := []Package{}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch {
+		case name == dpkgStatusFile:
+			packages = append(packages, parseDpkgStatus(files[name], true)...)
+		case path.Dir(name) == dpkgStatusDir:
+			// distroless images have a file per package and don't set status
+			packages = append(packages, parseDpkgStatus(files[name], false)...)
+		case name == apkInstalledFile:
+			packages = append(packages, parseAPKInstalled(files[name])...)
+		}
+	}
+
+	if created.IsZero() {
+		created = time.Now()
+	}
+
+	doc := &SPDXDocument{
+		SPDXVersion:       "SPDX-2.2",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              docName,
+		DocumentNamespace: "https://github.com/errordeveloper/imagine/spdx/" + digest.String(),
+		CreationInfo: SPDXCreationInfo{
+			Created:  created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: imagine"},
+		},
+		Packages: []SPDXPackage{{
+			SPDXID:           spdxImageID,
+			Name:             docName,
+			VersionInfo:      digest.String(),
+			DownloadLocation: spdxNoAssertion,
+			LicenseConcluded: spdxNoAssertion,
+			LicenseDeclared:  spdxNoAssertion,
+			CopyrightText:    spdxNoAssertion,
+		}},
+		Relationships: []SPDXRelationship{{
+			SPDXElementID:      "SPDXRef-DOCUMENT",
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: spdxImageID,
+		}},
+	}
+
+	for i, pkg := range packages {
+		id := fmt.Sprintf("SPDXRef-Package-%s-%d", pkg.Type, i)
+		doc.Packages = append(doc.Packages, SPDXPackage{
+			SPDXID:           id,
+			Name:             pkg.Name,
+			VersionInfo:      pkg.Version,
+			DownloadLocation: spdxNoAssertion,
+			LicenseConcluded: spdxNoAssertion,
+			LicenseDeclared:  spdxNoAssertion,
+			CopyrightText:    spdxNoAssertion,
+			ExternalRefs: []SPDXExternalRef{{
+				ReferenceCategory: "PACKAGE_MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  pkg.purl(distro),
+			}},
+		})
+		doc.Relationships = append(doc.Relationships, SPDXRelationship{
+			SPDXElementID:      spdxImageID,
+			RelationshipType:   "CONTAINS",
+			RelatedSPDXElement: id,
+		})
+	}
+
+	return doc, nil
+}
+
+// readFiles returns contents of regular files in the flattened image
+// filesystem for which match returns true
+func readFiles(img v1.Image, match func(string) bool) (map[string][]byte, error) {
+	entries, err := export.ReadFiles(img, func(name string) (bool, bool) {
+		ok := match(name)
+		return ok, ok
+	})
+	if err != nil {
+		return nil, err
+	}
+	files := map[string][]byte{}
+	for name, f := range entries {
+		if f.Header.Typeflag == tar.TypeReg {
+			files[name] = f.Content
+		}
+	}
+	return files, nil
+}
+
+func osReleaseID(data []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "ID=") {
+			return strings.Trim(strings.TrimPrefix(line, "ID="), `"'`)
+		}
+	}
+	return ""
+}
+
+// parseStanzas parses blank-line separated blocks of 'key: value' or
+// 'k:value' lines, continuation lines are ignored
+func parseStanzas(data []byte) []map[string]string {
+	stanzas := []map[string]string{}
+	stanza := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			if len(stanza) != 0 {
+				stanzas = append(stanzas, stanza)
+				stanza = map[string]string{}
+			}
+			continue
+		}
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		if kv := strings.SplitN(line, ":", 2); len(kv) == 2 {
+			stanza[kv[0]] = strings.TrimSpace(kv[1])
+		}
+	}
+	if len(stanza) != 0 {
+		stanzas = append(stanzas, stanza)
+	}
+	return stanzas
+}
+
+func parseDpkgStatus(data []byte, checkStatus bool) []Package {
+	packages := []Package{}
+	for _, stanza := range parseStanzas(data) {
+		if stanza["Package"] == "" {
+			continue
+		}
+		if checkStatus && !strings.HasSuffix(stanza["Status"], dpkgInstalledMark) {
+			continue
+		}
+		packages = append(packages, Package{
+			Type:         "deb",
+			Name:         stanza["Package"],
+			Version:      stanza["Version"],
+			Architecture: stanza["Architecture"],
+		})
+	}
+	return packages
+}
+
+func parseAPKInstalled(data []byte) []Package {
+	packages := []Package{}
+	for _, stanza := range parseStanzas(data) {
+		if stanza["P"] == "" {
+			continue
+		}
+		packages = append(packages, Package{
+			Type:         "apk",
+			Name:         stanza["P"],
+			Version:      stanza["V"],
+			Architecture: stanza["A"],
+		})
+	}
+	return packages
+}
@@ -5,9 +5,21 @@ import (
 	"math/rand"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"github.com/docker/buildx/store"
+	dockerconfig "github.com/docker/cli/cli/config"
 )
 
+// ManagedBuilderPrefix is used for names of builders that imagine creates
+const ManagedBuilderPrefix = "imagine_"
+
 var r = rand.New(rand.NewSource(time.Now().UnixNano()))
 
 func builderName() string {
@@ -18,16 +30,41 @@ func builderName() string {
 	for i := 0; i < length; i++ {
 		randomName[i] = chars[r.Intn(len(chars))]
 	}
-	return fmt.Sprintf("imagine_%s", string(randomName))
+	return ManagedBuilderPrefix + string(randomName)
+}
+
+// Baker builds targets defined in a bake manifest file, the default
+// group is built when targets are not given
+type Baker interface {
+	Bake(filename string, targets []string) error
 }
 
+var _ Baker = &Buildx{}
+
+// Buildx runs bake manifests using docker CLI with buildx plugin
 type Buildx struct {
 	Builder string
 	Debug   bool
+
+	// DockerConfigDir is passed to docker CLI as DOCKER_CONFIG, when set,
+	// buildx state is still kept in the default location
+	DockerConfigDir string
+
+	// the following are only used when creating a builder
+	Driver     string
+	DriverOpts map[string]string
+	ConfigFile string
 }
 
 func (x *Buildx) mkCmd(cmd string, args ...string) *exec.Cmd {
-	return exec.Command("docker", append([]string{"buildx", cmd}, args...)...)
+	c := exec.Command("docker", append([]string{"buildx", cmd}, args...)...)
+	if x.DockerConfigDir != "" {
+		c.Env = append(os.Environ(),
+			"DOCKER_CONFIG="+x.DockerConfigDir,
+			"BUILDX_CONFIG="+storePath(),
+		)
+	}
+	return c
 }
 
 func New() *Buildx {
@@ -36,8 +73,9 @@ func New() *Buildx {
 	}
 }
 
-func (x *Buildx) Bake(filename string, args ...string) error {
-	cmd := x.mkCmd("bake", append([]string{"--builder", x.Builder, "--file", filename}, args...)...)
+func (x *Buildx) Bake(filename string, targets []string) error {
+	args := append([]string{"--builder", x.Builder, "--file", filename}, targets...)
+	cmd := x.mkCmd("bake", args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if x.Debug {
@@ -47,10 +85,28 @@ func (x *Buildx) Bake(filename string, args ...string) error {
 }
 
 func (x *Buildx) Create() error {
-	cmd := x.mkCmd("create", "--name", x.Builder)
+	args := []string{"--name", x.Builder}
+	if x.Driver != "" {
+		args = append(args, "--driver", x.Driver)
+	}
+	driverOpts := make([]string, 0, len(x.DriverOpts))
+	for k, v := range x.DriverOpts {
+		driverOpts = append(driverOpts, k+"="+v)
+	}
+	sort.Strings(driverOpts)
+	for _, driverOpt := range driverOpts {
+		args = append(args, "--driver-opt", driverOpt)
+	}
+	if x.ConfigFile != "" {
+		args = append(args, "--config", x.ConfigFile)
+	}
+
+	cmd := x.mkCmd("create", args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-
+	if x.Debug {
+		fmt.Printf("running %q\n", cmd.String())
+	}
 	return cmd.Run()
 }
 
@@ -61,3 +117,150 @@ func (x *Buildx) Delete() error {
 
 	return cmd.Run()
 }
+
+// Exists checks if builder is known to buildx
+func (x *Buildx) Exists() (bool, error) {
+	builders, err := List()
+	if err != nil {
+		return false, err
+	}
+	for _, builder := range builders {
+		if builder.Name == x.Builder {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// EnsureBuilder creates the builder unless it exists already, it
+// returns true if the builder has been created
+func (x *Buildx) EnsureBuilder() (bool, error) {
+	exists, err := x.Exists()
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+	if err := x.Create(); err != nil {
+		return false, fmt.Errorf("unable to create builder %q: %w", x.Builder, err)
+	}
+	return true, nil
+}
+
+// DeleteOnExit ensures the builder is deleted when the process gets
+// interrupted or terminated, the returned function should be deferred
+// to delete the builder on normal exit; any other cleanups are run
+// after the builder is deleted, same as with CleanupOnExit
+func (x *Buildx) DeleteOnExit(cleanups ...func()) func() {
+	deleteBuilder := func() {
+		fmt.Printf("deleting builder %q\n", x.Builder)
+		if err := x.Delete(); err != nil {
+			fmt.Printf("unable to delete builder %q: %s\n", x.Builder, err)
+		}
+	}
+	return CleanupOnExit(append([]func(){deleteBuilder}, cleanups...)...)
+}
+
+// CleanupOnExit runs the cleanups in the given order when the process
+// gets interrupted or terminated, before it exits, as deferred calls
+// are skipped then; the returned function should be deferred to run
+// the cleanups on normal exit, these are only run once
+func CleanupOnExit(cleanups ...func()) func() {
+	once := &sync.Once{}
+	cleanup := func() {
+		once.Do(func() {
+			for _, cleanup := range cleanups {
+				cleanup()
+			}
+		})
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case sig := <-signals:
+			fmt.Printf("received %s\n", sig)
+			cleanup()
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+
+	stop := &sync.Once{}
+	return func() {
+		stop.Do(func() {
+			signal.Stop(signals)
+			close(done)
+		})
+		cleanup()
+	}
+}
+
+// BuilderInfo describes a builder known to buildx
+type BuilderInfo struct {
+	Name    string
+	Driver  string
+	Managed bool
+
+	// Modified is the last time buildx updated the builder,
+	// normally that is when it was created
+	Modified time.Time
+}
+
+func storePath() string {
+	if buildxConfig := os.Getenv("BUILDX_CONFIG"); buildxConfig != "" {
+		return buildxConfig
+	}
+	return filepath.Join(dockerconfig.Dir(), "buildx")
+}
+
+// List returns all builders known to buildx, excluding the default builder
+func List() ([]BuilderInfo, error) {
+	root := storePath()
+	s, err := store.New(root)
+	if err != nil {
+		return nil, err
+	}
+	txn, release, err := s.Txn()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	nodeGroups, err := txn.List()
+	if err != nil {
+		return nil, err
+	}
+
+	builders := make([]BuilderInfo, 0, len(nodeGroups))
+	for _, ng := range nodeGroups {
+		info, err := os.Stat(filepath.Join(root, "instances", ng.Name))
+		if err != nil {
+			return nil, err
+		}
+		builders = append(builders, BuilderInfo{
+			Name:     ng.Name,
+			Driver:   ng.Driver,
+			Managed:  strings.HasPrefix(ng.Name, ManagedBuilderPrefix),
+			Modified: info.ModTime(),
+		})
+	}
+	return builders, nil
+}
+
+// Prunable returns managed builders that were last modified before the
+// given time, builders that are newer may still be used by a build that
+// is in progress, so these are left alone
+func Prunable(builders []BuilderInfo, before time.Time) []BuilderInfo {
+	prunable := []BuilderInfo{}
+	for _, builder := range builders {
+		if builder.Managed && builder.Modified.Before(before) {
+			prunable = append(prunable, builder)
+		}
+	}
+	return prunable
+}
@@ -0,0 +1,145 @@
+package buildx_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/buildx/store"
+	. "github.com/onsi/gomega"
+
+	. "github.com/errordeveloper/imagine/pkg/buildx"
+)
+
+// saveBuilder writes builder instance file in the same
+// way buildx does, with the given modification time
+func saveBuilder(g *WithT, root, name, driver string, modified time.Time) {
+	dir := filepath.Join(root, "instances")
+	g.Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+	data, err := json.Marshal(&store.NodeGroup{Name: name, Driver: driver})
+	g.Expect(err).ToNot(HaveOccurred())
+	path := filepath.Join(dir, name)
+	g.Expect(ioutil.WriteFile(path, data, 0600)).To(Succeed())
+	g.Expect(os.Chtimes(path, modified, modified)).To(Succeed())
+}
+
+func TestList(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	root := t.TempDir()
+	setenv(t, "BUILDX_CONFIG", root)
+
+	now := time.Now().Truncate(time.Second)
+	saveBuilder(g, root, "imagine_0123456789ab", "docker-container", now.Add(-time.Hour))
+	saveBuilder(g, root, "other", "kubernetes", now)
+
+	builders, err := List()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(builders).To(HaveLen(2))
+
+	g.Expect(builders[0].Name).To(Equal("imagine_0123456789ab"))
+	g.Expect(builders[0].Driver).To(Equal("docker-container"))
+	g.Expect(builders[0].Managed).To(BeTrue())
+	g.Expect(builders[0].Modified).To(BeTemporally("==", now.Add(-time.Hour)))
+
+	g.Expect(builders[1].Name).To(Equal("other"))
+	g.Expect(builders[1].Driver).To(Equal("kubernetes"))
+	g.Expect(builders[1].Managed).To(BeFalse())
+	g.Expect(builders[1].Modified).To(BeTemporally("==", now))
+
+	{
+		bx := &Buildx{Builder: "imagine_0123456789ab"}
+		exists, err := bx.Exists()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(exists).To(BeTrue())
+
+		created, err := bx.EnsureBuilder()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(created).To(BeFalse())
+	}
+
+	{
+		bx := &Buildx{Builder: "imagine_ba9876543210"}
+		exists, err := bx.Exists()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(exists).To(BeFalse())
+	}
+}
+
+func TestPrunable(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	now := time.Now()
+	builders := []BuilderInfo{
+		{Name: "imagine_old", Managed: true, Modified: now.Add(-48 * time.Hour)},
+		{Name: "imagine_new", Managed: true, Modified: now.Add(-time.Minute)},
+		{Name: "other_old", Managed: false, Modified: now.Add(-48 * time.Hour)},
+	}
+
+	prunable := Prunable(builders, now.Add(-24*time.Hour))
+	g.Expect(prunable).To(HaveLen(1))
+	g.Expect(prunable[0].Name).To(Equal("imagine_old"))
+
+	g.Expect(Prunable(builders, now)).To(HaveLen(2))
+	g.Expect(Prunable(nil, now)).To(BeEmpty())
+}
+
+// setenv sets the variable for the duration of the test
+func setenv(t *testing.T, key, value string) {
+	previous, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			_ = os.Setenv(key, previous)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	})
+}
+
+// fakeDocker puts a docker script on PATH that records
+// its arguments in the returned file
+func fakeDocker(t *testing.T, g *WithT) string {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "docker.log")
+	script := "#!/bin/sh\necho \"$@\" >> " + log + "\n"
+	g.Expect(ioutil.WriteFile(filepath.Join(dir, "docker"), []byte(script), 0755)).To(Succeed())
+	setenv(t, "PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return log
+}
+
+func TestEnsureBuilder(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	setenv(t, "BUILDX_CONFIG", t.TempDir())
+	log := fakeDocker(t, g)
+
+	bx := &Buildx{
+		Builder:    "imagine_0123456789ab",
+		Driver:     "docker-container",
+		DriverOpts: map[string]string{"network": "host", "image": "moby/buildkit"},
+		ConfigFile: "buildkitd.toml",
+	}
+	created, err := bx.EnsureBuilder()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(created).To(BeTrue())
+
+	cleanups := 0
+	deleteBuilder := bx.DeleteOnExit(func() { cleanups++ })
+	deleteBuilder()
+	deleteBuilder()
+	g.Expect(cleanups).To(Equal(1))
+
+	data, err := ioutil.ReadFile(log)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(string(data)).To(Equal(
+		"buildx create --name imagine_0123456789ab --driver docker-container" +
+			" --driver-opt image=moby/buildkit --driver-opt network=host --config buildkitd.toml\n" +
+			"buildx rm imagine_0123456789ab\n",
+	))
+}
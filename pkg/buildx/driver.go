@@ -0,0 +1,76 @@
+package buildx
+
+import (
+	"context"
+
+	"github.com/docker/buildx/driver"
+	"github.com/docker/buildx/util/progress"
+	dockerclient "github.com/docker/docker/client"
+	"github.com/moby/buildkit/client"
+
+	// register connection helpers for docker-container:// and kube-pod:// addresses
+	_ "github.com/moby/buildkit/client/connhelper/dockercontainer"
+	_ "github.com/moby/buildkit/client/connhelper/kubepod"
+)
+
+const addressDriverName = "imagine-address"
+
+// addressDriver is a minimal buildx driver that connects to a BuildKit
+// daemon which is already running at a given address, it never attempts
+// to start or stop the daemon
+type addressDriver struct {
+	name       string
+	address    string
+	clientOpts []client.ClientOpt
+}
+
+var _ driver.Driver = &addressDriver{}
+
+func (d *addressDriver) Factory() driver.Factory { return &addressDriverFactory{} }
+
+func (d *addressDriver) Bootstrap(context.Context, progress.Logger) error { return nil }
+
+func (d *addressDriver) Info(context.Context) (*driver.Info, error) {
+	return &driver.Info{Status: driver.Running}, nil
+}
+
+func (d *addressDriver) Stop(context.Context, bool) error { return nil }
+
+func (d *addressDriver) Rm(context.Context, bool) error { return nil }
+
+func (d *addressDriver) Client(ctx context.Context) (*client.Client, error) {
+	return client.New(ctx, d.address, d.clientOpts...)
+}
+
+func (d *addressDriver) Features() map[driver.Feature]bool {
+	return map[driver.Feature]bool{
+		driver.OCIExporter:    true,
+		driver.DockerExporter: true,
+		driver.CacheExport:    true,
+		driver.MultiPlatform:  true,
+	}
+}
+
+func (d *addressDriver) IsMobyDriver() bool { return false }
+
+func (d *addressDriver) Config() driver.InitConfig {
+	return driver.InitConfig{Name: d.name}
+}
+
+// addressDriverFactory is only needed to satisfy driver.Driver interface,
+// it is not registered with buildx
+type addressDriverFactory struct{}
+
+var _ driver.Factory = &addressDriverFactory{}
+
+func (*addressDriverFactory) Name() string { return addressDriverName }
+
+func (*addressDriverFactory) Usage() string { return addressDriverName }
+
+func (*addressDriverFactory) Priority(context.Context, dockerclient.APIClient) int { return 0 }
+
+func (*addressDriverFactory) New(_ context.Context, cfg driver.InitConfig) (driver.Driver, error) {
+	return &addressDriver{name: cfg.Name}, nil
+}
+
+func (*addressDriverFactory) AllowsInstances() bool { return true }
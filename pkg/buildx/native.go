@@ -0,0 +1,216 @@
+package buildx
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/docker/buildx/bake"
+	"github.com/docker/buildx/build"
+	"github.com/docker/buildx/util/progress"
+	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/util/appcontext"
+)
+
+const (
+	defaultBakeTarget = "default"
+
+	exporterImageDigestKey = "containerimage.digest"
+)
+
+// Native runs bake manifests in-process using buildx and BuildKit
+// client libraries, it talks to BuildKit daemon at the given address
+// directly, so neither docker CLI nor buildx plugin are required
+type Native struct {
+	Address  string
+	TLS      *TLSConfig
+	Progress string
+	Debug    bool
+
+	// DockerConfigDir is used instead of the default docker config
+	// directory to obtain registry credentials, when set
+	DockerConfigDir string
+
+	// OnStatus is called for every progress event, it can be used
+	// to observe the build in addition to the progress printer
+	OnStatus func(*client.SolveStatus)
+}
+
+// TLSConfig holds paths to files used for mutual TLS with BuildKit daemon,
+// CA certificate is always required, client certificate and key are optional
+type TLSConfig struct {
+	ServerName string
+	CACert     string
+	Cert       string
+	Key        string
+}
+
+// Result holds the outcome of building a single bake target
+type Result struct {
+	Target           string
+	Digest           string
+	ExporterResponse map[string]string
+}
+
+var _ Baker = &Native{}
+
+func NewNative(address string) *Native {
+	return &Native{
+		Address:  address,
+		Progress: "auto",
+	}
+}
+
+func (x *Native) clientOpts() ([]client.ClientOpt, error) {
+	opts := []client.ClientOpt{}
+	if x.TLS != nil {
+		if x.TLS.CACert == "" {
+			return nil, fmt.Errorf("CA certificate must be set to use TLS")
+		}
+		if (x.TLS.Cert == "") != (x.TLS.Key == "") {
+			return nil, fmt.Errorf("both client certificate and key must be set")
+		}
+		opts = append(opts, client.WithCredentials(x.TLS.ServerName, x.TLS.CACert, x.TLS.Cert, x.TLS.Key))
+	}
+	return opts, nil
+}
+
+func (x *Native) driverInfo() ([]build.DriverInfo, error) {
+	clientOpts, err := x.clientOpts()
+	if err != nil {
+		return nil, err
+	}
+	return []build.DriverInfo{{
+		Name: addressDriverName,
+		Driver: &addressDriver{
+			name:       addressDriverName,
+			address:    x.Address,
+			clientOpts: clientOpts,
+		},
+	}}, nil
+}
+
+// Workers connects to BuildKit daemon and lists its workers, it
+// can be used to check the daemon is reachable
+func (x *Native) Workers(ctx context.Context) ([]*client.WorkerInfo, error) {
+	clientOpts, err := x.clientOpts()
+	if err != nil {
+		return nil, err
+	}
+	c, err := client.New(ctx, x.Address, append(clientOpts, client.WithFailFast())...)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	workers, err := c.ListWorkers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to BuildKit at %q: %w", x.Address, err)
+	}
+	if len(workers) == 0 {
+		return nil, fmt.Errorf("BuildKit at %q has no workers", x.Address)
+	}
+	return workers, nil
+}
+
+func (x *Native) Bake(filename string, targets []string) error {
+	results, err := x.BakeWithResults(appcontext.Context(), filename, targets...)
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		if result.Digest != "" {
+			fmt.Printf("built %q with digest %q\n", result.Target, result.Digest)
+		}
+	}
+	return nil
+}
+
+// BakeWithResults loads bake manifest from the given file and builds the
+// given targets (or the default group), it returns per-target results
+// sorted by target name
+func (x *Native) BakeWithResults(ctx context.Context, filename string, targets ...string) ([]Result, error) {
+	if len(targets) == 0 {
+		targets = []string{defaultBakeTarget}
+	}
+
+	drivers, err := x.driverInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	workers, err := x.Workers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if x.DockerConfigDir != "" {
+		// auth provider that bake attaches to each build reads
+		// the default config, so it has to be set globally
+		dockerconfig.SetDir(x.DockerConfigDir)
+	}
+
+	files, err := bake.ReadLocalFiles([]string{filename})
+	if err != nil {
+		return nil, err
+	}
+
+	bakeTargets, err := bake.ReadTargets(ctx, files, targets, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load bake manifest %q: %w", filename, err)
+	}
+
+	opts, err := bake.TargetsToBuildOpt(bakeTargets, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if x.Debug {
+		fmt.Printf("building %d target(s) from %q using BuildKit at %q (%d worker(s))\n", len(opts), filename, x.Address, len(workers))
+	}
+
+	printerCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	printer := progress.NewPrinter(printerCtx, os.Stderr, x.Progress)
+
+	var w progress.Writer = printer
+	if x.OnStatus != nil {
+		w = &statusWriter{Writer: printer, onStatus: x.OnStatus}
+	}
+
+	dockerConfig := dockerconfig.LoadDefaultConfigFile(os.Stderr)
+
+	resp, err := build.Build(ctx, drivers, opts, nil, dockerConfig, w)
+	if waitErr := printer.Wait(); err == nil {
+		err = waitErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("build failed: %w", err)
+	}
+
+	results := make([]Result, 0, len(resp))
+	for target, solveResponse := range resp {
+		result := Result{
+			Target:           target,
+			ExporterResponse: solveResponse.ExporterResponse,
+		}
+		if solveResponse.ExporterResponse != nil {
+			result.Digest = solveResponse.ExporterResponse[exporterImageDigestKey]
+		}
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Target < results[j].Target })
+	return results, nil
+}
+
+type statusWriter struct {
+	progress.Writer
+	onStatus func(*client.SolveStatus)
+}
+
+func (w *statusWriter) Write(s *client.SolveStatus) {
+	w.onStatus(s)
+	w.Writer.Write(s)
+}
@@ -0,0 +1,85 @@
+package buildx_test
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	controlapi "github.com/moby/buildkit/api/services/control"
+	apitypes "github.com/moby/buildkit/api/types"
+	"github.com/moby/buildkit/solver/pb"
+	"google.golang.org/grpc"
+
+	. "github.com/errordeveloper/imagine/pkg/buildx"
+)
+
+// fakeControl stands in for BuildKit daemon, it only implements
+// the calls that are needed to check connectivity
+type fakeControl struct {
+	controlapi.UnimplementedControlServer
+
+	workers []*apitypes.WorkerRecord
+}
+
+func (c *fakeControl) ListWorkers(context.Context, *controlapi.ListWorkersRequest) (*controlapi.ListWorkersResponse, error) {
+	return &controlapi.ListWorkersResponse{Record: c.workers}, nil
+}
+
+func startFakeBuildKit(t *testing.T, workers ...*apitypes.WorkerRecord) string {
+	socket := filepath.Join(t.TempDir(), "buildkitd.sock")
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer()
+	controlapi.RegisterControlServer(server, &fakeControl{workers: workers})
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+
+	return "unix://" + socket
+}
+
+func TestNativeWorkers(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ctx := context.Background()
+
+	{
+		address := startFakeBuildKit(t, &apitypes.WorkerRecord{
+			ID:        "worker-1",
+			Platforms: []pb.Platform{{OS: "linux", Architecture: "amd64"}},
+		})
+
+		workers, err := NewNative(address).Workers(ctx)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(workers).To(HaveLen(1))
+		g.Expect(workers[0].ID).To(Equal("worker-1"))
+		g.Expect(workers[0].Platforms).To(HaveLen(1))
+		g.Expect(workers[0].Platforms[0].Architecture).To(Equal("amd64"))
+	}
+
+	{
+		address := startFakeBuildKit(t)
+
+		_, err := NewNative(address).Workers(ctx)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("has no workers"))
+	}
+
+	{
+		bx := NewNative(startFakeBuildKit(t))
+		bx.TLS = &TLSConfig{Cert: "client.pem"}
+
+		_, err := bx.Workers(ctx)
+		g.Expect(err).To(MatchError("CA certificate must be set to use TLS"))
+
+		bx.TLS.CACert = "ca.pem"
+		_, err = bx.Workers(ctx)
+		g.Expect(err).To(MatchError("both client certificate and key must be set"))
+	}
+}
@@ -0,0 +1,54 @@
+package buildx
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// TestResult is the outcome of building a single test target
+type TestResult struct {
+	Target   string
+	Duration time.Duration
+	Err      error
+}
+
+// RunTests builds each of the test targets one by one, so that
+// every test runs even if one of the earlier ones fails
+func RunTests(bx Baker, filename string, targets ...string) []TestResult {
+	results := make([]TestResult, 0, len(targets))
+	for _, target := range targets {
+		fmt.Printf("running test target %q\n", target)
+		startedOn := time.Now()
+		err := bx.Bake(filename, []string{target})
+		results = append(results, TestResult{
+			Target:   target,
+			Duration: time.Since(startedOn),
+			Err:      err,
+		})
+	}
+	return results
+}
+
+// ReportTestResults writes a summary of the results to w, it returns an
+// error if any of the tests failed
+func ReportTestResults(w io.Writer, results []TestResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+	failed := 0
+	fmt.Fprintln(w, "test results:")
+	for _, result := range results {
+		duration := result.Duration.Round(100 * time.Millisecond)
+		if result.Err != nil {
+			failed++
+			fmt.Fprintf(w, "  FAIL %s (%s): %s\n", result.Target, duration, result.Err)
+			continue
+		}
+		fmt.Fprintf(w, "  PASS %s (%s)\n", result.Target, duration)
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d test target(s) failed", failed, len(results))
+	}
+	return nil
+}
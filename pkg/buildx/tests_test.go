@@ -0,0 +1,63 @@
+package buildx_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	. "github.com/errordeveloper/imagine/pkg/buildx"
+)
+
+// fakeBaker records targets it was asked to build and
+// fails for the given targets
+type fakeBaker struct {
+	failing map[string]bool
+	built   [][]string
+}
+
+func (b *fakeBaker) Bake(filename string, targets []string) error {
+	b.built = append(b.built, targets)
+	for _, target := range targets {
+		if b.failing[target] {
+			return fmt.Errorf("%s failed", target)
+		}
+	}
+	return nil
+}
+
+func TestRunTests(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	{
+		bx := &fakeBaker{}
+		results := RunTests(bx, "buildx.json", "image-1-unit-test", "image-1-lint")
+		g.Expect(bx.built).To(Equal([][]string{{"image-1-unit-test"}, {"image-1-lint"}}))
+		g.Expect(results).To(HaveLen(2))
+
+		out := &bytes.Buffer{}
+		g.Expect(ReportTestResults(out, results)).To(Succeed())
+		g.Expect(out.String()).To(HavePrefix("test results:\n  PASS image-1-unit-test ("))
+		g.Expect(out.String()).To(ContainSubstring("\n  PASS image-1-lint ("))
+	}
+
+	{
+		bx := &fakeBaker{failing: map[string]bool{"image-1-unit-test": true}}
+		results := RunTests(bx, "buildx.json", "image-1-unit-test", "image-1-lint")
+		g.Expect(bx.built).To(HaveLen(2))
+		g.Expect(results[0].Err).To(MatchError("image-1-unit-test failed"))
+		g.Expect(results[1].Err).ToNot(HaveOccurred())
+
+		out := &bytes.Buffer{}
+		g.Expect(ReportTestResults(out, results)).To(MatchError("1 of 2 test target(s) failed"))
+		g.Expect(out.String()).To(ContainSubstring("  FAIL image-1-unit-test ("))
+		g.Expect(out.String()).To(ContainSubstring("): image-1-unit-test failed\n"))
+	}
+
+	{
+		out := &bytes.Buffer{}
+		g.Expect(ReportTestResults(out, nil)).To(Succeed())
+		g.Expect(out.String()).To(BeEmpty())
+	}
+}
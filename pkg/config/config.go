@@ -1,13 +1,27 @@
 package config
 
 import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
 	"github.com/spf13/cobra"
+
+	"github.com/errordeveloper/imagine/pkg/dockerfile"
+	"github.com/errordeveloper/imagine/pkg/git"
+	"github.com/errordeveloper/imagine/pkg/imagesize"
+	"github.com/errordeveloper/imagine/pkg/rebuilder"
+	"github.com/errordeveloper/imagine/pkg/recipe"
+	"github.com/errordeveloper/imagine/pkg/registry"
 )
 
 const (
 	defaultUpstreamBranch = "origin/master"
 	defaultDockerfile     = "Dockerfile"
 	defaultPlatform       = "linux/amd64"
+	defaultBuilderDriver  = "docker-container"
 )
 
 type BasicFlags struct {
@@ -24,10 +38,49 @@ type BasicFlags struct {
 type CommonFlags struct {
 	*BasicFlags
 
-	Test      bool
-	Push      bool
-	Export    bool
-	Platforms []string
+	Test           bool
+	NoTest         bool
+	TestStageNames []string
+	TestReports    []string
+	TestReportsDir string
+	TestStatus     string
+	Push           bool
+	Export         bool
+	ExportFormat   string
+	ExportDir      string
+	Platforms      []string
+
+	Cache           string
+	CacheExportMode string
+	CacheDir        string
+	CachePerBranch  bool
+	Branch          string
+
+	WithoutLabels bool
+}
+
+type RegistryFlags struct {
+	RegistryConfigFile  string
+	DockerConfigDir     string
+	RegistryConcurrency int
+}
+
+type LintFlags struct {
+	Lint       string
+	LintIgnore []string
+}
+
+type SizeFlags struct {
+	SizeReport     bool
+	SizeBudget     string
+	LayerBudget    int
+	SizeBudgetMode string
+}
+
+type BuilderFlags struct {
+	Driver     string
+	DriverOpts map[string]string
+	ConfigFile string
 }
 
 func (f *BasicFlags) Register(cmd *cobra.Command) {
@@ -54,11 +107,269 @@ func (f *CommonFlags) Register(cmd *cobra.Command) {
 	f.BasicFlags = &BasicFlags{}
 	f.BasicFlags.Register(cmd)
 
-	cmd.Flags().BoolVar(&f.Test, "test", false, "whether to test image first (depends on 'test' build stage being defined)")
+	cmd.Flags().BoolVar(&f.Test, "test", false, "whether to require tests, fails when any of the test stages is not defined (tests are run whenever test stages are defined)")
+
+	cmd.Flags().BoolVar(&f.NoTest, "no-test", false, "whether to skip tests even when a test stage is defined")
+
+	cmd.Flags().StringArrayVar(&f.TestStageNames, "test-stage", []string{dockerfile.TestStage}, "names of build stages to use for tests, each stage that is defined is built as a separate target before the image")
+
+	cmd.Flags().StringArrayVar(&f.TestReports, "test-report", []string{}, "paths inside test stages to copy to test reports directory once tests have run (e.g. '/out/junit.xml')")
+
+	cmd.Flags().StringVar(&f.TestReportsDir, "test-reports-dir", "", "directory to copy test reports to, each test stage gets a sub-directory (defaults to '"+recipe.DefaultTestReportsDir+"')")
+
+	cmd.Flags().StringVar(&f.TestStatus, "test-status", "", "path inside test stages of a file with exit status of the tests, when set test stages should write it and succeed, so that reports of failing tests are copied as well (e.g. '/out/status')")
 
 	cmd.Flags().BoolVar(&f.Push, "push", false, "whether to push image to registries or not (if any registries are given)")
 
-	cmd.Flags().BoolVar(&f.Export, "export", false, "whether to export the image to an OCI tarball 'image-<name>.oci'")
+	cmd.Flags().BoolVar(&f.Export, "export", false, "whether to export the image to an OCI tarball 'image-<name>.oci' (can be combined with --push)")
+
+	cmd.Flags().StringVar(&f.ExportFormat, "export-format", "oci-tar", "format of the image export, either OCI image layout tarball ('oci-tar') or directory ('oci-dir')")
+
+	cmd.Flags().StringVar(&f.ExportDir, "export-dir", "", "directory to export image filesystem to (can be combined with --push and --export)")
 
 	cmd.Flags().StringArrayVar(&f.Platforms, "platform", []string{defaultPlatform}, "platforms to target")
+
+	cmd.Flags().StringVar(&f.Cache, "cache", "none", "build cache mode ('none', 'registry', 'inline' or 'local'), registry and inline cache is stored in the first registry")
+
+	cmd.Flags().StringVar(&f.CacheExportMode, "cache-export-mode", "min", "whether to export cache for the final image only ('min') or for all build stages ('max')")
+
+	cmd.Flags().StringVar(&f.CacheDir, "cache-dir", "", "directory to use with 'local' cache mode")
+
+	cmd.Flags().BoolVar(&f.CachePerBranch, "cache-per-branch", false, "whether to store cache separately for each branch, base branch cache is used as a fallback")
+
+	cmd.Flags().StringVar(&f.Branch, "branch", "", "name of the branch to use with --cache-per-branch (defaults to the checked out branch, or one of "+strings.Join(branchEnvVars, ", ")+" when HEAD is detached)")
+
+	cmd.Flags().BoolVar(&f.WithoutLabels, "without-labels", false, "whether to omit 'org.opencontainers.image.*' labels that are set based on git metadata")
+}
+
+// TestStages returns names of the build stages to run tests with, only
+// stages that are defined are returned, unless --test is set, in which
+// case all of them must be defined
+func (f *CommonFlags) TestStages(scope recipe.ImageScope) ([]string, error) {
+	if f.NoTest {
+		if f.Test {
+			return nil, fmt.Errorf("--test and --no-test cannot be used together")
+		}
+		return nil, nil
+	}
+	d, err := dockerfile.Load(scope.DockerfilePath())
+	if err != nil {
+		return nil, err
+	}
+	testStages := []string{}
+	for _, testStage := range f.TestStageNames {
+		if d.HasStage(testStage) {
+			testStages = append(testStages, testStage)
+		} else if f.Test {
+			return nil, fmt.Errorf("--test is set, but test stage %q is not defined in %q", testStage, scope.DockerfilePath())
+		}
+	}
+	return testStages, nil
+}
+
+// ImageScope returns root or sub-directory scope based on the flags
+func (f *BasicFlags) ImageScope(g git.Git, baseDir string) recipe.ImageScope {
+	return f.ImageScopeForRevision(g, baseDir, "")
+}
+
+// ImageScopeForRevision returns scope that makes tags for the given
+// revision, or for HEAD when rev is empty
+func (f *BasicFlags) ImageScopeForRevision(g git.Git, baseDir, rev string) recipe.ImageScope {
+	if f.Root {
+		return &recipe.ImageScopeRootDir{
+			Git:      g,
+			BaseDir:  baseDir,
+			Revision: rev,
+
+			RelativeDockerfilePath: filepath.Join(f.Dir, f.Dockerfile),
+
+			WithoutSuffix: f.WithoutSuffix,
+			BaseBranch:    f.UpstreamBranch,
+		}
+	}
+	return &recipe.ImageScopeSubDir{
+		Git:      g,
+		BaseDir:  baseDir,
+		Revision: rev,
+
+		RelativeImageDirPath: f.Dir,
+		Dockerfile:           f.Dockerfile,
+
+		WithoutSuffix: f.WithoutSuffix,
+		BaseBranch:    f.UpstreamBranch,
+	}
+}
+
+func (f *BuilderFlags) Register(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.Driver, "builder-driver", defaultBuilderDriver, "driver to use when creating a builder")
+
+	cmd.Flags().StringToStringVar(&f.DriverOpts, "builder-driver-opt", nil, "driver options to use when creating a builder")
+
+	cmd.Flags().StringVar(&f.ConfigFile, "builder-config", "", "BuildKit config file to use when creating a builder")
+}
+
+// Register adds lint flags, Lint is used as default mode when it's set
+func (f *LintFlags) Register(cmd *cobra.Command) {
+	defaultMode := f.Lint
+	if defaultMode == "" {
+		defaultMode = dockerfile.LintModeWarn
+	}
+	cmd.Flags().StringVar(&f.Lint, "lint", defaultMode, "how to treat problems found in Dockerfile, either report them as warnings ('warn'), fail ('error') or skip the checks ('off')")
+
+	cmd.Flags().StringArrayVar(&f.LintIgnore, "lint-ignore", []string{}, "Dockerfile checks to skip ('"+strings.Join(dockerfile.Checks, "', '")+"')")
+}
+
+// Validate checks lint mode and names of ignored checks
+func (f *LintFlags) Validate() error {
+	switch f.Lint {
+	case dockerfile.LintModeOff, dockerfile.LintModeWarn, dockerfile.LintModeError:
+	default:
+		return fmt.Errorf("unsupported --lint mode %q", f.Lint)
+	}
+	for _, check := range f.LintIgnore {
+		known := false
+		for _, knownCheck := range dockerfile.Checks {
+			known = known || check == knownCheck
+		}
+		if !known {
+			return fmt.Errorf("unknown check %q in --lint-ignore", check)
+		}
+	}
+	return nil
+}
+
+// LintDockerfile runs checks of the Dockerfile in the given scope and
+// reports findings, it returns an error in 'error' mode if there
+// were any findings; testStages are reported when they are not defined,
+// and resolveDigest (if not nil) is used to suggest base image digests
+func (f *LintFlags) LintDockerfile(w io.Writer, scope recipe.ImageScope, testStages []string, args map[string]string, resolveDigest func(string) (string, error)) error {
+	if f.Lint == dockerfile.LintModeOff {
+		return nil
+	}
+	d, err := dockerfile.Load(scope.DockerfilePath())
+	if err != nil {
+		return err
+	}
+	findings, err := d.Lint(dockerfile.LintOptions{
+		ContextPath: scope.ContextPath(),
+		TestStages:  testStages,
+		Args:        args,
+		Ignore:      f.LintIgnore,
+
+		ResolveDigest: resolveDigest,
+	})
+	if err != nil {
+		return err
+	}
+	return dockerfile.Report(w, scope.DockerfilePath(), f.Lint, findings)
+}
+
+func (f *SizeFlags) Register(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&f.SizeReport, "size-report", false, "report size and layer count of the pushed or exported image for each platform, compared to the image from the merge-base with upstream branch")
+
+	cmd.Flags().StringVar(&f.SizeBudget, "size-budget", "", "allowed growth of compressed size compared to the base image, either a percentage (e.g. '10%') or a size (e.g. '5MiB'), implies --size-report")
+
+	cmd.Flags().IntVar(&f.LayerBudget, "layer-budget", -1, "number of layers that can be added compared to the base image (negative for no limit), implies --size-report")
+
+	cmd.Flags().StringVar(&f.SizeBudgetMode, "size-budget-mode", imagesize.ModeWarn, "how to treat growth over budget, either report it as a warning ('warn') or fail ('error')")
+}
+
+// Validate checks size budget and mode, and enables size report
+// when any of the budgets is set
+func (f *SizeFlags) Validate() error {
+	switch f.SizeBudgetMode {
+	case imagesize.ModeWarn, imagesize.ModeError:
+	default:
+		return fmt.Errorf("unsupported --size-budget-mode %q", f.SizeBudgetMode)
+	}
+	if _, _, err := imagesize.ParseGrowth(f.SizeBudget); err != nil {
+		return err
+	}
+	if f.SizeBudget != "" || f.LayerBudget >= 0 {
+		f.SizeReport = true
+	}
+	return nil
+}
+
+// Budget returns size budget set by the flags
+func (f *SizeFlags) Budget() (imagesize.Budget, error) {
+	maxGrowth, maxGrowthPercent, err := imagesize.ParseGrowth(f.SizeBudget)
+	if err != nil {
+		return imagesize.Budget{}, err
+	}
+	return imagesize.Budget{
+		MaxGrowth:        maxGrowth,
+		MaxGrowthPercent: maxGrowthPercent,
+		MaxLayerGrowth:   f.LayerBudget,
+	}, nil
+}
+
+func (f *RegistryFlags) Register(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.RegistryConfigFile, "registry-config", "", "JSON file with per-registry settings, such as credentials")
+
+	cmd.Flags().StringVar(&f.DockerConfigDir, "docker-config", "", "directory with docker 'config.json' to use instead of the default one")
+
+	cmd.Flags().IntVar(&f.RegistryConcurrency, "registry-concurrency", rebuilder.DefaultConcurrency, "maximum number of registry lookups to make at the same time")
+}
+
+// RegistryConfig loads registry config file, if it was given, and
+// applies the remaining flags on top of it; it returns nil when none
+// of the flags are set, so that defaults are used
+func (f *RegistryFlags) RegistryConfig() (*registry.Config, error) {
+	if f.RegistryConfigFile == "" && f.DockerConfigDir == "" {
+		return nil, nil
+	}
+	c := &registry.Config{}
+	if f.RegistryConfigFile != "" {
+		var err error
+		if c, err = registry.LoadConfig(f.RegistryConfigFile); err != nil {
+			return nil, err
+		}
+	}
+	if f.DockerConfigDir != "" {
+		c.DockerConfig = f.DockerConfigDir
+	}
+	return c, nil
+}
+
+func (f *CommonFlags) CacheConfig(g git.Git) (*recipe.CacheConfig, error) {
+	cache := &recipe.CacheConfig{
+		Mode:       f.Cache,
+		ExportMode: f.CacheExportMode,
+		LocalDir:   f.CacheDir,
+		PerBranch:  f.CachePerBranch,
+		BaseBranch: f.UpstreamBranch,
+	}
+	if f.CachePerBranch {
+		branch, err := f.branch(g)
+		if err != nil {
+			return nil, err
+		}
+		if branch == "" {
+			fmt.Printf("branch is not known as HEAD is detached, only base branch cache is used (set --branch to override)\n")
+		}
+		cache.Branch = branch
+	}
+	return cache, nil
+}
+
+// branchEnvVars are set by CI systems that build detached HEAD
+var branchEnvVars = []string{"GITHUB_HEAD_REF", "CI_COMMIT_REF_NAME"}
+
+// branch returns name of the branch that is being built, it is
+// taken from environment when HEAD is detached
+func (f *CommonFlags) branch(g git.Git) (string, error) {
+	if f.Branch != "" {
+		return f.Branch, nil
+	}
+	branch, err := g.CurrentBranch()
+	if err != nil || branch != "" {
+		return branch, err
+	}
+	for _, envVar := range branchEnvVars {
+		if branch := os.Getenv(envVar); branch != "" {
+			return branch, nil
+		}
+	}
+	return "", nil
 }
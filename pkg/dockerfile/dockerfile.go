@@ -0,0 +1,119 @@
+package dockerfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/frontend/dockerfile/shell"
+)
+
+// Dockerfile holds build stages and global args of a parsed Dockerfile
+type Dockerfile struct {
+	Path     string
+	Stages   []instructions.Stage
+	MetaArgs []instructions.ArgCommand
+
+	escapeToken rune
+}
+
+// Load reads and parses Dockerfile at the given path
+func Load(path string) (*Dockerfile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	d, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %q: %w", path, err)
+	}
+	d.Path = path
+	return d, nil
+}
+
+// Parse parses Dockerfile, it only checks syntax of the instructions
+func Parse(r io.Reader) (*Dockerfile, error) {
+	result, err := parser.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	stages, metaArgs, err := instructions.Parse(result.AST)
+	if err != nil {
+		return nil, err
+	}
+	return &Dockerfile{
+		Stages:   stages,
+		MetaArgs: metaArgs,
+
+		escapeToken: result.EscapeToken,
+	}, nil
+}
+
+// HasStage checks if there is a stage with the given name, stage
+// names are not case-sensitive
+func (d *Dockerfile) HasStage(name string) bool {
+	for _, stage := range d.Stages {
+		if strings.EqualFold(stage.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// DeclaredArgs returns names of all args declared globally or in
+// any of the stages
+func (d *Dockerfile) DeclaredArgs() map[string]bool {
+	args := map[string]bool{}
+	addArgs := func(cmd *instructions.ArgCommand) {
+		for _, arg := range cmd.Args {
+			args[arg.Key] = true
+		}
+	}
+	for i := range d.MetaArgs {
+		addArgs(&d.MetaArgs[i])
+	}
+	for _, stage := range d.Stages {
+		for _, cmd := range stage.Commands {
+			if arg, ok := cmd.(*instructions.ArgCommand); ok {
+				addArgs(arg)
+			}
+		}
+	}
+	return args
+}
+
+// metaArgs returns values of global args, these can be used in FROM
+// instructions; same as BuildKit does, values of declared args are
+// taken from args, and defaults are expanded with preceding args
+func (d *Dockerfile) metaArgs(lex *shell.Lex, args map[string]string) map[string]string {
+	values := map[string]string{}
+	for _, cmd := range d.MetaArgs {
+		for _, arg := range cmd.Args {
+			if value, ok := args[arg.Key]; ok {
+				values[arg.Key] = value
+				continue
+			}
+			if arg.Value == nil {
+				continue
+			}
+			value, err := lex.ProcessWordWithMap(*arg.Value, values)
+			if err != nil {
+				value = *arg.Value
+			}
+			values[arg.Key] = value
+		}
+	}
+	return values
+}
+
+func (d *Dockerfile) lex() *shell.Lex {
+	if d.escapeToken == 0 {
+		return shell.NewLex(parser.DefaultEscapeToken)
+	}
+	return shell.NewLex(d.escapeToken)
+}
@@ -0,0 +1,213 @@
+package dockerfile_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	. "github.com/errordeveloper/imagine/pkg/dockerfile"
+)
+
+const testDockerfile = `ARG BASE=alpine:3.12
+ARG GOLANG=golang:1.15@sha256:de97bab9325c4c3904f8f7fec8eb469169a1d247bdc97dcab38c2c75cf4b4ba5
+
+FROM ${GOLANG} AS builder
+ARG VERSION
+COPY . /src
+COPY ../shared /shared
+ADD https://example.com/archive.tar.gz /tmp/
+RUN go build -o /out/app /src
+
+FROM builder AS Test
+RUN go test /src/...
+
+FROM scratch AS empty
+
+FROM ${BASE}
+COPY --from=builder /out/app /app
+COPY ../../outside/file /file
+`
+
+func writeDockerfile(t *testing.T, content string) string {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "Dockerfile")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParse(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	d, err := Parse(strings.NewReader(testDockerfile))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	g.Expect(d.Stages).To(HaveLen(4))
+	g.Expect(d.HasStage("builder")).To(BeTrue())
+	g.Expect(d.HasStage("test")).To(BeTrue())
+	g.Expect(d.HasStage("release")).To(BeFalse())
+	g.Expect(d.DeclaredArgs()).To(Equal(map[string]bool{
+		"BASE":    true,
+		"GOLANG":  true,
+		"VERSION": true,
+	}))
+
+	_, err = Parse(strings.NewReader("FROM alpine\nFOO bar\n"))
+	g.Expect(err).To(HaveOccurred())
+
+	_, err = Load(filepath.Join(t.TempDir(), "Dockerfile"))
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestLint(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	path := writeDockerfile(t, testDockerfile)
+	contextPath := filepath.Dir(path)
+
+	d, err := Load(path)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(d.Path).To(Equal(path))
+
+	findings, err := d.Lint(LintOptions{
+		ContextPath: contextPath,
+		TestStages:  []string{TestStage},
+		Args: map[string]string{
+			"VERSION":               "1.0",
+			"FOO":                   "bar",
+			"HTTP_PROXY":            "http://proxy",
+			"BUILDKIT_INLINE_CACHE": "1",
+		},
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+
+	checks := []string{}
+	for _, finding := range findings {
+		checks = append(checks, finding.Check)
+	}
+	g.Expect(checks).To(Equal([]string{
+		CheckUnpinnedBaseImage,
+		CheckDockerignore,
+		CheckUndeclaredArg,
+		CheckCopyOutsideContext,
+		CheckCopyOutsideContext,
+	}))
+	g.Expect(findings[0].String()).To(Equal(`line 16: base image "alpine:3.12" is not pinned by digest (unpinned-base-image)`))
+	g.Expect(findings[2].Message).To(Equal(`build arg "FOO" is not declared with ARG instruction, it will be ignored`))
+	g.Expect(findings[3].String()).To(Equal(`line 7: source "../shared" is outside of build context (copy-outside-context)`))
+	g.Expect(findings[4].Line).To(Equal(18))
+
+	g.Expect(ioutil.WriteFile(path+".dockerignore", []byte("*.md\n"), 0644)).To(Succeed())
+
+	findings, err = d.Lint(LintOptions{
+		ContextPath: contextPath,
+		Ignore:      []string{CheckUnpinnedBaseImage, CheckCopyOutsideContext},
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(findings).To(BeEmpty())
+
+	d, err = Load(writeDockerfile(t, "FROM alpine@sha256:074d3636ebda6dd446d0d00304c4454f468237fdacf08fb0eeac90bdbfa1bac7\n"))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	findings, err = d.Lint(LintOptions{
+		ContextPath: contextPath,
+		TestStages:  []string{TestStage},
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(findings).To(HaveLen(2))
+	g.Expect(findings[0].String()).To(Equal(`tests are enabled, but there is no "test" stage (test-stage)`))
+	g.Expect(findings[1].Check).To(Equal(CheckDockerignore))
+
+	findings, err = d.Lint(LintOptions{
+		ContextPath: contextPath,
+		TestStages:  []string{"unit-test", "integration-test"},
+		Ignore:      []string{CheckDockerignore},
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(findings).To(HaveLen(2))
+	g.Expect(findings[0].Message).To(Equal(`tests are enabled, but there is no "unit-test" stage`))
+	g.Expect(findings[1].Message).To(Equal(`tests are enabled, but there is no "integration-test" stage`))
+}
+
+func TestLintBaseImageArgs(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	d, err := Parse(strings.NewReader(`ARG REGISTRY
+ARG ALPINE_VERSION=3.12
+ARG BASE=${REGISTRY:-docker.io}/library/alpine:${ALPINE_VERSION}
+FROM ${BASE}
+`))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	lint := func(args map[string]string) []Finding {
+		findings, err := d.Lint(LintOptions{
+			Args:   args,
+			Ignore: []string{CheckDockerignore, CheckUndeclaredArg},
+		})
+		g.Expect(err).ToNot(HaveOccurred())
+		return findings
+	}
+
+	findings := lint(nil)
+	g.Expect(findings).To(HaveLen(1))
+	g.Expect(findings[0].Message).To(Equal(`base image "docker.io/library/alpine:3.12" is not pinned by digest`))
+
+	findings = lint(map[string]string{"REGISTRY": "registry.internal:5000", "ALPINE_VERSION": "3.13"})
+	g.Expect(findings).To(HaveLen(1))
+	g.Expect(findings[0].Message).To(Equal(`base image "registry.internal:5000/library/alpine:3.13" is not pinned by digest`))
+
+	// digests are suggested when they can be resolved
+	findings, err = d.Lint(LintOptions{
+		Args:   map[string]string{"ALPINE_VERSION": "3.13"},
+		Ignore: []string{CheckDockerignore},
+		ResolveDigest: func(ref string) (string, error) {
+			if ref != "docker.io/library/alpine:3.12" {
+				return "", fmt.Errorf("unexpected ref %q", ref)
+			}
+			return "sha256:074d3636ebda6dd446d0d00304c4454f468237fdacf08fb0eeac90bdbfa1bac7", nil
+		},
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(findings).To(HaveLen(1))
+	g.Expect(findings[0].Message).To(Equal(`base image "docker.io/library/alpine:3.13" is not pinned by digest`))
+
+	findings, err = d.Lint(LintOptions{
+		Ignore: []string{CheckDockerignore},
+		ResolveDigest: func(ref string) (string, error) {
+			return "sha256:074d3636ebda6dd446d0d00304c4454f468237fdacf08fb0eeac90bdbfa1bac7", nil
+		},
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(findings).To(HaveLen(1))
+	g.Expect(findings[0].Message).To(Equal(`base image "docker.io/library/alpine:3.12" is not pinned by digest, current digest is "sha256:074d3636ebda6dd446d0d00304c4454f468237fdacf08fb0eeac90bdbfa1bac7"`))
+
+	findings = lint(map[string]string{"BASE": "alpine@sha256:074d3636ebda6dd446d0d00304c4454f468237fdacf08fb0eeac90bdbfa1bac7"})
+	g.Expect(findings).To(BeEmpty())
+}
+
+func TestReport(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	findings := []Finding{{
+		Check:   CheckDockerignore,
+		Message: "no .dockerignore",
+	}}
+
+	out := &bytes.Buffer{}
+	g.Expect(Report(out, "Dockerfile", LintModeWarn, findings)).To(Succeed())
+	g.Expect(out.String()).To(Equal("warning: Dockerfile: no .dockerignore (dockerignore)\n"))
+
+	out.Reset()
+	g.Expect(Report(out, "Dockerfile", LintModeError, findings)).To(MatchError(`1 problem(s) found in "Dockerfile"`))
+	g.Expect(out.String()).To(Equal("error: Dockerfile: no .dockerignore (dockerignore)\n"))
+
+	out.Reset()
+	g.Expect(Report(out, "Dockerfile", LintModeError, nil)).To(Succeed())
+	g.Expect(out.String()).To(BeEmpty())
+}
@@ -0,0 +1,270 @@
+package dockerfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+const (
+	CheckTestStage          = "test-stage"
+	CheckUnpinnedBaseImage  = "unpinned-base-image"
+	CheckDockerignore       = "dockerignore"
+	CheckUndeclaredArg      = "undeclared-arg"
+	CheckCopyOutsideContext = "copy-outside-context"
+
+	// LintModeOff disables all checks
+	LintModeOff = "off"
+	// LintModeWarn reports findings, but doesn't fail
+	LintModeWarn = "warn"
+	// LintModeError reports findings and fails if there are any
+	LintModeError = "error"
+
+	// TestStage is the name of the stage that is built
+	// with '-test' target
+	TestStage = "test"
+)
+
+// Checks lists names of all of the checks
+var Checks = []string{
+	CheckTestStage,
+	CheckUnpinnedBaseImage,
+	CheckDockerignore,
+	CheckUndeclaredArg,
+	CheckCopyOutsideContext,
+}
+
+// predefinedArgs can be passed without being declared, see
+// https://docs.docker.com/engine/reference/builder/#predefined-args
+var predefinedArgs = map[string]bool{
+	"HTTP_PROXY":  true,
+	"http_proxy":  true,
+	"HTTPS_PROXY": true,
+	"https_proxy": true,
+	"FTP_PROXY":   true,
+	"ftp_proxy":   true,
+	"NO_PROXY":    true,
+	"no_proxy":    true,
+	"ALL_PROXY":   true,
+	"all_proxy":   true,
+}
+
+// Finding is a problem found by one of the checks
+type Finding struct {
+	Check   string
+	Line    int
+	Message string
+}
+
+func (f Finding) String() string {
+	if f.Line == 0 {
+		return fmt.Sprintf("%s (%s)", f.Message, f.Check)
+	}
+	return fmt.Sprintf("line %d: %s (%s)", f.Line, f.Message, f.Check)
+}
+
+// LintOptions describe how the image is going to be built
+type LintOptions struct {
+	ContextPath string
+	// TestStages are names of the stages that are required
+	// for tests, none are required when it's empty
+	TestStages []string
+	Args       map[string]string
+	// Ignore lists checks that should not be run
+	Ignore []string
+	// ResolveDigest is used to suggest a digest for each of the
+	// unpinned base images, when it's set; failures are ignored
+	ResolveDigest func(ref string) (string, error)
+}
+
+// Lint runs all of the checks that are not ignored
+func (d *Dockerfile) Lint(options LintOptions) ([]Finding, error) {
+	ignore := map[string]bool{}
+	for _, check := range options.Ignore {
+		ignore[check] = true
+	}
+
+	findings := []Finding{}
+	if !ignore[CheckTestStage] {
+		findings = append(findings, d.checkTestStage(options)...)
+	}
+	if !ignore[CheckUnpinnedBaseImage] {
+		findings = append(findings, d.checkUnpinnedBaseImages(options)...)
+	}
+	if !ignore[CheckDockerignore] {
+		dockerignoreFindings, err := d.checkDockerignore(options)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, dockerignoreFindings...)
+	}
+	if !ignore[CheckUndeclaredArg] {
+		findings = append(findings, d.checkUndeclaredArgs(options)...)
+	}
+	if !ignore[CheckCopyOutsideContext] {
+		findings = append(findings, d.checkCopySources()...)
+	}
+	return findings, nil
+}
+
+func (d *Dockerfile) checkTestStage(options LintOptions) []Finding {
+	findings := []Finding{}
+	for _, testStage := range options.TestStages {
+		if !d.HasStage(testStage) {
+			findings = append(findings, Finding{
+				Check:   CheckTestStage,
+				Message: fmt.Sprintf("tests are enabled, but there is no %q stage", testStage),
+			})
+		}
+	}
+	return findings
+}
+
+func (d *Dockerfile) checkUnpinnedBaseImages(options LintOptions) []Finding {
+	findings := []Finding{}
+	lex := d.lex()
+	metaArgs := d.metaArgs(lex, options.Args)
+	stages := map[string]bool{}
+	for _, stage := range d.Stages {
+		baseName, err := lex.ProcessWordWithMap(stage.BaseName, metaArgs)
+		if err != nil {
+			baseName = stage.BaseName
+		}
+		switch {
+		case stages[strings.ToLower(baseName)]:
+		case baseName == "scratch":
+		case strings.Contains(baseName, "@"):
+		default:
+			message := fmt.Sprintf("base image %q is not pinned by digest", baseName)
+			if options.ResolveDigest != nil {
+				if digest, err := options.ResolveDigest(baseName); err == nil {
+					message += fmt.Sprintf(", current digest is %q", digest)
+				}
+			}
+			findings = append(findings, Finding{
+				Check:   CheckUnpinnedBaseImage,
+				Line:    line(stage.Location),
+				Message: message,
+			})
+		}
+		if stage.Name != "" {
+			stages[strings.ToLower(stage.Name)] = true
+		}
+	}
+	return findings
+}
+
+func (d *Dockerfile) checkDockerignore(options LintOptions) ([]Finding, error) {
+	candidates := []string{filepath.Join(options.ContextPath, ".dockerignore")}
+	if d.Path != "" {
+		candidates = append(candidates, d.Path+".dockerignore")
+	}
+	for _, candidate := range candidates {
+		_, err := os.Stat(candidate)
+		if err == nil {
+			return nil, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return []Finding{{
+		Check:   CheckDockerignore,
+		Message: fmt.Sprintf("neither of %s exist, whole build context is sent to the builder", strings.Join(candidates, " or ")),
+	}}, nil
+}
+
+func (d *Dockerfile) checkUndeclaredArgs(options LintOptions) []Finding {
+	declared := d.DeclaredArgs()
+	undeclared := []string{}
+	for arg := range options.Args {
+		if !declared[arg] && !predefinedArgs[arg] && !strings.HasPrefix(arg, "BUILDKIT_") {
+			undeclared = append(undeclared, arg)
+		}
+	}
+	sort.Strings(undeclared)
+
+	findings := []Finding{}
+	for _, arg := range undeclared {
+		findings = append(findings, Finding{
+			Check:   CheckUndeclaredArg,
+			Message: fmt.Sprintf("build arg %q is not declared with ARG instruction, it will be ignored", arg),
+		})
+	}
+	return findings
+}
+
+func (d *Dockerfile) checkCopySources() []Finding {
+	findings := []Finding{}
+	for _, stage := range d.Stages {
+		for _, cmd := range stage.Commands {
+			var sources []string
+			switch cmd := cmd.(type) {
+			case *instructions.CopyCommand:
+				if cmd.From != "" {
+					continue
+				}
+				sources = cmd.Sources()
+			case *instructions.AddCommand:
+				sources = cmd.Sources()
+			default:
+				continue
+			}
+			for _, source := range sources {
+				if isURL(source) || path.IsAbs(source) {
+					continue
+				}
+				if source := path.Clean(source); source == ".." || strings.HasPrefix(source, "../") {
+					findings = append(findings, Finding{
+						Check:   CheckCopyOutsideContext,
+						Line:    line(cmd.Location()),
+						Message: fmt.Sprintf("source %q is outside of build context", source),
+					})
+				}
+			}
+		}
+	}
+	return findings
+}
+
+func isURL(source string) bool {
+	for _, prefix := range []string{"http://", "https://", "git://", "git@"} {
+		if strings.HasPrefix(source, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func line(location []parser.Range) int {
+	if len(location) == 0 {
+		return 0
+	}
+	return location[0].Start.Line
+}
+
+// Report writes findings to w, it returns an error if there are
+// any findings and mode is LintModeError
+func Report(w io.Writer, path, mode string, findings []Finding) error {
+	if len(findings) == 0 {
+		return nil
+	}
+	severity := "warning"
+	if mode == LintModeError {
+		severity = "error"
+	}
+	for _, finding := range findings {
+		fmt.Fprintf(w, "%s: %s: %s\n", severity, path, finding)
+	}
+	if mode == LintModeError {
+		return fmt.Errorf("%d problem(s) found in %q", len(findings), path)
+	}
+	return nil
+}
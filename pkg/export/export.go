@@ -0,0 +1,396 @@
+package export
+
+// Helpers for reading and writing images as OCI image layout, these
+// are used for exports that buildx cannot do natively
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	FormatOCITar = "oci-tar"
+	FormatOCIDir = "oci-dir"
+
+	RefNameAnnotation = "org.opencontainers.image.ref.name"
+
+	dockerArchiveManifest = "manifest.json"
+)
+
+// Artifact is either an image index or a single image, only one
+// of the fields is set; when artifact is read from an archive, any
+// ref names recorded in the archive are set also; Annotations
+// are added to descriptors when the artifact is written to OCI
+// image layout
+type Artifact struct {
+	Index v1.ImageIndex
+	Image v1.Image
+
+	RefNames    []string
+	Annotations map[string]string
+}
+
+func (a *Artifact) descriptorAnnotations(refName string) map[string]string {
+	annotations := map[string]string{}
+	for k, v := range a.Annotations {
+		annotations[k] = v
+	}
+	if refName != "" {
+		annotations[RefNameAnnotation] = refName
+	}
+	return annotations
+}
+
+func (a *Artifact) Digest() (v1.Hash, error) {
+	if a.Index != nil {
+		return a.Index.Digest()
+	}
+	return a.Image.Digest()
+}
+
+// PlatformString returns platform as 'os-arch[-variant]', which is
+// suitable for use in file names
+func PlatformString(platform *v1.Platform) string {
+	if platform == nil {
+		return "unknown"
+	}
+	parts := []string{platform.OS, platform.Architecture}
+	if platform.Variant != "" {
+		parts = append(parts, platform.Variant)
+	}
+	return strings.Join(parts, "-")
+}
+
+// PlatformImages returns images keyed by platform string, entries of
+// an index that are not images are skipped
+func (a *Artifact) PlatformImages() (map[string]v1.Image, error) {
+	images := map[string]v1.Image{}
+
+	if a.Image != nil {
+		configFile, err := a.Image.ConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		platform := &v1.Platform{OS: configFile.OS, Architecture: configFile.Architecture}
+		images[PlatformString(platform)] = a.Image
+		return images, nil
+	}
+
+	indexManifest, err := a.Index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range indexManifest.Manifests {
+		switch desc.MediaType {
+		case types.OCIManifestSchema1, types.DockerManifestSchema2:
+		default:
+			continue
+		}
+		img, err := a.Index.Image(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		images[PlatformString(desc.Platform)] = img
+	}
+	return images, nil
+}
+
+func isIndex(mediaType types.MediaType) bool {
+	return mediaType == types.OCIImageIndex || mediaType == types.DockerManifestList
+}
+
+// FromRemote returns an artifact for remote image or index
+func FromRemote(desc *remote.Descriptor) (*Artifact, error) {
+	if isIndex(desc.MediaType) {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return nil, err
+		}
+		return &Artifact{Index: idx}, nil
+	}
+
+	img, err := desc.Image()
+	if err != nil {
+		return nil, err
+	}
+	return &Artifact{Image: img}, nil
+}
+
+// FromLayout returns an artifact for the first manifest found in
+// an OCI image layout directory
+func FromLayout(dir string) (*Artifact, error) {
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := p.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	indexManifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	if len(indexManifest.Manifests) == 0 {
+		return nil, fmt.Errorf("no manifests found in OCI image layout %q", dir)
+	}
+
+	desc := indexManifest.Manifests[0]
+
+	artifact := &Artifact{}
+	for _, m := range indexManifest.Manifests {
+		if refName, ok := m.Annotations[RefNameAnnotation]; ok && m.Digest == desc.Digest {
+			artifact.RefNames = append(artifact.RefNames, refName)
+		}
+	}
+
+	if isIndex(desc.MediaType) {
+		artifact.Index, err = idx.ImageIndex(desc.Digest)
+	} else {
+		artifact.Image, err = idx.Image(desc.Digest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return artifact, nil
+}
+
+// fromDockerArchive returns an artifact for a tarball in the format
+// used by 'docker save', only archives with one image are supported
+func fromDockerArchive(path, extractedDir string) (*Artifact, error) {
+	data, err := ioutil.ReadFile(filepath.Join(extractedDir, dockerArchiveManifest))
+	if err != nil {
+		return nil, err
+	}
+	manifest := tarball.Manifest{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("unable to parse %q in %q: %w", dockerArchiveManifest, path, err)
+	}
+	if len(manifest) != 1 {
+		return nil, fmt.Errorf("expected one image in %q, found %d", path, len(manifest))
+	}
+
+	img, err := tarball.ImageFromPath(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Artifact{Image: img, RefNames: manifest[0].RepoTags}, nil
+}
+
+// FromArchive returns an artifact for OCI image layout directory or
+// tarball, or a docker tarball, the returned function must be called
+// to clean up once the artifact is no longer used
+func FromArchive(path string) (*Artifact, func(), error) {
+	cleanup := func() {}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, cleanup, err
+	}
+	if info.IsDir() {
+		artifact, err := FromLayout(path)
+		return artifact, cleanup, err
+	}
+
+	tempDir, err := ioutil.TempDir("", "imagine-oci-layout-")
+	if err != nil {
+		return nil, cleanup, err
+	}
+	cleanup = func() { os.RemoveAll(tempDir) }
+
+	if err := extractTar(path, tempDir); err != nil {
+		return nil, cleanup, fmt.Errorf("unable to extract %q: %w", path, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(tempDir, "index.json")); os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Join(tempDir, dockerArchiveManifest)); err == nil {
+			artifact, err := fromDockerArchive(path, tempDir)
+			return artifact, cleanup, err
+		}
+		return nil, cleanup, fmt.Errorf("%q is neither an OCI image layout nor a docker archive", path)
+	}
+
+	artifact, err := FromLayout(tempDir)
+	return artifact, cleanup, err
+}
+
+// WriteOCILayout writes an artifact to an OCI image layout in the given
+// directory, the artifact is referenced once for each of the given ref
+// names, so that all tags are preserved
+func WriteOCILayout(dir string, artifact *Artifact, refNames ...string) error {
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		return err
+	}
+
+	options := [][]layout.Option{}
+	for _, refName := range refNames {
+		options = append(options, []layout.Option{
+			layout.WithAnnotations(artifact.descriptorAnnotations(refName)),
+		})
+	}
+	if len(options) == 0 {
+		if len(artifact.Annotations) != 0 {
+			options = append(options, []layout.Option{
+				layout.WithAnnotations(artifact.descriptorAnnotations("")),
+			})
+		} else {
+			options = append(options, nil)
+		}
+	}
+
+	for _, opts := range options {
+		if artifact.Index != nil {
+			err = p.AppendIndex(artifact.Index, opts...)
+		} else {
+			err = p.AppendImage(artifact.Image, opts...)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteOCIArchive writes an artifact to a tarball containing an OCI
+// image layout
+func WriteOCIArchive(dest string, artifact *Artifact, refNames ...string) error {
+	tempDir, err := ioutil.TempDir("", "imagine-oci-layout-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := WriteOCILayout(tempDir, artifact, refNames...); err != nil {
+		return fmt.Errorf("unable to write OCI image layout: %w", err)
+	}
+
+	return writeTar(tempDir, dest)
+}
+
+// Write writes an artifact in the given format, any existing
+// file or directory at dest is replaced
+func Write(format, dest string, artifact *Artifact, refNames ...string) error {
+	switch format {
+	case FormatOCITar:
+		return WriteOCIArchive(dest, artifact, refNames...)
+	case FormatOCIDir:
+		if err := os.RemoveAll(dest); err != nil {
+			return err
+		}
+		return WriteOCILayout(dest, artifact, refNames...)
+	default:
+		return fmt.Errorf("unsupported export format %q", format)
+	}
+}
+
+func writeTar(dir, dest string) error {
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write %q: %w", dest, err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func extractTar(src, dir string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid path %q in archive", hdr.Name)
+		}
+		path := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			dst, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(dst, tr); err != nil {
+				dst.Close()
+				return err
+			}
+			if err := dst.Close(); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package export_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+
+	. "github.com/errordeveloper/imagine/pkg/export"
+)
+
+func TestRoundTrip(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	idx, err := random.Index(64, 2, 2)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	expectedDigest, err := idx.Digest()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	refNames := []string{
+		"example.com/reg/image-1:16c315",
+		"example.org/reg/image-1:16c315",
+	}
+
+	{
+		dest := filepath.Join(t.TempDir(), "image-1.oci")
+
+		g.Expect(Write(FormatOCIDir, dest, &Artifact{Index: idx}, refNames...)).To(Succeed())
+
+		p, err := layout.FromPath(dest)
+		g.Expect(err).ToNot(HaveOccurred())
+		topLevelIndex, err := p.ImageIndex()
+		g.Expect(err).ToNot(HaveOccurred())
+		indexManifest, err := topLevelIndex.IndexManifest()
+		g.Expect(err).ToNot(HaveOccurred())
+
+		g.Expect(indexManifest.Manifests).To(HaveLen(2))
+		for i, desc := range indexManifest.Manifests {
+			g.Expect(desc.Digest).To(Equal(expectedDigest))
+			g.Expect(desc.Annotations).To(HaveKeyWithValue(RefNameAnnotation, refNames[i]))
+		}
+
+		artifact, cleanup, err := FromArchive(dest)
+		defer cleanup()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(artifact.Index).ToNot(BeNil())
+		g.Expect(artifact.Digest()).To(Equal(expectedDigest))
+		g.Expect(artifact.RefNames).To(Equal(refNames))
+	}
+
+	{
+		dest := filepath.Join(t.TempDir(), "image-1.oci")
+
+		g.Expect(Write(FormatOCITar, dest, &Artifact{Index: idx}, refNames...)).To(Succeed())
+
+		artifact, cleanup, err := FromArchive(dest)
+		defer cleanup()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(artifact.Index).ToNot(BeNil())
+		g.Expect(artifact.Digest()).To(Equal(expectedDigest))
+
+		manifest, err := artifact.Index.IndexManifest()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(manifest.Manifests).To(HaveLen(2))
+	}
+
+	{
+		img, err := random.Image(64, 1)
+		g.Expect(err).ToNot(HaveOccurred())
+
+		dest := filepath.Join(t.TempDir(), "image-1.oci")
+		g.Expect(Write(FormatOCITar, dest, &Artifact{Image: img})).To(Succeed())
+
+		artifact, cleanup, err := FromArchive(dest)
+		defer cleanup()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(artifact.Index).To(BeNil())
+		g.Expect(artifact.Image).ToNot(BeNil())
+	}
+
+	{
+		img, err := random.Image(64, 1)
+		g.Expect(err).ToNot(HaveOccurred())
+		expectedDigest, err := img.Digest()
+		g.Expect(err).ToNot(HaveOccurred())
+
+		tag, err := name.NewTag(refNames[0])
+		g.Expect(err).ToNot(HaveOccurred())
+
+		dest := filepath.Join(t.TempDir(), "image-1.tar")
+		g.Expect(tarball.WriteToFile(dest, tag, img)).To(Succeed())
+
+		artifact, cleanup, err := FromArchive(dest)
+		defer cleanup()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(artifact.Image).ToNot(BeNil())
+		g.Expect(artifact.Digest()).To(Equal(expectedDigest))
+		g.Expect(artifact.RefNames).To(ConsistOf(refNames[0]))
+	}
+
+	{
+		dest := filepath.Join(t.TempDir(), "image-1.oci")
+
+		annotations := map[string]string{
+			"org.opencontainers.image.revision": "16c315243fd31c00b80c188123099501ae2ccf91",
+			RefNameAnnotation:                   "16c315",
+		}
+		g.Expect(Write(FormatOCIDir, dest, &Artifact{Index: idx, Annotations: annotations}, refNames...)).To(Succeed())
+
+		p, err := layout.FromPath(dest)
+		g.Expect(err).ToNot(HaveOccurred())
+		topLevelIndex, err := p.ImageIndex()
+		g.Expect(err).ToNot(HaveOccurred())
+		indexManifest, err := topLevelIndex.IndexManifest()
+		g.Expect(err).ToNot(HaveOccurred())
+
+		g.Expect(indexManifest.Manifests).To(HaveLen(2))
+		for i, desc := range indexManifest.Manifests {
+			g.Expect(desc.Annotations).To(Equal(map[string]string{
+				"org.opencontainers.image.revision": "16c315243fd31c00b80c188123099501ae2ccf91",
+				RefNameAnnotation:                   refNames[i],
+			}))
+		}
+	}
+
+	{
+		err := Write("docker", filepath.Join(t.TempDir(), "image-1.tar"), &Artifact{Index: idx})
+		g.Expect(err).To(MatchError(`unsupported export format "docker"`))
+	}
+}
+
+func TestNormaliseTimestamps(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	created := time.Date(2020, 12, 1, 10, 30, 0, 0, time.UTC)
+
+	{
+		img, err := random.Image(64, 2)
+		g.Expect(err).ToNot(HaveOccurred())
+		configFile, err := img.ConfigFile()
+		g.Expect(err).ToNot(HaveOccurred())
+		configFile.History = []v1.History{{CreatedBy: "foo"}, {CreatedBy: "bar"}}
+		img, err = mutate.ConfigFile(img, configFile)
+		g.Expect(err).ToNot(HaveOccurred())
+
+		artifact, err := NormaliseTimestamps(&Artifact{Image: img}, created)
+		g.Expect(err).ToNot(HaveOccurred())
+
+		normalisedConfigFile, err := artifact.Image.ConfigFile()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(normalisedConfigFile.Created.Time).To(BeTemporally("==", created))
+		g.Expect(normalisedConfigFile.History).To(HaveLen(2))
+		for _, history := range normalisedConfigFile.History {
+			g.Expect(history.Created.Time).To(BeTemporally("==", created))
+		}
+
+		layers, err := img.Layers()
+		g.Expect(err).ToNot(HaveOccurred())
+		normalisedLayers, err := artifact.Image.Layers()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(normalisedLayers).To(HaveLen(len(layers)))
+		for i := range layers {
+			layerDigest, err := layers[i].Digest()
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(normalisedLayers[i].Digest()).To(Equal(layerDigest))
+		}
+
+		again, err := NormaliseTimestamps(artifact, created.Add(time.Millisecond))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(again.Image).To(BeIdenticalTo(artifact.Image))
+	}
+
+	{
+		idx, err := random.Index(64, 1, 2)
+		g.Expect(err).ToNot(HaveOccurred())
+		originalDigest, err := idx.Digest()
+		g.Expect(err).ToNot(HaveOccurred())
+
+		artifact, err := NormaliseTimestamps(&Artifact{Index: idx, RefNames: []string{"image-1:16c315"}}, created)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(artifact.RefNames).To(ConsistOf("image-1:16c315"))
+
+		digest, err := artifact.Digest()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(digest).ToNot(Equal(originalDigest))
+
+		indexManifest, err := artifact.Index.IndexManifest()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(indexManifest.Manifests).To(HaveLen(2))
+		for _, desc := range indexManifest.Manifests {
+			img, err := artifact.Index.Image(desc.Digest)
+			g.Expect(err).ToNot(HaveOccurred())
+			configFile, err := img.ConfigFile()
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(configFile.Created.Time).To(BeTemporally("==", created))
+		}
+
+		again, err := NormaliseTimestamps(artifact, created)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(again.Digest()).To(Equal(digest))
+	}
+}
+
+func TestCopyFiles(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	src := t.TempDir()
+	files := map[string]string{
+		"out/junit.xml":        "<testsuites/>",
+		"out/coverage/cov.out": "mode: set",
+		"src/main.go":          "package main",
+	}
+	for name, content := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		g.Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+		g.Expect(ioutil.WriteFile(path, []byte(content), 0644)).To(Succeed())
+	}
+	g.Expect(os.Symlink("/etc/passwd", filepath.Join(src, "out", "passwd"))).To(Succeed())
+
+	dest := filepath.Join(t.TempDir(), "reports")
+	missing, err := CopyFiles(src, dest, "/out", "../src/main.go")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(missing).To(BeEmpty())
+
+	for name, content := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(string(data)).To(Equal(content))
+	}
+	_, err = os.Lstat(filepath.Join(dest, "out", "passwd"))
+	g.Expect(os.IsNotExist(err)).To(BeTrue())
+
+	missing, err = CopyFiles(src, dest, "out/missing.xml", "out/junit.xml")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(missing).To(Equal([]string{"out/missing.xml"}))
+}
@@ -0,0 +1,118 @@
+package export
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// File is an entry in the flattened filesystem of an image, Content
+// is only set for regular files that were asked to be read
+type File struct {
+	Header  *tar.Header
+	Content []byte
+}
+
+// ReadFiles returns entries of the flattened filesystem of the image
+// for which match returns true, names are relative to the root and
+// contents of regular files are read when match asks for it
+func ReadFiles(img v1.Image, match func(name string) (ok, readContent bool)) (map[string]*File, error) {
+	rc := mutate.Extract(img)
+	defer rc.Close()
+
+	files := map[string]*File{}
+	tr := tar.NewReader(rc)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read image filesystem: %w", err)
+		}
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		ok, readContent := match(name)
+		if !ok {
+			continue
+		}
+		f := &File{Header: header}
+		if readContent && header.Typeflag == tar.TypeReg {
+			if f.Content, err = ioutil.ReadAll(tr); err != nil {
+				return nil, err
+			}
+		}
+		files[name] = f
+	}
+}
+
+// CopyFiles copies the given paths, which are files or directories,
+// from srcDir to the same relative paths in destDir; paths are
+// always treated as relative to srcDir, symlinks are skipped; paths
+// that don't exist are skipped as well, and these are returned
+func CopyFiles(srcDir, destDir string, paths ...string) ([]string, error) {
+	missing := []string{}
+	for _, p := range paths {
+		rel := filepath.FromSlash(strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(p)), "/"))
+		if rel == "" {
+			rel = "."
+		}
+		src := filepath.Join(srcDir, rel)
+		if _, err := os.Lstat(src); err != nil {
+			if os.IsNotExist(err) {
+				missing = append(missing, p)
+				continue
+			}
+			return nil, fmt.Errorf("unable to copy %q: %w", p, err)
+		}
+		err := filepath.Walk(src, func(srcPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			name, err := filepath.Rel(srcDir, srcPath)
+			if err != nil {
+				return err
+			}
+			destPath := filepath.Join(destDir, name)
+			switch {
+			case info.IsDir():
+				return os.MkdirAll(destPath, 0755)
+			case info.Mode().IsRegular():
+				return copyFile(srcPath, destPath, info.Mode().Perm())
+			default:
+				return nil
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to copy %q: %w", p, err)
+		}
+	}
+	return missing, nil
+}
+
+func copyFile(src, dest string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
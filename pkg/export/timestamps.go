@@ -0,0 +1,118 @@
+package export
+
+import (
+	"fmt"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// NormaliseTimestamps sets creation time in config and history of each
+// of the images to the given time, layers are left untouched; artifact
+// is returned as is when all timestamps are already set, otherwise
+// any annotations of the top-level index are dropped
+func NormaliseTimestamps(artifact *Artifact, t time.Time) (*Artifact, error) {
+	created := v1.Time{Time: t.UTC().Truncate(time.Second)}
+
+	normalised := *artifact
+	if artifact.Index != nil {
+		idx, _, err := normaliseIndexTimestamps(artifact.Index, created)
+		if err != nil {
+			return nil, err
+		}
+		normalised.Index = idx
+		return &normalised, nil
+	}
+
+	img, _, err := normaliseImageTimestamps(artifact.Image, created)
+	if err != nil {
+		return nil, err
+	}
+	normalised.Image = img
+	return &normalised, nil
+}
+
+func normaliseImageTimestamps(img v1.Image, created v1.Time) (v1.Image, bool, error) {
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return nil, false, err
+	}
+
+	configFile = configFile.DeepCopy()
+	changed := !configFile.Created.Equal(created.Time)
+	configFile.Created = created
+	for i := range configFile.History {
+		if !configFile.History[i].Created.Equal(created.Time) {
+			changed = true
+		}
+		configFile.History[i].Created = created
+	}
+	if !changed {
+		return img, false, nil
+	}
+
+	img, err = mutate.ConfigFile(img, configFile)
+	if err != nil {
+		return nil, false, err
+	}
+	return img, true, nil
+}
+
+func normaliseIndexTimestamps(idx v1.ImageIndex, created v1.Time) (v1.ImageIndex, bool, error) {
+	indexManifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, false, err
+	}
+	mediaType, err := idx.MediaType()
+	if err != nil {
+		return nil, false, err
+	}
+
+	changed := false
+	addenda := make([]mutate.IndexAddendum, 0, len(indexManifest.Manifests))
+	for _, desc := range indexManifest.Manifests {
+		var (
+			add          mutate.Appendable
+			childChanged bool
+		)
+		switch {
+		case isIndex(desc.MediaType):
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, false, err
+			}
+			add, childChanged, err = normaliseIndexTimestamps(child, created)
+			if err != nil {
+				return nil, false, err
+			}
+		case desc.MediaType == types.OCIManifestSchema1, desc.MediaType == types.DockerManifestSchema2:
+			child, err := idx.Image(desc.Digest)
+			if err != nil {
+				return nil, false, err
+			}
+			add, childChanged, err = normaliseImageTimestamps(child, created)
+			if err != nil {
+				return nil, false, err
+			}
+		default:
+			return nil, false, fmt.Errorf("unexpected media type %q of %q", desc.MediaType, desc.Digest)
+		}
+		changed = changed || childChanged
+		addenda = append(addenda, mutate.IndexAddendum{
+			Add: add,
+			Descriptor: v1.Descriptor{
+				Platform:    desc.Platform,
+				Annotations: desc.Annotations,
+				URLs:        desc.URLs,
+			},
+		})
+	}
+	if !changed {
+		return idx, false, nil
+	}
+
+	return mutate.AppendManifests(mutate.IndexMediaType(empty.Index, mediaType), addenda...), true, nil
+}
@@ -2,10 +2,13 @@ package git
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/Masterminds/semver"
 )
 
+// FakeRepo returns values of its fields for HEAD, and values of
+// one of the Revisions for any other revision
 type FakeRepo struct {
 	TreeHashForHeadRoot  string
 	TreeHashForHeadVal   map[string]string
@@ -14,35 +17,82 @@ type FakeRepo struct {
 	IsWIPVal             map[string]bool
 	IsWIPRoot            bool
 	IsDevVal             bool
+	CurrentBranchVal     string
+	OriginURLVal         string
+	CommitTimeRoot       time.Time
+	CommitTimeVal        map[string]time.Time
+	// LastCommitVal is only needed for paths that
+	// were last changed before the commit itself
+	LastCommitVal map[string]string
+	MergeBaseVal  string
+	Revisions     map[string]*FakeRepo
+	// Ancestors are listed for each revision
+	Ancestors        map[string][]string
+	PathRevisionsVal map[string][]PathRevision
+	BranchesVal      map[string][]string
+	ReleasesVal      map[string][]string
 }
 
-func (f *FakeRepo) TreeHashForHead(path string) (string, error) {
+func (f *FakeRepo) revision(rev string) (*FakeRepo, error) {
+	if rev == Head {
+		return f, nil
+	}
+	v, ok := f.Revisions[rev]
+	if !ok {
+		return nil, fmt.Errorf("%s not in fake repo", rev)
+	}
+	return v, nil
+}
+
+func (f *FakeRepo) TreeHash(rev, path string) (string, error) {
+	r, err := f.revision(rev)
+	if err != nil {
+		return "", err
+	}
 	if path == "" {
-		return f.TreeHashForHeadRoot, nil
+		return r.TreeHashForHeadRoot, nil
 	}
-	v, ok := f.TreeHashForHeadVal[path]
+	v, ok := r.TreeHashForHeadVal[path]
 	if !ok {
 		return "", fmt.Errorf("%s not in fake tree", path)
 	}
 	return v, nil
 }
 
-func (f *FakeRepo) CommitHashForHead(short bool) (string, error) {
+func (f *FakeRepo) TreeHashes(revs []string, path string) (map[string]string, error) {
+	treeHashes := map[string]string{}
+	for _, rev := range revs {
+		if treeHash, err := f.TreeHash(rev, path); err == nil {
+			treeHashes[rev] = treeHash
+		}
+	}
+	return treeHashes, nil
+}
+
+func (f *FakeRepo) CommitHash(rev string, short bool) (string, error) {
+	r, err := f.revision(rev)
+	if err != nil {
+		return "", err
+	}
 	if short {
-		return f.CommitHashForHeadVal[:6], nil
+		return r.CommitHashForHeadVal[:6], nil
 	}
-	return f.CommitHashForHeadVal, nil
+	return r.CommitHashForHeadVal, nil
 }
 
-func (f *FakeRepo) TagsForHead() ([]string, error) {
-	if len(f.TagsForHeadVal) == 0 {
+func (f *FakeRepo) Tags(rev string) ([]string, error) {
+	r, err := f.revision(rev)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.TagsForHeadVal) == 0 {
 		return nil, fmt.Errorf("no tag in fake repo")
 	}
-	return f.TagsForHeadVal, nil
+	return r.TagsForHeadVal, nil
 }
 
-func (f *FakeRepo) SemVerTagForHead(ignoreParserErrors bool) (*semver.Version, error) {
-	tags, err := f.TagsForHead()
+func (f *FakeRepo) SemVerTag(rev string, ignoreParserErrors bool) (*semver.Version, error) {
+	tags, err := f.Tags(rev)
 	if err != nil {
 		return nil, err
 	}
@@ -60,6 +110,79 @@ func (f *FakeRepo) IsWIP(path string) (bool, error) {
 	return v, nil
 }
 
-func (f *FakeRepo) IsDev(string) (bool, error) {
-	return f.IsDevVal, nil
+func (f *FakeRepo) IsDev(rev, _ string) (bool, error) {
+	r, err := f.revision(rev)
+	if err != nil {
+		return false, err
+	}
+	return r.IsDevVal, nil
+}
+
+func (f *FakeRepo) CurrentBranch() (string, error) {
+	return f.CurrentBranchVal, nil
+}
+
+func (f *FakeRepo) OriginURL() (string, error) {
+	return f.OriginURLVal, nil
+}
+
+func (f *FakeRepo) CommitTime(rev, path string) (time.Time, error) {
+	r, err := f.revision(rev)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if path == "" {
+		return r.CommitTimeRoot, nil
+	}
+	return r.CommitTimeVal[path], nil
+}
+
+func (f *FakeRepo) LastCommit(rev, path string) (string, error) {
+	r, err := f.revision(rev)
+	if err != nil {
+		return "", err
+	}
+	if v, ok := r.LastCommitVal[path]; ok {
+		return v, nil
+	}
+	return r.CommitHashForHeadVal, nil
+}
+
+func (f *FakeRepo) MergeBase(string) (string, error) {
+	if f.MergeBaseVal == "" {
+		return "", fmt.Errorf("no merge base in fake repo")
+	}
+	return f.MergeBaseVal, nil
+}
+
+func (f *FakeRepo) IsAncestor(ancestor, rev string) (bool, error) {
+	if ancestor == rev {
+		return true, nil
+	}
+	for _, v := range f.Ancestors[rev] {
+		if v == ancestor {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *FakeRepo) PathRevisions(path string) ([]PathRevision, error) {
+	return f.PathRevisionsVal[path], nil
+}
+
+func (f *FakeRepo) BranchesContaining(rev string) ([]string, error) {
+	return f.BranchesVal[rev], nil
+}
+
+func (f *FakeRepo) ReleasesContaining(rev string) ([]*semver.Version, error) {
+	versions := []*semver.Version{}
+	for _, tag := range f.ReleasesVal[rev] {
+		version, err := semver.NewVersion(tag)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
 }
@@ -8,21 +8,40 @@ package git
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Masterminds/semver"
 )
 
+// Head is the revision that is checked out, uncommitted changes
+// are only checked for it with IsWIP
+const Head = "HEAD"
+
+// Git provides information about a revision, which is anything
+// that resolves to a commit (e.g. a commit hash, branch or tag)
 type Git interface {
-	TreeHashForHead(string) (string, error)
-	CommitHashForHead(short bool) (string, error)
-	TagsForHead() ([]string, error)
-	SemVerTagForHead(bool) (*semver.Version, error)
+	TreeHash(rev, path string) (string, error)
+	TreeHashes(revs []string, path string) (map[string]string, error)
+	CommitHash(rev string, short bool) (string, error)
+	Tags(rev string) ([]string, error)
+	SemVerTag(rev string, ignoreParserErrors bool) (*semver.Version, error)
 	IsWIP(string) (bool, error)
-	IsDev(string) (bool, error)
+	IsDev(rev, baseBranch string) (bool, error)
+	CurrentBranch() (string, error)
+	OriginURL() (string, error)
+	CommitTime(rev, path string) (time.Time, error)
+	LastCommit(rev, path string) (string, error)
+	MergeBase(string) (string, error)
+	IsAncestor(ancestor, rev string) (bool, error)
+	PathRevisions(path string) ([]PathRevision, error)
+	BranchesContaining(rev string) ([]string, error)
+	ReleasesContaining(rev string) ([]*semver.Version, error)
 }
 
 type GitRepo struct {
@@ -66,7 +85,12 @@ func (g *GitRepo) mkCmd(args ...string) *exec.Cmd {
 }
 
 func (g *GitRepo) commandStdout(args ...string) (string, error) {
+	return g.commandStdoutWithInput(nil, args...)
+}
+
+func (g *GitRepo) commandStdoutWithInput(input io.Reader, args ...string) (string, error) {
 	cmd := g.mkCmd(args...)
+	cmd.Stdin = input
 	cmd.Stderr = nil
 	if debug() {
 		cmd.Stderr = os.Stderr
@@ -123,8 +147,8 @@ func (g *GitRepo) isAtTopLevel() (bool, error) {
 	return g.TopLevel == wd, nil
 }
 
-func (g *GitRepo) TreeHashForHead(path string) (string, error) {
-	revParseOut, err := g.commandStdout("rev-parse", "HEAD:"+path)
+func (g *GitRepo) TreeHash(rev, path string) (string, error) {
+	revParseOut, err := g.commandStdout("rev-parse", rev+":"+path)
 	if err != nil {
 		return "", err
 	}
@@ -132,10 +156,41 @@ func (g *GitRepo) TreeHashForHead(path string) (string, error) {
 	return strings.TrimSpace(revParseOut), nil
 }
 
-func (g *GitRepo) CommitHashForHead(short bool) (string, error) {
-	args := []string{"rev-parse", "HEAD"}
+// TreeHashes returns tree hashes of the path in each of the given
+// commits, all of them are looked up with a single git command;
+// commits that don't have the path are omitted
+func (g *GitRepo) TreeHashes(revs []string, path string) (map[string]string, error) {
+	treeHashes := map[string]string{}
+	if len(revs) == 0 {
+		return treeHashes, nil
+	}
+	input := &strings.Builder{}
+	for _, rev := range revs {
+		fmt.Fprintf(input, "%s:%s\n", rev, path)
+	}
+	catFileOut, err := g.commandStdoutWithInput(strings.NewReader(input.String()), "cat-file", "--batch-check=%(objectname)")
+	if err != nil {
+		return nil, err
+	}
+	// there is one line of output for each line of input, objects
+	// that don't exist are reported as '<rev>:<path> missing'
+	lines := strings.Split(strings.TrimSuffix(catFileOut, "\n"), "\n")
+	if len(lines) != len(revs) {
+		return nil, fmt.Errorf("unexpected output of 'git cat-file' for %d revisions: %q", len(revs), catFileOut)
+	}
+	for i, line := range lines {
+		if strings.HasSuffix(line, " missing") {
+			continue
+		}
+		treeHashes[revs[i]] = strings.TrimSpace(line)
+	}
+	return treeHashes, nil
+}
+
+func (g *GitRepo) CommitHash(rev string, short bool) (string, error) {
+	args := []string{"rev-parse", "--verify", rev + "^{commit}"}
 	if short {
-		args = []string{"rev-parse", "--short", "HEAD"}
+		args = []string{"rev-parse", "--verify", "--short", rev + "^{commit}"}
 	}
 	out, err := g.commandStdout(args...)
 	if err != nil {
@@ -145,9 +200,9 @@ func (g *GitRepo) CommitHashForHead(short bool) (string, error) {
 	return strings.TrimSpace(out), nil
 }
 
-func (g *GitRepo) TagsForHead() ([]string, error) {
+func (g *GitRepo) Tags(rev string) ([]string, error) {
 	// using name-rev provides clear indication in case there is no tag
-	nameRevOut, err := g.commandStdout("name-rev", "--name-only", "--no-undefined", "--tags", "HEAD")
+	nameRevOut, err := g.commandStdout("name-rev", "--name-only", "--no-undefined", "--tags", rev)
 	if err != nil {
 		return nil, err
 	}
@@ -188,8 +243,8 @@ func semVerFromTags(ignoreParserErrors bool, tags []string) (*semver.Version, er
 	return versions[l-1], nil
 }
 
-func (g *GitRepo) SemVerTagForHead(ignoreParserErrors bool) (*semver.Version, error) {
-	tags, err := g.TagsForHead()
+func (g *GitRepo) SemVerTag(rev string, ignoreParserErrors bool) (*semver.Version, error) {
+	tags, err := g.Tags(rev)
 	if err != nil {
 		return nil, err
 	}
@@ -211,7 +266,7 @@ func (g *GitRepo) IsWIP(path string) (bool, error) {
 	if path == "" {
 		path = g.TopLevel
 	}
-	err := g.command("diff-index", "--quiet", "HEAD", "--", path)
+	err := g.command("diff-index", "--quiet", Head, "--", path)
 	if err == nil {
 		return false, nil
 	}
@@ -221,20 +276,168 @@ func (g *GitRepo) IsWIP(path string) (bool, error) {
 	return false, err
 }
 
-// IsDev check if current branch has diverged from the base branch
-func (g *GitRepo) IsDev(baseBranch string) (bool, error) {
-	revParseOut, err := g.commandStdout("rev-parse", "HEAD")
+// IsDev check if the commit is not on the base branch, i.e.
+// current branch has diverged from the base branch
+func (g *GitRepo) IsDev(rev, baseBranch string) (bool, error) {
+	isAncestor, err := g.IsAncestor(rev, baseBranch)
+	if err != nil {
+		return false, err
+	}
+	return !isAncestor, nil
+}
+
+// IsAncestor checks if the first commit is an ancestor of
+// the second one, a commit is an ancestor of itself
+func (g *GitRepo) IsAncestor(ancestor, rev string) (bool, error) {
+	revParseOut, err := g.commandStdout("rev-parse", "--verify", ancestor+"^{commit}")
 	if err != nil {
 		return false, err
 	}
 
-	_, err = g.commandStdout("merge-base", "--is-ancestor", strings.TrimSpace(revParseOut), baseBranch)
+	_, err = g.commandStdout("merge-base", "--is-ancestor", strings.TrimSpace(revParseOut), rev)
 	if err != nil {
 		if exitErr, ok := errors.Unwrap(err).(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
-			return true, nil
+			return false, nil
 		}
 		return false, err
 	}
 
-	return false, nil
+	return true, nil
+}
+
+// PathRevision is a commit that changed a path, Parents are the nearest
+// ancestors of the commit that changed the same path
+type PathRevision struct {
+	Commit  string
+	Parents []string
+}
+
+// PathRevisions returns commits reachable from any ref that changed the
+// given path, descendants are listed before ancestors; as parents are
+// rewritten by git, the whole history of the path is read at once
+func (g *GitRepo) PathRevisions(path string) ([]PathRevision, error) {
+	revListOut, err := g.commandStdout("rev-list", "--all", "--topo-order", "--simplify-merges", "--parents", "--", path)
+	if err != nil {
+		return nil, err
+	}
+
+	revs := []PathRevision{}
+	for _, line := range strings.Split(strings.TrimSpace(revListOut), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		revs = append(revs, PathRevision{Commit: fields[0], Parents: fields[1:]})
+	}
+	return revs, nil
+}
+
+// BranchesContaining returns names of local and remote branches
+// the commit is on
+func (g *GitRepo) BranchesContaining(rev string) ([]string, error) {
+	branchOut, err := g.commandStdout("branch", "--all", "--format=%(refname:short)", "--contains", rev)
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(branchOut), nil
+}
+
+// ReleasesContaining returns semver tags that include the commit,
+// sorted from the earliest, other tags are ignored
+func (g *GitRepo) ReleasesContaining(rev string) ([]*semver.Version, error) {
+	tagOut, err := g.commandStdout("tag", "--contains", rev)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []*semver.Version{}
+	for _, tag := range strings.Fields(tagOut) {
+		if version, err := semver.NewVersion(tag); err == nil {
+			versions = append(versions, version)
+		}
+	}
+	sort.Sort(semver.Collection(versions))
+	return versions, nil
+}
+
+// MergeBase returns full hash of the best common ancestor
+// of HEAD and the base branch
+func (g *GitRepo) MergeBase(baseBranch string) (string, error) {
+	mergeBaseOut, err := g.commandStdout("merge-base", Head, baseBranch)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(mergeBaseOut), nil
+}
+
+// CurrentBranch returns name of the branch that is checked out, or
+// an empty string when HEAD is detached
+func (g *GitRepo) CurrentBranch() (string, error) {
+	revParseOut, err := g.commandStdout("rev-parse", "--abbrev-ref", Head)
+	if err != nil {
+		return "", err
+	}
+
+	branch := strings.TrimSpace(revParseOut)
+	if branch == Head {
+		return "", nil
+	}
+	return branch, nil
+}
+
+// OriginURL returns URL of 'origin' remote, or an empty
+// string when there is no such remote
+func (g *GitRepo) OriginURL() (string, error) {
+	remoteOut, err := g.commandStdout("remote")
+	if err != nil {
+		return "", err
+	}
+	for _, remote := range strings.Fields(remoteOut) {
+		if remote != "origin" {
+			continue
+		}
+		urlOut, err := g.commandStdout("remote", "get-url", "origin")
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(urlOut), nil
+	}
+	return "", nil
+}
+
+// CommitTime returns committer date of the last commit
+// that changed the given path, or of the commit itself when path is empty
+func (g *GitRepo) CommitTime(rev, path string) (time.Time, error) {
+	args := []string{"log", "-1", "--format=%ct", rev}
+	if path != "" {
+		args = append(args, "--", path)
+	}
+	logOut, err := g.commandStdout(args...)
+	if err != nil {
+		return time.Time{}, err
+	}
+	timestamp, err := strconv.ParseInt(strings.TrimSpace(logOut), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to parse commit time: %w", err)
+	}
+	return time.Unix(timestamp, 0).UTC(), nil
+}
+
+// LastCommit returns hash of the last commit that changed
+// the given path, or of the commit itself when path is empty
+func (g *GitRepo) LastCommit(rev, path string) (string, error) {
+	if path == "" {
+		return g.CommitHash(rev, false)
+	}
+	logOut, err := g.commandStdout("log", "-1", "--format=%H", rev, "--", path)
+	if err != nil {
+		return "", err
+	}
+	commit := strings.TrimSpace(logOut)
+	if commit == "" {
+		return "", fmt.Errorf("%s is not in history of %s", path, rev)
+	}
+	return commit, nil
 }
@@ -0,0 +1,239 @@
+package git_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	. "github.com/errordeveloper/imagine/pkg/git"
+)
+
+// testRepo is a temporary git repo with isolated config
+type testRepo struct {
+	t   *testing.T
+	dir string
+}
+
+// setenv sets the variable for the duration of the test
+func setenv(t *testing.T, key, value string) {
+	previous, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			_ = os.Setenv(key, previous)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	})
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	// global config is read from HOME and XDG_CONFIG_HOME,
+	// both point to an empty directory
+	home := t.TempDir()
+	setenv(t, "HOME", home)
+	setenv(t, "XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	setenv(t, "GIT_CONFIG_NOSYSTEM", "1")
+	setenv(t, "GIT_AUTHOR_NAME", "imagine")
+	setenv(t, "GIT_AUTHOR_EMAIL", "imagine@example.com")
+	setenv(t, "GIT_COMMITTER_NAME", "imagine")
+	setenv(t, "GIT_COMMITTER_EMAIL", "imagine@example.com")
+
+	r := &testRepo{t: t, dir: t.TempDir()}
+	r.git("init", "-q")
+	r.git("symbolic-ref", "HEAD", "refs/heads/master")
+	return r
+}
+
+func (r *testRepo) git(args ...string) string {
+	cmd := exec.Command("git", append([]string{"-C", r.dir}, args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("git %v: %s: %s", args, err, out)
+	}
+	return string(out)
+}
+
+// commit writes the files and commits them, it returns hash of the commit
+func (r *testRepo) commit(message string, files map[string]string) string {
+	for name, content := range files {
+		path := filepath.Join(r.dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			r.t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			r.t.Fatal(err)
+		}
+	}
+	r.git("add", "-A")
+	r.git("commit", "-q", "-m", message)
+	return r.git("rev-parse", "HEAD")[:40]
+}
+
+// open returns GitRepo for the test repo, as New changes working
+// directory to the top level of the repo, it's restored afterwards
+func (r *testRepo) open() *GitRepo {
+	wd, err := os.Getwd()
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	r.t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	g, err := New(r.dir)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return g
+}
+
+func TestRepoHistory(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	r := newTestRepo(t)
+
+	// master: c1 -- c2 -- c3 (v1.0.0)
+	//                \
+	// feature:        f1 (v1.1.0-rc.1, latest)
+	c1 := r.commit("add image", map[string]string{"image/Dockerfile": "FROM scratch\n"})
+	c2 := r.commit("update readme", map[string]string{"README.md": "imagine\n"})
+	c3 := r.commit("update image", map[string]string{"image/Dockerfile": "FROM alpine\n"})
+	r.git("tag", "v1.0.0")
+	r.git("checkout", "-q", "-b", "feature", c2)
+	f1 := r.commit("change image on a branch", map[string]string{"image/Dockerfile": "FROM busybox\n"})
+	r.git("tag", "v1.1.0-rc.1")
+	r.git("tag", "latest")
+	r.git("checkout", "-q", "master")
+
+	repo := r.open()
+
+	{
+		for _, c := range []struct {
+			ancestor, rev string
+			expected      bool
+		}{
+			{c1, c3, true},
+			{c3, c1, false},
+			{c3, c3, true},
+			{c2, "feature", true},
+			{f1, "master", false},
+			{"v1.0.0", "master", true},
+		} {
+			isAncestor, err := repo.IsAncestor(c.ancestor, c.rev)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(isAncestor).To(Equal(c.expected), "%s is ancestor of %s", c.ancestor, c.rev)
+		}
+
+		_, err := repo.IsAncestor("no-such-rev", "master")
+		g.Expect(err).To(HaveOccurred())
+	}
+
+	{
+		isDev, err := repo.IsDev(f1, "master")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(isDev).To(BeTrue())
+
+		isDev, err = repo.IsDev(c2, "master")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(isDev).To(BeFalse())
+	}
+
+	{
+		// c2 didn't change the directory, so it's skipped in parents
+		revs, err := repo.PathRevisions("image")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(revs).To(HaveLen(3))
+		g.Expect(revs[:2]).To(ConsistOf(
+			PathRevision{Commit: c3, Parents: []string{c1}},
+			PathRevision{Commit: f1, Parents: []string{c1}},
+		))
+		g.Expect(revs[2]).To(Equal(PathRevision{Commit: c1, Parents: []string{}}))
+
+		revs, err = repo.PathRevisions("README.md")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(revs).To(Equal([]PathRevision{{Commit: c2, Parents: []string{}}}))
+	}
+
+	{
+		// merge keeps the directory as it is on master, it stays in
+		// the history, as it differs from one of the parents
+		r.git("merge", "-q", "--no-ff", "-s", "ours", "-m", "merge feature", "feature")
+		m1 := r.git("rev-parse", "HEAD")[:40]
+
+		revs, err := repo.PathRevisions("image")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(revs).To(HaveLen(4))
+		g.Expect(revs[0]).To(Equal(PathRevision{Commit: m1, Parents: []string{c3, f1}}))
+
+		r.git("reset", "-q", "--hard", c3)
+	}
+
+	{
+		// README.md doesn't exist in c1, nor does any path in a bad revision
+		treeHashes, err := repo.TreeHashes([]string{c1, c2, c3, f1, "no-such-rev"}, "README.md")
+		g.Expect(err).ToNot(HaveOccurred())
+		readme := r.git("rev-parse", c2+":README.md")[:40]
+		g.Expect(treeHashes).To(Equal(map[string]string{c2: readme, c3: readme, f1: readme}))
+
+		treeHashes, err = repo.TreeHashes([]string{c1, c3}, "image")
+		g.Expect(err).ToNot(HaveOccurred())
+		for _, rev := range []string{c1, c3} {
+			treeHash, err := repo.TreeHash(rev, "image")
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(treeHashes).To(HaveKeyWithValue(rev, treeHash))
+		}
+
+		treeHashes, err = repo.TreeHashes(nil, "image")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(treeHashes).To(BeEmpty())
+	}
+
+	{
+		for _, c := range []struct {
+			rev, path, expected string
+		}{
+			{"master", "image", c3},
+			{"master", "README.md", c2},
+			{"master", "", c3},
+			{"feature", "image", f1},
+			{c2, "image", c1},
+		} {
+			commit, err := repo.LastCommit(c.rev, c.path)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(commit).To(Equal(c.expected), "last commit of %q at %s", c.path, c.rev)
+		}
+
+		_, err := repo.LastCommit(c1, "README.md")
+		g.Expect(err).To(HaveOccurred())
+	}
+
+	{
+		branches, err := repo.BranchesContaining(c2)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(branches).To(ConsistOf("master", "feature"))
+
+		branches, err = repo.BranchesContaining(c3)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(branches).To(ConsistOf("master"))
+	}
+
+	{
+		releases, err := repo.ReleasesContaining(c1)
+		g.Expect(err).ToNot(HaveOccurred())
+		versions := []string{}
+		for _, release := range releases {
+			versions = append(versions, release.Original())
+		}
+		g.Expect(versions).To(Equal([]string{"v1.0.0", "v1.1.0-rc.1"}))
+
+		releases, err = repo.ReleasesContaining(f1)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(releases).To(HaveLen(1))
+		g.Expect(releases[0].Original()).To(Equal("v1.1.0-rc.1"))
+	}
+}
@@ -0,0 +1,407 @@
+package imagediff
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	units "github.com/docker/go-units"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/errordeveloper/imagine/pkg/export"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+
+	Added    = "A"
+	Modified = "M"
+	Deleted  = "D"
+)
+
+// ConfigChange is a difference in one field of image config, values
+// are empty when field is not set
+type ConfigChange struct {
+	Field    string
+	Old, New string
+}
+
+// Layer is a layer that is only present in one of the images, Files
+// are only set for layers of the new image
+type Layer struct {
+	DiffID    v1.Hash
+	Size      int64
+	CreatedBy string
+	Files     []FileChange
+}
+
+// FileChange describes a path changed by a layer, directories
+// are only included when they are added
+type FileChange struct {
+	Change string
+	Path   string
+	Size   int64
+}
+
+// Diff is the difference between images for one platform, when the
+// platform is missing from one of the images, only that is set
+type Diff struct {
+	Platform   string
+	OldMissing bool
+	NewMissing bool
+
+	Config       []ConfigChange
+	CommonLayers int
+	Removed      []Layer
+	Added        []Layer
+}
+
+// Compare returns differences for each of the platforms in
+// either of the artifacts, sorted by platform
+func Compare(oldArtifact, newArtifact *export.Artifact) ([]Diff, error) {
+	oldImages, err := oldArtifact.PlatformImages()
+	if err != nil {
+		return nil, err
+	}
+	newImages, err := newArtifact.PlatformImages()
+	if err != nil {
+		return nil, err
+	}
+
+	platforms := []string{}
+	for platform := range oldImages {
+		platforms = append(platforms, platform)
+	}
+	for platform := range newImages {
+		if _, ok := oldImages[platform]; !ok {
+			platforms = append(platforms, platform)
+		}
+	}
+	sort.Strings(platforms)
+
+	diffs := []Diff{}
+	for _, platform := range platforms {
+		oldImage, newImage := oldImages[platform], newImages[platform]
+		if oldImage == nil || newImage == nil {
+			diffs = append(diffs, Diff{Platform: platform, OldMissing: oldImage == nil, NewMissing: newImage == nil})
+			continue
+		}
+		diff, err := compareImages(oldImage, newImage)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compare images for %q: %w", platform, err)
+		}
+		diff.Platform = platform
+		diffs = append(diffs, *diff)
+	}
+	return diffs, nil
+}
+
+func compareImages(oldImage, newImage v1.Image) (*Diff, error) {
+	oldConfig, err := oldImage.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	newConfig, err := newImage.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	diff := &Diff{Config: compareConfig(oldConfig.Config, newConfig.Config)}
+
+	oldLayers, err := layers(oldImage, oldConfig)
+	if err != nil {
+		return nil, err
+	}
+	newLayers, err := layers(newImage, newConfig)
+	if err != nil {
+		return nil, err
+	}
+	for diff.CommonLayers < len(oldLayers) && diff.CommonLayers < len(newLayers) &&
+		oldLayers[diff.CommonLayers].DiffID == newLayers[diff.CommonLayers].DiffID {
+		diff.CommonLayers++
+	}
+	diff.Removed = oldLayers[diff.CommonLayers:]
+	diff.Added = newLayers[diff.CommonLayers:]
+
+	if len(diff.Added) != 0 {
+		if err := addFileChanges(newImage, diff.CommonLayers, diff.Added); err != nil {
+			return nil, err
+		}
+	}
+	return diff, nil
+}
+
+func compareConfig(oldConfig, newConfig v1.Config) []ConfigChange {
+	changes := []ConfigChange{}
+	compare := func(field, oldValue, newValue string) {
+		if oldValue != newValue {
+			changes = append(changes, ConfigChange{Field: field, Old: oldValue, New: newValue})
+		}
+	}
+	compare("user", quote(oldConfig.User), quote(newConfig.User))
+	compare("workingDir", quote(oldConfig.WorkingDir), quote(newConfig.WorkingDir))
+	compare("entrypoint", quoteSlice(oldConfig.Entrypoint), quoteSlice(newConfig.Entrypoint))
+	compare("cmd", quoteSlice(oldConfig.Cmd), quoteSlice(newConfig.Cmd))
+
+	compareMaps := func(field string, oldMap, newMap map[string]string) {
+		for _, key := range unionKeys(oldMap, newMap) {
+			oldValue, oldOK := oldMap[key]
+			newValue, newOK := newMap[key]
+			if oldOK {
+				oldValue = fmt.Sprintf("%q", oldValue)
+			}
+			if newOK {
+				newValue = fmt.Sprintf("%q", newValue)
+			}
+			compare(field+" "+key, oldValue, newValue)
+		}
+	}
+	compareMaps("env", envMap(oldConfig.Env), envMap(newConfig.Env))
+	compareMaps("label", oldConfig.Labels, newConfig.Labels)
+
+	compareSets := func(field string, oldSet, newSet map[string]struct{}) {
+		for _, key := range unionKeys(setMap(oldSet), setMap(newSet)) {
+			_, oldOK := oldSet[key]
+			_, newOK := newSet[key]
+			compare(field+" "+key, present(oldOK), present(newOK))
+		}
+	}
+	compareSets("exposedPort", oldConfig.ExposedPorts, newConfig.ExposedPorts)
+	compareSets("volume", oldConfig.Volumes, newConfig.Volumes)
+	return changes
+}
+
+func quote(value string) string {
+	if value == "" {
+		return ""
+	}
+	return fmt.Sprintf("%q", value)
+}
+
+func quoteSlice(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%q", values)
+}
+
+func present(ok bool) string {
+	if ok {
+		return "present"
+	}
+	return ""
+}
+
+func envMap(env []string) map[string]string {
+	m := map[string]string{}
+	for _, kv := range env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			m[parts[0]] = parts[1]
+		} else {
+			m[parts[0]] = ""
+		}
+	}
+	return m
+}
+
+func setMap(set map[string]struct{}) map[string]string {
+	m := map[string]string{}
+	for key := range set {
+		m[key] = ""
+	}
+	return m
+}
+
+func unionKeys(a, b map[string]string) []string {
+	keys := []string{}
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// layers returns diff IDs and sizes of image layers, along with
+// commands that created them when history is available
+func layers(img v1.Image, configFile *v1.ConfigFile) ([]Layer, error) {
+	imageLayers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	createdBy := []string{}
+	for _, history := range configFile.History {
+		if !history.EmptyLayer {
+			createdBy = append(createdBy, history.CreatedBy)
+		}
+	}
+	if len(createdBy) != len(imageLayers) {
+		createdBy = nil
+	}
+
+	result := []Layer{}
+	for i, layer := range imageLayers {
+		diffID, err := layer.DiffID()
+		if err != nil {
+			return nil, err
+		}
+		size, err := layer.Size()
+		if err != nil {
+			return nil, err
+		}
+		l := Layer{DiffID: diffID, Size: size}
+		if createdBy != nil {
+			l.CreatedBy = createdBy[i]
+		}
+		result = append(result, l)
+	}
+	return result, nil
+}
+
+// addFileChanges applies the common layers first and then each of
+// the added layers, so that added files can be told from modified
+func addFileChanges(img v1.Image, commonLayers int, added []Layer) error {
+	imageLayers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+
+	paths := map[string]bool{}
+	for i, layer := range imageLayers {
+		changes := []FileChange{}
+		if err := applyLayer(layer, paths, func(change FileChange) {
+			changes = append(changes, change)
+		}); err != nil {
+			return err
+		}
+		if i >= commonLayers {
+			added[i-commonLayers].Files = changes
+		}
+	}
+	return nil
+}
+
+// applyLayer updates paths with the contents of the layer and
+// calls changed for each of the changes it makes
+func applyLayer(layer v1.Layer, paths map[string]bool, changed func(FileChange)) error {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read layer: %w", err)
+		}
+		name := cleanPath(header.Name)
+		if name == "" {
+			continue
+		}
+		dir, base := path.Split(name)
+		switch {
+		case base == opaqueWhiteout:
+			deletePaths(paths, strings.TrimSuffix(dir, "/"), false)
+			changed(FileChange{Change: Deleted, Path: "/" + dir + "*"})
+		case strings.HasPrefix(base, whiteoutPrefix):
+			deleted := dir + strings.TrimPrefix(base, whiteoutPrefix)
+			deletePaths(paths, deleted, true)
+			changed(FileChange{Change: Deleted, Path: "/" + deleted})
+		case paths[name]:
+			if header.Typeflag != tar.TypeDir {
+				changed(FileChange{Change: Modified, Path: "/" + name, Size: header.Size})
+			}
+		default:
+			paths[name] = true
+			if header.Typeflag == tar.TypeDir {
+				changed(FileChange{Change: Added, Path: "/" + name + "/"})
+				continue
+			}
+			changed(FileChange{Change: Added, Path: "/" + name, Size: header.Size})
+		}
+	}
+}
+
+// deletePaths removes everything under the given path, and the
+// path itself if self is set
+func deletePaths(paths map[string]bool, name string, self bool) {
+	if self {
+		delete(paths, name)
+	}
+	for p := range paths {
+		if strings.HasPrefix(p, name+"/") {
+			delete(paths, p)
+		}
+	}
+}
+
+func cleanPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// Write prints the differences in a human-readable form
+func Write(w io.Writer, diffs []Diff) {
+	for _, diff := range diffs {
+		fmt.Fprintf(w, "platform %s:\n", diff.Platform)
+		switch {
+		case diff.OldMissing:
+			fmt.Fprintf(w, "  only in new image\n")
+			continue
+		case diff.NewMissing:
+			fmt.Fprintf(w, "  only in old image\n")
+			continue
+		}
+
+		if len(diff.Config) == 0 {
+			fmt.Fprintf(w, "  config: no changes\n")
+		} else {
+			fmt.Fprintf(w, "  config:\n")
+			for _, change := range diff.Config {
+				fmt.Fprintf(w, "    %s: %s -> %s\n", change.Field, orUnset(change.Old), orUnset(change.New))
+			}
+		}
+
+		fmt.Fprintf(w, "  layers: %d in common, %d removed, %d added\n", diff.CommonLayers, len(diff.Removed), len(diff.Added))
+		for _, layer := range diff.Removed {
+			writeLayer(w, "-", layer)
+		}
+		for _, layer := range diff.Added {
+			writeLayer(w, "+", layer)
+			for _, file := range layer.Files {
+				if file.Change == Deleted || strings.HasSuffix(file.Path, "/") {
+					fmt.Fprintf(w, "      %s %s\n", file.Change, file.Path)
+					continue
+				}
+				fmt.Fprintf(w, "      %s %s (%s)\n", file.Change, file.Path, units.BytesSize(float64(file.Size)))
+			}
+		}
+	}
+}
+
+func writeLayer(w io.Writer, prefix string, layer Layer) {
+	fmt.Fprintf(w, "  %s %s (%s)", prefix, layer.DiffID, units.BytesSize(float64(layer.Size)))
+	if layer.CreatedBy != "" {
+		fmt.Fprintf(w, " %s", layer.CreatedBy)
+	}
+	fmt.Fprintln(w)
+}
+
+func orUnset(value string) string {
+	if value == "" {
+		return "(unset)"
+	}
+	return value
+}
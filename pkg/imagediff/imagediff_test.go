@@ -0,0 +1,120 @@
+package imagediff_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+
+	"github.com/errordeveloper/imagine/pkg/export"
+	. "github.com/errordeveloper/imagine/pkg/imagediff"
+	"github.com/errordeveloper/imagine/pkg/internal/testutil"
+)
+
+func newTestImage(t *testing.T, config v1.Config, layers ...mutate.Addendum) *export.Artifact {
+	return &export.Artifact{Image: testutil.NewImage(t, config, layers...)}
+}
+
+func TestCompare(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	base := mutate.Addendum{
+		Layer: testutil.NewLayer(t,
+			testutil.File{Name: "etc/", Typeflag: tar.TypeDir},
+			testutil.File{Name: "etc/os-release", Typeflag: tar.TypeReg, Content: "ID=alpine\n"},
+			testutil.File{Name: "var/cache/", Typeflag: tar.TypeDir},
+			testutil.File{Name: "var/cache/apk.idx", Typeflag: tar.TypeReg, Content: "index"},
+		),
+		History: v1.History{CreatedBy: "ADD rootfs.tar.gz /"},
+	}
+
+	oldImage := newTestImage(t,
+		v1.Config{
+			User:       "root",
+			Entrypoint: []string{"/app"},
+			Env:        []string{"PATH=/bin", "APP_MODE=debug"},
+			Labels:     map[string]string{"version": "1.0"},
+		},
+		base,
+		mutate.Addendum{
+			Layer:   testutil.NewLayer(t, testutil.File{Name: "app", Typeflag: tar.TypeReg, Content: "v1"}),
+			History: v1.History{CreatedBy: "COPY app /app"},
+		},
+	)
+
+	newImage := newTestImage(t,
+		v1.Config{
+			User:         "nobody",
+			Entrypoint:   []string{"/app"},
+			Env:          []string{"PATH=/bin"},
+			Labels:       map[string]string{"version": "1.1"},
+			ExposedPorts: map[string]struct{}{"8080/tcp": {}},
+		},
+		base,
+		mutate.Addendum{
+			Layer: testutil.NewLayer(t,
+				testutil.File{Name: "app", Typeflag: tar.TypeReg, Content: "v1.1"},
+				testutil.File{Name: "etc/", Typeflag: tar.TypeDir},
+				testutil.File{Name: "etc/app.conf", Typeflag: tar.TypeReg, Content: "listen=8080"},
+				testutil.File{Name: "var/cache/.wh..wh..opq", Typeflag: tar.TypeReg},
+			),
+			History: v1.History{CreatedBy: "COPY app /app"},
+		},
+		mutate.Addendum{
+			Layer:   testutil.NewLayer(t, testutil.File{Name: "app", Typeflag: tar.TypeReg, Content: "v1.1.1"}, testutil.File{Name: "etc/.wh.os-release", Typeflag: tar.TypeReg}),
+			History: v1.History{CreatedBy: "RUN patch"},
+		},
+	)
+
+	diffs, err := Compare(oldImage, newImage)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(diffs).To(HaveLen(1))
+
+	diff := diffs[0]
+	g.Expect(diff.Platform).To(Equal("linux-amd64"))
+	g.Expect(diff.Config).To(Equal([]ConfigChange{
+		{Field: "user", Old: `"root"`, New: `"nobody"`},
+		{Field: "env APP_MODE", Old: `"debug"`},
+		{Field: "label version", Old: `"1.0"`, New: `"1.1"`},
+		{Field: "exposedPort 8080/tcp", New: "present"},
+	}))
+	g.Expect(diff.CommonLayers).To(Equal(1))
+	g.Expect(diff.Removed).To(HaveLen(1))
+	g.Expect(diff.Removed[0].CreatedBy).To(Equal("COPY app /app"))
+	g.Expect(diff.Removed[0].Files).To(BeEmpty())
+	g.Expect(diff.Added).To(HaveLen(2))
+	g.Expect(diff.Added[0].Files).To(Equal([]FileChange{
+		{Change: Added, Path: "/app", Size: 4},
+		{Change: Added, Path: "/etc/app.conf", Size: 11},
+		{Change: Deleted, Path: "/var/cache/*"},
+	}))
+	g.Expect(diff.Added[1].CreatedBy).To(Equal("RUN patch"))
+	g.Expect(diff.Added[1].Files).To(Equal([]FileChange{
+		{Change: Modified, Path: "/app", Size: 6},
+		{Change: Deleted, Path: "/etc/os-release"},
+	}))
+
+	out := &bytes.Buffer{}
+	Write(out, diffs)
+	g.Expect(out.String()).To(HavePrefix(`platform linux-amd64:
+  config:
+    user: "root" -> "nobody"
+    env APP_MODE: "debug" -> (unset)
+    label version: "1.0" -> "1.1"
+    exposedPort 8080/tcp: (unset) -> present
+  layers: 1 in common, 1 removed, 2 added
+  - sha256:`))
+	g.Expect(out.String()).To(ContainSubstring("\n      A /etc/app.conf (11B)\n      D /var/cache/*\n  + sha256:"))
+	g.Expect(strings.Count(out.String(), " COPY app /app\n")).To(Equal(2))
+
+	diffs, err = Compare(oldImage, oldImage)
+	g.Expect(err).ToNot(HaveOccurred())
+	out.Reset()
+	Write(out, diffs)
+	g.Expect(out.String()).To(Equal("platform linux-amd64:\n  config: no changes\n  layers: 2 in common, 0 removed, 0 added\n"))
+}
@@ -0,0 +1,211 @@
+package imagesize
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	units "github.com/docker/go-units"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+
+	"github.com/errordeveloper/imagine/pkg/export"
+)
+
+const (
+	ModeWarn  = "warn"
+	ModeError = "error"
+)
+
+// Stats describes size of the image for one platform
+type Stats struct {
+	Platform     string
+	Compressed   int64
+	Uncompressed int64
+	Layers       int
+}
+
+// Measure returns stats for each of the platform images, sorted
+// by platform; uncompressed size is only known once all of the
+// layers are read, so remote layers get downloaded
+func Measure(artifact *export.Artifact) ([]Stats, error) {
+	images, err := artifact.PlatformImages()
+	if err != nil {
+		return nil, err
+	}
+	stats := []Stats{}
+	for platform, img := range images {
+		s, err := measureImage(img)
+		if err != nil {
+			return nil, fmt.Errorf("unable to measure image for %q: %w", platform, err)
+		}
+		s.Platform = platform
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Platform < stats[j].Platform })
+	return stats, nil
+}
+
+func measureImage(img v1.Image) (*Stats, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	s := &Stats{Layers: len(layers)}
+	for _, layer := range layers {
+		compressed, err := layer.Size()
+		if err != nil {
+			return nil, err
+		}
+		uncompressed, err := partial.UncompressedSize(layer)
+		if err != nil {
+			return nil, err
+		}
+		s.Compressed += compressed
+		s.Uncompressed += uncompressed
+	}
+	return s, nil
+}
+
+// Budget limits growth of compressed size and layer count compared
+// to the base image, negative values mean there is no limit
+type Budget struct {
+	MaxGrowth        int64
+	MaxGrowthPercent float64
+	MaxLayerGrowth   int
+}
+
+// NoBudget doesn't limit growth
+var NoBudget = Budget{MaxGrowth: -1, MaxGrowthPercent: -1, MaxLayerGrowth: -1}
+
+// ParseGrowth parses size growth limit, which is either a percentage
+// (e.g. '10%') or a size in bytes with an optional binary unit
+// suffix (e.g. '5MiB' or '512k'), an empty string means no limit
+func ParseGrowth(value string) (maxGrowth int64, maxGrowthPercent float64, err error) {
+	switch {
+	case value == "":
+		return -1, -1, nil
+	case strings.HasSuffix(value, "%"):
+		maxGrowthPercent, err = strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || maxGrowthPercent < 0 {
+			return 0, 0, fmt.Errorf("invalid size budget %q", value)
+		}
+		return -1, maxGrowthPercent, nil
+	default:
+		maxGrowth, err = units.RAMInBytes(value)
+		if err != nil || maxGrowth < 0 {
+			return 0, 0, fmt.Errorf("invalid size budget %q", value)
+		}
+		return maxGrowth, -1, nil
+	}
+}
+
+// Comparison of the image for one platform to the base image,
+// Base is nil when base image doesn't have the platform
+type Comparison struct {
+	Current    Stats
+	Base       *Stats
+	Violations []string
+}
+
+// Compare checks growth of each of the platform images, base can
+// be nil when there is no base image to compare to
+func Compare(current, base []Stats, budget Budget) []Comparison {
+	basePlatforms := map[string]*Stats{}
+	for i := range base {
+		basePlatforms[base[i].Platform] = &base[i]
+	}
+	comparisons := []Comparison{}
+	for _, s := range current {
+		c := Comparison{Current: s, Base: basePlatforms[s.Platform]}
+		if c.Base != nil {
+			c.Violations = budget.check(s, *c.Base)
+		}
+		comparisons = append(comparisons, c)
+	}
+	return comparisons
+}
+
+func (b Budget) check(current, base Stats) []string {
+	violations := []string{}
+	growth := current.Compressed - base.Compressed
+	if b.MaxGrowth >= 0 && growth > b.MaxGrowth {
+		violations = append(violations, fmt.Sprintf("compressed size grew by %s, which exceeds the budget of %s",
+			units.BytesSize(float64(growth)), units.BytesSize(float64(b.MaxGrowth))))
+	}
+	if b.MaxGrowthPercent >= 0 && growth > 0 {
+		if percent := growthPercent(current.Compressed, base.Compressed); percent > b.MaxGrowthPercent {
+			violations = append(violations, fmt.Sprintf("compressed size grew by %.1f%%, which exceeds the budget of %g%%",
+				percent, b.MaxGrowthPercent))
+		}
+	}
+	if layerGrowth := current.Layers - base.Layers; b.MaxLayerGrowth >= 0 && layerGrowth > b.MaxLayerGrowth {
+		violations = append(violations, fmt.Sprintf("%d layer(s) were added, which exceeds the budget of %d",
+			layerGrowth, b.MaxLayerGrowth))
+	}
+	return violations
+}
+
+func growthPercent(current, base int64) float64 {
+	if base == 0 {
+		return 100
+	}
+	return float64(current-base) / float64(base) * 100
+}
+
+func formatSize(size int64) string {
+	return units.BytesSize(float64(size))
+}
+
+func formatDelta(current, base int64) string {
+	delta := current - base
+	sign := "+"
+	if delta < 0 {
+		sign, delta = "-", -delta
+	}
+	return fmt.Sprintf("%s%s, %s%.1f%%", sign, formatSize(delta), sign, absFloat(growthPercent(current, base)))
+}
+
+func absFloat(f float64) float64 {
+	if f < 0 {
+		return -f
+	}
+	return f
+}
+
+// Report writes comparisons to w, violations are reported as warnings
+// or errors depending on mode, and an error is returned in the latter
+// case if there are any
+func Report(w io.Writer, name, baseName string, mode string, comparisons []Comparison) error {
+	fmt.Fprintf(w, "image size of %q:\n", name)
+	if baseName != "" {
+		fmt.Fprintf(w, "  (compared to %q)\n", baseName)
+	}
+	violations := 0
+	for _, c := range comparisons {
+		fmt.Fprintf(w, "  %s: %s compressed, %s uncompressed, %d layer(s)\n",
+			c.Current.Platform, formatSize(c.Current.Compressed), formatSize(c.Current.Uncompressed), c.Current.Layers)
+		if c.Base != nil {
+			fmt.Fprintf(w, "    base: %s compressed (%s), %s uncompressed (%s), %d layer(s) (%+d)\n",
+				formatSize(c.Base.Compressed), formatDelta(c.Current.Compressed, c.Base.Compressed),
+				formatSize(c.Base.Uncompressed), formatDelta(c.Current.Uncompressed, c.Base.Uncompressed),
+				c.Base.Layers, c.Current.Layers-c.Base.Layers)
+		} else if baseName != "" {
+			fmt.Fprintf(w, "    base: platform not present in base image\n")
+		}
+		for _, violation := range c.Violations {
+			violations++
+			level := "warning"
+			if mode == ModeError {
+				level = "error"
+			}
+			fmt.Fprintf(w, "    %s: %s\n", level, violation)
+		}
+	}
+	if mode == ModeError && violations != 0 {
+		return fmt.Errorf("image %q exceeds size budget (%d violation(s))", name, violations)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package imagesize_test
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+
+	"github.com/errordeveloper/imagine/pkg/export"
+	. "github.com/errordeveloper/imagine/pkg/imagesize"
+)
+
+func TestMeasure(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	img, err := random.Image(1024, 3)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	stats, err := Measure(&export.Artifact{Image: img})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(stats).To(HaveLen(1))
+	g.Expect(stats[0].Platform).To(Equal("-"))
+	g.Expect(stats[0].Layers).To(Equal(3))
+	g.Expect(stats[0].Compressed).To(BeNumerically(">", 0))
+	g.Expect(stats[0].Uncompressed).To(BeNumerically(">", 3*1024))
+
+	idx, err := random.Index(1024, 2, 2)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	stats, err = Measure(&export.Artifact{Index: idx})
+	g.Expect(err).ToNot(HaveOccurred())
+	// random index has no platforms set, so both images have the same key
+	g.Expect(stats).To(HaveLen(1))
+	g.Expect(stats[0].Layers).To(Equal(2))
+}
+
+func TestParseGrowth(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	maxGrowth, maxGrowthPercent, err := ParseGrowth("")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(maxGrowth).To(BeEquivalentTo(-1))
+	g.Expect(maxGrowthPercent).To(BeEquivalentTo(-1))
+
+	maxGrowth, maxGrowthPercent, err = ParseGrowth("12.5%")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(maxGrowth).To(BeEquivalentTo(-1))
+	g.Expect(maxGrowthPercent).To(Equal(12.5))
+
+	maxGrowth, maxGrowthPercent, err = ParseGrowth("5MiB")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(maxGrowth).To(BeEquivalentTo(5 * 1024 * 1024))
+	g.Expect(maxGrowthPercent).To(BeEquivalentTo(-1))
+
+	maxGrowth, _, err = ParseGrowth("512k")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(maxGrowth).To(BeEquivalentTo(512 * 1024))
+
+	for _, value := range []string{"ten%", "-1%", "5 parsecs"} {
+		_, _, err = ParseGrowth(value)
+		g.Expect(err).To(MatchError(`invalid size budget "` + value + `"`))
+	}
+}
+
+func TestCompare(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	current := []Stats{
+		{Platform: "linux-amd64", Compressed: 12 * 1024 * 1024, Uncompressed: 30 * 1024 * 1024, Layers: 6},
+		{Platform: "linux-arm64", Compressed: 10 * 1024 * 1024, Uncompressed: 28 * 1024 * 1024, Layers: 5},
+		{Platform: "linux-s390x", Compressed: 10 * 1024 * 1024, Uncompressed: 28 * 1024 * 1024, Layers: 5},
+	}
+	base := []Stats{
+		{Platform: "linux-amd64", Compressed: 10 * 1024 * 1024, Uncompressed: 30 * 1024 * 1024, Layers: 4},
+		{Platform: "linux-arm64", Compressed: 11 * 1024 * 1024, Uncompressed: 29 * 1024 * 1024, Layers: 5},
+	}
+
+	{
+		comparisons := Compare(current, base, NoBudget)
+		g.Expect(comparisons).To(HaveLen(3))
+		for _, c := range comparisons {
+			g.Expect(c.Violations).To(BeEmpty())
+		}
+		g.Expect(comparisons[2].Base).To(BeNil())
+
+		out := &bytes.Buffer{}
+		g.Expect(Report(out, "reg.example.com/app:f0e1d2", "reg.example.com/app:a3b2c1", ModeError, comparisons)).To(Succeed())
+		g.Expect(out.String()).To(Equal(`image size of "reg.example.com/app:f0e1d2":
+  (compared to "reg.example.com/app:a3b2c1")
+  linux-amd64: 12MiB compressed, 30MiB uncompressed, 6 layer(s)
+    base: 10MiB compressed (+2MiB, +20.0%), 30MiB uncompressed (+0B, +0.0%), 4 layer(s) (+2)
+  linux-arm64: 10MiB compressed, 28MiB uncompressed, 5 layer(s)
+    base: 11MiB compressed (-1MiB, -9.1%), 29MiB uncompressed (-1MiB, -3.4%), 5 layer(s) (+0)
+  linux-s390x: 10MiB compressed, 28MiB uncompressed, 5 layer(s)
+    base: platform not present in base image
+`))
+	}
+
+	{
+		comparisons := Compare(current, base, Budget{MaxGrowth: 1024 * 1024, MaxGrowthPercent: 10, MaxLayerGrowth: 1})
+		g.Expect(comparisons[0].Violations).To(Equal([]string{
+			"compressed size grew by 2MiB, which exceeds the budget of 1MiB",
+			"compressed size grew by 20.0%, which exceeds the budget of 10%",
+			"2 layer(s) were added, which exceeds the budget of 1",
+		}))
+		g.Expect(comparisons[1].Violations).To(BeEmpty())
+
+		out := &bytes.Buffer{}
+		g.Expect(Report(out, "app", "", ModeWarn, comparisons)).To(Succeed())
+		g.Expect(out.String()).To(ContainSubstring("    warning: 2 layer(s) were added, which exceeds the budget of 1\n"))
+		g.Expect(out.String()).ToNot(ContainSubstring("compared to"))
+
+		out.Reset()
+		g.Expect(Report(out, "app", "", ModeError, comparisons)).To(MatchError(`image "app" exceeds size budget (3 violation(s))`))
+		g.Expect(out.String()).To(ContainSubstring("    error: compressed size grew by 2MiB, which exceeds the budget of 1MiB\n"))
+	}
+
+	{
+		comparisons := Compare(current, nil, Budget{MaxGrowth: 0, MaxGrowthPercent: 0, MaxLayerGrowth: 0})
+		for _, c := range comparisons {
+			g.Expect(c.Base).To(BeNil())
+			g.Expect(c.Violations).To(BeEmpty())
+		}
+	}
+}
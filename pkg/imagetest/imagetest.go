@@ -0,0 +1,301 @@
+package imagetest
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/errordeveloper/imagine/pkg/export"
+)
+
+// Spec is a set of assertions about image config and filesystem, only
+// fields that are set are checked
+type Spec struct {
+	Files []FileAssertion `json:"files,omitempty"`
+
+	Entrypoint []string `json:"entrypoint,omitempty"`
+	Cmd        []string `json:"cmd,omitempty"`
+	User       *string  `json:"user,omitempty"`
+	WorkingDir *string  `json:"workingDir,omitempty"`
+
+	// Env and Labels are checked for exact values, an empty
+	// value only checks that the variable or label is set
+	Env    map[string]string `json:"env,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+
+	ExposedPorts []string `json:"exposedPorts,omitempty"`
+
+	// MaxSize is the limit of total compressed size of
+	// the layers in bytes
+	MaxSize int64 `json:"maxSize,omitempty"`
+}
+
+// FileAssertion checks a path in image filesystem, symlinks are
+// not followed
+type FileAssertion struct {
+	Path string `json:"path"`
+	// Exists defaults to true, when false other fields are ignored
+	Exists     *bool  `json:"exists,omitempty"`
+	IsDir      bool   `json:"isDir,omitempty"`
+	Executable bool   `json:"executable,omitempty"`
+	Contains   string `json:"contains,omitempty"`
+}
+
+func (f *FileAssertion) exists() bool {
+	return f.Exists == nil || *f.Exists
+}
+
+// Result is the outcome of a single assertion for one platform
+type Result struct {
+	Platform  string
+	Assertion string
+	Err       error
+}
+
+// LoadSpec reads spec from a JSON file
+func LoadSpec(filename string) (*Spec, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	spec := &Spec{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(spec); err != nil {
+		return nil, fmt.Errorf("unable to parse image test spec %q: %w", filename, err)
+	}
+	for _, file := range spec.Files {
+		if file.Path == "" {
+			return nil, fmt.Errorf("invalid image test spec %q: file assertion without path", filename)
+		}
+	}
+	return spec, nil
+}
+
+// Run checks all assertions against each of the platform images,
+// results are sorted by platform
+func Run(artifact *export.Artifact, spec *Spec) ([]Result, error) {
+	images, err := artifact.PlatformImages()
+	if err != nil {
+		return nil, err
+	}
+	platforms := make([]string, 0, len(images))
+	for platform := range images {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+
+	results := []Result{}
+	for _, platform := range platforms {
+		imageResults, err := runImage(images[platform], spec)
+		if err != nil {
+			return nil, fmt.Errorf("unable to test image for %q: %w", platform, err)
+		}
+		for _, result := range imageResults {
+			result.Platform = platform
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+func runImage(img v1.Image, spec *Spec) ([]Result, error) {
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	config := configFile.Config
+
+	results := []Result{}
+	check := func(assertion string, err error) {
+		results = append(results, Result{Assertion: assertion, Err: err})
+	}
+
+	if spec.Entrypoint != nil {
+		check("entrypoint", expectEqual(spec.Entrypoint, config.Entrypoint))
+	}
+	if spec.Cmd != nil {
+		check("cmd", expectEqual(spec.Cmd, config.Cmd))
+	}
+	if spec.User != nil {
+		check("user", expectEqual(*spec.User, config.User))
+	}
+	if spec.WorkingDir != nil {
+		check("workingDir", expectEqual(*spec.WorkingDir, config.WorkingDir))
+	}
+
+	env := map[string]string{}
+	for _, kv := range config.Env {
+		if i := strings.Index(kv, "="); i != -1 {
+			env[kv[:i]] = kv[i+1:]
+		} else {
+			env[kv] = ""
+		}
+	}
+	for _, key := range sortedKeys(spec.Env) {
+		check("env "+key, expectValue(spec.Env[key], env, key))
+	}
+	for _, key := range sortedKeys(spec.Labels) {
+		check("label "+key, expectValue(spec.Labels[key], config.Labels, key))
+	}
+
+	for _, port := range spec.ExposedPorts {
+		var err error
+		if _, ok := config.ExposedPorts[port]; !ok {
+			err = fmt.Errorf("port is not exposed")
+		}
+		check("exposedPort "+port, err)
+	}
+
+	if spec.MaxSize != 0 {
+		size, err := compressedSize(img)
+		if err != nil {
+			return nil, err
+		}
+		if size > spec.MaxSize {
+			err = fmt.Errorf("size %d exceeds %d bytes", size, spec.MaxSize)
+		}
+		check("maxSize", err)
+	}
+
+	if len(spec.Files) != 0 {
+		files, err := readFiles(img, spec.Files)
+		if err != nil {
+			return nil, err
+		}
+		for _, assertion := range spec.Files {
+			check("file "+assertion.Path, checkFile(assertion, files[cleanPath(assertion.Path)]))
+		}
+	}
+
+	return results, nil
+}
+
+func expectEqual(expected, actual interface{}) error {
+	if reflect.DeepEqual(expected, actual) {
+		return nil
+	}
+	return fmt.Errorf("expected %q, got %q", expected, actual)
+}
+
+func expectValue(expected string, actual map[string]string, key string) error {
+	value, ok := actual[key]
+	if !ok {
+		return fmt.Errorf("not set")
+	}
+	if expected != "" && expected != value {
+		return fmt.Errorf("expected %q, got %q", expected, value)
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func compressedSize(img v1.Image) (int64, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return 0, err
+	}
+	total := int64(0)
+	for _, layer := range layers {
+		size, err := layer.Size()
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+func cleanPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// readFiles returns headers of the asserted paths in the flattened
+// filesystem, contents are only read when they need to be checked
+func readFiles(img v1.Image, assertions []FileAssertion) (map[string]*export.File, error) {
+	wanted := map[string]bool{}
+	for _, assertion := range assertions {
+		wanted[cleanPath(assertion.Path)] = wanted[cleanPath(assertion.Path)] || assertion.Contains != ""
+	}
+	return export.ReadFiles(img, func(name string) (bool, bool) {
+		readContent, ok := wanted[name]
+		return ok, readContent
+	})
+}
+
+func checkFile(assertion FileAssertion, f *export.File) error {
+	if !assertion.exists() {
+		if f != nil {
+			return fmt.Errorf("exists, but should not")
+		}
+		return nil
+	}
+	if f == nil {
+		return fmt.Errorf("does not exist")
+	}
+	isDir := f.Header.Typeflag == tar.TypeDir
+	if assertion.IsDir && !isDir {
+		return fmt.Errorf("is not a directory")
+	}
+	if assertion.Executable && (isDir || f.Header.FileInfo().Mode().Perm()&0111 == 0) {
+		return fmt.Errorf("is not executable (mode %s)", f.Header.FileInfo().Mode())
+	}
+	if assertion.Contains != "" {
+		if f.Header.Typeflag != tar.TypeReg {
+			return fmt.Errorf("is not a regular file")
+		}
+		if !bytes.Contains(f.Content, []byte(assertion.Contains)) {
+			return fmt.Errorf("does not contain %q", assertion.Contains)
+		}
+	}
+	return nil
+}
+
+// Report writes results to w, it returns an error if any
+// of the assertions failed
+func Report(w io.Writer, results []Result) error {
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			fmt.Fprintf(w, "  FAIL %s: %s: %s\n", result.Platform, result.Assertion, result.Err)
+			continue
+		}
+		fmt.Fprintf(w, "  PASS %s: %s\n", result.Platform, result.Assertion)
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d image assertion(s) failed", failed, len(results))
+	}
+	return nil
+}
+
+// Test runs the assertions against the artifact and writes
+// the results to w under the given name
+func Test(w io.Writer, name string, artifact *export.Artifact, spec *Spec) error {
+	results, err := Run(artifact, spec)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "image test results for %q:\n", name)
+	if err := Report(w, results); err != nil {
+		return fmt.Errorf("image %q: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package imagetest_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+
+	"github.com/errordeveloper/imagine/pkg/export"
+	. "github.com/errordeveloper/imagine/pkg/imagetest"
+	"github.com/errordeveloper/imagine/pkg/internal/testutil"
+)
+
+func newTestImage(t *testing.T) v1.Image {
+	return testutil.NewImage(t,
+		v1.Config{
+			Entrypoint:   []string{"/app/server"},
+			User:         "nobody",
+			Env:          []string{"PATH=/usr/bin:/bin", "APP_MODE=production"},
+			Labels:       map[string]string{"org.opencontainers.image.source": "https://github.com/errordeveloper/imagine"},
+			ExposedPorts: map[string]struct{}{"8080/tcp": {}},
+		},
+		mutate.Addendum{Layer: testutil.NewLayer(t,
+			testutil.File{Name: "app/", Mode: 0755, Typeflag: tar.TypeDir},
+			testutil.File{Name: "app/server", Mode: 0755, Typeflag: tar.TypeReg, Content: "#!/bin/sh\n"},
+			testutil.File{Name: "etc/app.conf", Typeflag: tar.TypeReg, Content: "listen = 8080\n"},
+			testutil.File{Name: "tmp/build.log", Typeflag: tar.TypeReg, Content: "ok\n"},
+		)},
+		mutate.Addendum{Layer: testutil.NewLayer(t,
+			testutil.File{Name: "tmp/.wh.build.log", Typeflag: tar.TypeReg},
+		)},
+	)
+}
+
+func loadSpec(t *testing.T, spec string) *Spec {
+	filename := filepath.Join(t.TempDir(), "image-test.json")
+	if err := ioutil.WriteFile(filename, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := LoadSpec(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func failures(results []Result) map[string]string {
+	failed := map[string]string{}
+	for _, result := range results {
+		if result.Err != nil {
+			failed[result.Assertion] = result.Err.Error()
+		}
+	}
+	return failed
+}
+
+func TestRun(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	artifact := &export.Artifact{Image: newTestImage(t)}
+
+	{
+		spec := loadSpec(t, `{
+			"files": [
+				{"path": "/app", "isDir": true},
+				{"path": "/app/server", "executable": true},
+				{"path": "/etc/app.conf", "contains": "listen = 8080"},
+				{"path": "/tmp/build.log", "exists": false}
+			],
+			"entrypoint": ["/app/server"],
+			"user": "nobody",
+			"env": {"APP_MODE": "production", "PATH": ""},
+			"labels": {"org.opencontainers.image.source": ""},
+			"exposedPorts": ["8080/tcp"],
+			"maxSize": 1048576
+		}`)
+
+		results, err := Run(artifact, spec)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(results).To(HaveLen(11))
+		g.Expect(failures(results)).To(BeEmpty())
+		g.Expect(results[0].Platform).To(Equal("linux-amd64"))
+
+		out := &bytes.Buffer{}
+		g.Expect(Report(out, results)).To(Succeed())
+		g.Expect(out.String()).To(ContainSubstring("  PASS linux-amd64: file /app/server\n"))
+	}
+
+	{
+		spec := loadSpec(t, `{
+			"files": [
+				{"path": "/app/missing"},
+				{"path": "/etc/app.conf", "executable": true},
+				{"path": "/app", "contains": "x"},
+				{"path": "/app/server", "exists": false}
+			],
+			"cmd": ["serve"],
+			"user": "root",
+			"workingDir": "/app",
+			"env": {"APP_MODE": "debug", "HOME": ""},
+			"exposedPorts": ["9090/tcp"],
+			"maxSize": 1
+		}`)
+
+		results, err := Run(artifact, spec)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(failures(results)).To(Equal(map[string]string{
+			"file /app/missing":    "does not exist",
+			"file /etc/app.conf":   "is not executable (mode -rw-r--r--)",
+			"file /app":            "is not a regular file",
+			"file /app/server":     "exists, but should not",
+			"cmd":                  `expected ["serve"], got []`,
+			"user":                 `expected "root", got "nobody"`,
+			"workingDir":           `expected "/app", got ""`,
+			"env APP_MODE":         `expected "debug", got "production"`,
+			"env HOME":             "not set",
+			"exposedPort 9090/tcp": "port is not exposed",
+			"maxSize":              failures(results)["maxSize"],
+		}))
+		g.Expect(failures(results)["maxSize"]).To(HavePrefix("size "))
+		g.Expect(failures(results)["maxSize"]).To(HaveSuffix(" exceeds 1 bytes"))
+
+		out := &bytes.Buffer{}
+		err = Report(out, results)
+		g.Expect(err).To(MatchError("11 of 11 image assertion(s) failed"))
+		g.Expect(strings.Count(out.String(), "  FAIL linux-amd64: ")).To(Equal(11))
+	}
+}
+
+func TestLoadSpec(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir := t.TempDir()
+
+	filename := filepath.Join(dir, "unknown.json")
+	g.Expect(ioutil.WriteFile(filename, []byte(`{"files": [], "entrypont": ["/app"]}`), 0644)).To(Succeed())
+	_, err := LoadSpec(filename)
+	g.Expect(err).To(MatchError(ContainSubstring(`unknown field "entrypont"`)))
+
+	filename = filepath.Join(dir, "nopath.json")
+	g.Expect(ioutil.WriteFile(filename, []byte(`{"files": [{"isDir": true}]}`), 0644)).To(Succeed())
+	_, err = LoadSpec(filename)
+	g.Expect(err).To(MatchError(ContainSubstring("file assertion without path")))
+}
@@ -0,0 +1,94 @@
+// Package testutil holds helpers that are shared by tests of
+// other packages, it is not used outside of tests
+package testutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// StartRegistry runs an in-memory registry for the duration
+// of the test and returns its host
+func StartRegistry(t *testing.T) string {
+	server := httptest.NewServer(ggcrregistry.New())
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Host
+}
+
+// File is an entry of a layer made by NewLayer, mode 0644
+// is used unless Mode is set
+type File struct {
+	Name     string
+	Mode     int64
+	Typeflag byte
+	Content  string
+}
+
+// NewLayer returns a layer with the given files in the given order
+func NewLayer(t *testing.T, files ...File) v1.Layer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, file := range files {
+		mode := file.Mode
+		if mode == 0 {
+			mode = 0644
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     file.Name,
+			Mode:     mode,
+			Size:     int64(len(file.Content)),
+			Typeflag: file.Typeflag,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(file.Content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layer
+}
+
+// NewImage returns a linux/amd64 image with the given config and layers
+func NewImage(t *testing.T, config v1.Config, layers ...mutate.Addendum) v1.Image {
+	img, err := mutate.Append(empty.Image, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile.OS, configFile.Architecture = "linux", "amd64"
+	configFile.Config = config
+	img, err = mutate.ConfigFile(img, configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
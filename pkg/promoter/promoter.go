@@ -0,0 +1,75 @@
+package promoter
+
+import (
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/errordeveloper/imagine/pkg/recipe"
+)
+
+// RegistryAPI is what Promoter needs from the registry, it's
+// implemented by registry.Registry and registry.FakeRegistry
+type RegistryAPI interface {
+	Digest(string) (string, error)
+	Copy(src, dst string) error
+}
+
+// Promoter copies an existing image to other registries or tags
+// without rebuilding it
+type Promoter struct {
+	RegistryAPI RegistryAPI
+
+	// Force allows promoting images with '-dev' or '-wip' suffix
+	Force bool
+}
+
+// Promote copies src to each of dsts by digest, so that all of the
+// destinations are guaranteed to point to the same image, even if
+// src gets updated while promotion is in progress; it returns the
+// digest of the promoted image
+func (p *Promoter) Promote(src string, dsts ...string) (string, error) {
+	if suffix := recipe.DevTagSuffix(src); suffix != "" && !p.Force {
+		return "", fmt.Errorf("refusing to promote %q due to %q suffix", src, suffix)
+	}
+
+	srcRef, err := name.ParseReference(src)
+	if err != nil {
+		return "", err
+	}
+
+	// all destinations are checked upfront, so that
+	// nothing gets copied when any of them is invalid
+	for _, dst := range dsts {
+		dstRef, err := name.ParseReference(dst)
+		if err != nil {
+			return "", fmt.Errorf("invalid destination %q: %w", dst, err)
+		}
+		if dstRef.Name() == srcRef.Name() {
+			return "", fmt.Errorf("destination %q is the same as source", dst)
+		}
+	}
+
+	digest, err := p.RegistryAPI.Digest(src)
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve %q: %w", src, err)
+	}
+
+	srcByDigest := srcRef.Context().Digest(digest).String()
+
+	for _, dst := range dsts {
+		if err := p.RegistryAPI.Copy(srcByDigest, dst); err != nil {
+			return "", fmt.Errorf("unable to copy %q to %q: %w", srcByDigest, dst, err)
+		}
+
+		dstDigest, err := p.RegistryAPI.Digest(dst)
+		if err != nil {
+			return "", fmt.Errorf("unable to verify %q: %w", dst, err)
+		}
+		if dstDigest != digest {
+			return "", fmt.Errorf("digest of %q is %q after copying, expected %q", dst, dstDigest, digest)
+		}
+	}
+
+	return digest, nil
+}
@@ -0,0 +1,96 @@
+package promoter_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/errordeveloper/imagine/pkg/registry"
+
+	. "github.com/errordeveloper/imagine/pkg/promoter"
+)
+
+const testDigest = "sha256:2f2e4e3a9c1b7ec1a0f14e1a87d5d9ad1f0a5c3bd5e1c8a16e44f8e0d4f3c2b1"
+
+func TestPromote(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	{
+		reg := &registry.FakeRegistry{
+			DigestValues: map[string]string{
+				"staging.example.com/imagine/image-1:16c315": testDigest,
+			},
+		}
+
+		p := &Promoter{RegistryAPI: reg}
+
+		digest, err := p.Promote("staging.example.com/imagine/image-1:16c315",
+			"release.example.com/imagine/image-1:16c315",
+			"release.example.com/imagine/image-1:v1.0.0",
+		)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(digest).To(Equal(testDigest))
+
+		g.Expect(reg.DigestValues).To(HaveKeyWithValue("release.example.com/imagine/image-1:16c315", testDigest))
+		g.Expect(reg.DigestValues).To(HaveKeyWithValue("release.example.com/imagine/image-1:v1.0.0", testDigest))
+	}
+
+	{
+		p := &Promoter{RegistryAPI: &registry.FakeRegistry{}}
+
+		_, err := p.Promote("staging.example.com/imagine/image-1:16c315",
+			"release.example.com/imagine/image-1:16c315",
+		)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(HavePrefix(`unable to resolve "staging.example.com/imagine/image-1:16c315"`))
+	}
+
+	{
+		reg := &registry.FakeRegistry{
+			DigestValues: map[string]string{
+				"staging.example.com/imagine/image-1:16c315-dev": testDigest,
+			},
+		}
+
+		p := &Promoter{RegistryAPI: reg}
+
+		_, err := p.Promote("staging.example.com/imagine/image-1:16c315-dev",
+			"release.example.com/imagine/image-1:v1.0.0",
+		)
+		g.Expect(err).To(MatchError(`refusing to promote "staging.example.com/imagine/image-1:16c315-dev" due to "-dev" suffix`))
+		g.Expect(reg.DigestValues).ToNot(HaveKey("release.example.com/imagine/image-1:v1.0.0"))
+
+		p.Force = true
+
+		digest, err := p.Promote("staging.example.com/imagine/image-1:16c315-dev",
+			"release.example.com/imagine/image-1:v1.0.0",
+		)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(digest).To(Equal(testDigest))
+		g.Expect(reg.DigestValues).To(HaveKeyWithValue("release.example.com/imagine/image-1:v1.0.0", testDigest))
+	}
+
+	{
+		reg := &registry.FakeRegistry{
+			DigestValues: map[string]string{
+				"staging.example.com/imagine/image-1:16c315": testDigest,
+			},
+		}
+		p := &Promoter{RegistryAPI: reg}
+
+		_, err := p.Promote("staging.example.com/imagine/image-1:16c315",
+			"release.example.com/imagine/image-1:16c315",
+			"staging.example.com/imagine/image-1:16c315",
+		)
+		g.Expect(err).To(MatchError(`destination "staging.example.com/imagine/image-1:16c315" is the same as source`))
+		g.Expect(reg.DigestValues).ToNot(HaveKey("release.example.com/imagine/image-1:16c315"))
+
+		_, err = p.Promote("staging.example.com/imagine/image-1:16c315",
+			"release.example.com/imagine/image-1:16c315",
+			"release.example.com/imagine/image-1:Invalid Tag",
+		)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(HavePrefix(`invalid destination "release.example.com/imagine/image-1:Invalid Tag"`))
+		g.Expect(reg.DigestValues).ToNot(HaveKey("release.example.com/imagine/image-1:16c315"))
+	}
+}
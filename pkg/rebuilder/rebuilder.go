@@ -2,30 +2,120 @@ package rebuilder
 
 import (
 	"fmt"
-	"strings"
+	"sync"
 
 	"github.com/errordeveloper/imagine/pkg/recipe"
 	"github.com/errordeveloper/imagine/pkg/registry"
 )
 
+// DefaultConcurrency is the number of registry lookups
+// made at the same time, unless set otherwise
+const DefaultConcurrency = 4
+
 type Rebuilder struct {
 	RegistryAPI registry.RegistryAPI
+
+	// Concurrency limits the number of registry lookups
+	// made at the same time
+	Concurrency int
+
+	// Signatures is used by UnsignedRefs to check which
+	// of the images are signed
+	Signatures SignatureChecker
+}
+
+// SignatureChecker checks if image has been signed
+type SignatureChecker interface {
+	IsSigned(string) (bool, error)
 }
 
 func (r *Rebuilder) ShouldRebuild(manifest *recipe.BakeManifest) (bool, string, error) {
-	for _, ref := range manifest.RegistryTags() {
-		for _, suffix := range []string{"-dev-wip", "-dev", "-wip"} {
-			if strings.HasSuffix(ref, suffix) {
-				return true, fmt.Sprintf("rebuilding due to %q suffix", suffix), nil
-			}
+	return r.shouldUpdate("rebuilding", manifest.RegistryTags())
+}
+
+// ShouldPush applies the same rules as ShouldRebuild to a set of refs that
+// a pre-built image would be pushed to
+func (r *Rebuilder) ShouldPush(refs ...string) (bool, string, error) {
+	return r.shouldUpdate("pushing", refs)
+}
+
+func (r *Rebuilder) shouldUpdate(action string, refs []string) (bool, string, error) {
+	for _, ref := range refs {
+		if suffix := recipe.DevTagSuffix(ref); suffix != "" {
+			return true, fmt.Sprintf("%s due to %q suffix", action, suffix), nil
 		}
+	}
+
+	errs := r.forEach(refs, func(_ int, ref string) error {
+		_, err := r.RegistryAPI.Digest(ref)
+		return err
+	})
 
-		if _, err := r.RegistryAPI.Digest(ref); err != nil {
-			// TODO: check the error is actually a 404, otherwise if it's to do with auth or network - fail early
-			return true, fmt.Sprintf("rebuilding as remote image %q is not present", ref), nil
-			break
+	// results are checked in the same order as refs are given,
+	// so that the outcome doesn't depend on timing
+	for i, ref := range refs {
+		if errs[i] == nil {
+			continue
 		}
+		if registry.IsNotFound(errs[i]) {
+			return true, fmt.Sprintf("%s as remote image %q is not present", action, ref), nil
+		}
+		return false, "", fmt.Errorf("unable to check remote image %q: %w", ref, errs[i])
 	}
 
 	return false, "", nil
 }
+
+// UnsignedRefs returns refs that point to images without signatures,
+// it is meant to be used once ShouldRebuild indicated that all of the
+// images are present
+func (r *Rebuilder) UnsignedRefs(refs ...string) ([]string, error) {
+	if r.Signatures == nil {
+		return nil, fmt.Errorf("signature checker is not set")
+	}
+
+	signed := make([]bool, len(refs))
+	errs := r.forEach(refs, func(i int, ref string) (err error) {
+		signed[i], err = r.Signatures.IsSigned(ref)
+		return err
+	})
+
+	unsigned := []string{}
+	for i, ref := range refs {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("unable to check signatures of %q: %w", ref, errs[i])
+		}
+		if !signed[i] {
+			unsigned = append(unsigned, ref)
+		}
+	}
+	return unsigned, nil
+}
+
+// forEach calls check for all refs concurrently and returns
+// an error for each of them
+func (r *Rebuilder) forEach(refs []string, check func(int, string) error) []error {
+	concurrency := r.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+
+	errs := make([]error, len(refs))
+	limit := make(chan struct{}, concurrency)
+	wg := &sync.WaitGroup{}
+
+	for i, ref := range refs {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(i int, ref string) {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+			errs[i] = check(i, ref)
+		}(i, ref)
+	}
+
+	wg.Wait()
+	return errs
+}
@@ -1,7 +1,10 @@
 package rebuilder_test
 
 import (
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	. "github.com/onsi/gomega"
 
@@ -12,6 +15,47 @@ import (
 	. "github.com/errordeveloper/imagine/pkg/rebuilder"
 )
 
+type unreachableRegistry struct{}
+
+func (*unreachableRegistry) Digest(ref string) (string, error) {
+	return "", fmt.Errorf("connection refused")
+}
+
+type slowRegistry struct {
+	registry.FakeRegistry
+
+	lock     sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (r *slowRegistry) Digest(ref string) (string, error) {
+	r.lock.Lock()
+	r.inFlight++
+	if r.inFlight > r.max {
+		r.max = r.inFlight
+	}
+	r.lock.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	r.lock.Lock()
+	r.inFlight--
+	r.lock.Unlock()
+
+	return r.FakeRegistry.Digest(ref)
+}
+
+type fakeSignatures map[string]bool
+
+func (f fakeSignatures) IsSigned(ref string) (bool, error) {
+	signed, ok := f[ref]
+	if !ok {
+		return false, fmt.Errorf("%s is not in fake registry: %w", ref, registry.ErrNotFound)
+	}
+	return signed, nil
+}
+
 func TestRebuilder(t *testing.T) {
 	g := NewGomegaWithT(t)
 
@@ -160,4 +204,110 @@ func TestRebuilder(t *testing.T) {
 		g.Expect(rebuild).To(BeFalse())
 		g.Expect(reason).To(BeEmpty())
 	}
+
+	{
+		rb := &Rebuilder{
+			RegistryAPI: &registry.FakeRegistry{
+				DigestValues: map[string]string{
+					"reg1.example.com/imagine/image-1:16c315": "sha256:test",
+				},
+			},
+		}
+
+		push, reason, err := rb.ShouldPush("reg1.example.com/imagine/image-1:16c315", "reg2.example.org/imagine/image-1:16c315")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(push).To(BeTrue())
+		g.Expect(reason).To(Equal(`pushing as remote image "reg2.example.org/imagine/image-1:16c315" is not present`))
+
+		push, reason, err = rb.ShouldPush("reg1.example.com/imagine/image-1:16c315")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(push).To(BeFalse())
+		g.Expect(reason).To(BeEmpty())
+
+		push, reason, err = rb.ShouldPush("reg1.example.com/imagine/image-1:16c315-dev")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(push).To(BeTrue())
+		g.Expect(reason).To(Equal(`pushing due to "-dev" suffix`))
+	}
+
+	{
+		rb := &Rebuilder{
+			RegistryAPI: &unreachableRegistry{},
+		}
+
+		_, _, err := rb.ShouldPush("reg1.example.com/imagine/image-1:16c315")
+		g.Expect(err).To(MatchError(`unable to check remote image "reg1.example.com/imagine/image-1:16c315": connection refused`))
+
+		push, reason, err := rb.ShouldPush("reg1.example.com/imagine/image-1:16c315-wip")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(push).To(BeTrue())
+		g.Expect(reason).To(Equal(`pushing due to "-wip" suffix`))
+	}
+
+	{
+		reg := &slowRegistry{
+			FakeRegistry: registry.FakeRegistry{
+				DigestValues: map[string]string{
+					"reg1.example.com/imagine/image-1:16c315": "sha256:test",
+					"reg2.example.com/imagine/image-1:16c315": "sha256:test",
+					"reg4.example.com/imagine/image-1:16c315": "sha256:test",
+					"reg5.example.com/imagine/image-1:16c315": "sha256:test",
+				},
+			},
+		}
+
+		rb := &Rebuilder{
+			RegistryAPI: reg,
+			Concurrency: 2,
+		}
+
+		push, reason, err := rb.ShouldPush(
+			"reg1.example.com/imagine/image-1:16c315",
+			"reg2.example.com/imagine/image-1:16c315",
+			"reg3.example.com/imagine/image-1:16c315",
+			"reg4.example.com/imagine/image-1:16c315",
+			"reg5.example.com/imagine/image-1:16c315",
+			"reg6.example.com/imagine/image-1:16c315",
+		)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(push).To(BeTrue())
+		g.Expect(reason).To(Equal(`pushing as remote image "reg3.example.com/imagine/image-1:16c315" is not present`))
+		g.Expect(reg.max).To(Equal(2))
+	}
+
+	{
+		rb := &Rebuilder{
+			RegistryAPI: &registry.FakeRegistry{},
+		}
+
+		_, err := rb.UnsignedRefs("reg1.example.com/imagine/image-1:16c315")
+		g.Expect(err).To(MatchError("signature checker is not set"))
+
+		rb.Signatures = fakeSignatures{
+			"reg1.example.com/imagine/image-1:16c315": true,
+			"reg2.example.com/imagine/image-1:16c315": false,
+			"reg3.example.com/imagine/image-1:16c315": true,
+			"reg4.example.com/imagine/image-1:16c315": false,
+		}
+
+		unsigned, err := rb.UnsignedRefs(
+			"reg1.example.com/imagine/image-1:16c315",
+			"reg2.example.com/imagine/image-1:16c315",
+			"reg3.example.com/imagine/image-1:16c315",
+			"reg4.example.com/imagine/image-1:16c315",
+		)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(unsigned).To(Equal([]string{
+			"reg2.example.com/imagine/image-1:16c315",
+			"reg4.example.com/imagine/image-1:16c315",
+		}))
+
+		unsigned, err = rb.UnsignedRefs("reg1.example.com/imagine/image-1:16c315")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(unsigned).To(BeEmpty())
+
+		_, err = rb.UnsignedRefs("reg5.example.com/imagine/image-1:16c315")
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(HavePrefix(`unable to check signatures of "reg5.example.com/imagine/image-1:16c315"`))
+	}
 }
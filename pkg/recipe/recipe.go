@@ -4,11 +4,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/Masterminds/semver"
 	"github.com/docker/buildx/bake"
 
+	"github.com/errordeveloper/imagine/pkg/export"
 	"github.com/errordeveloper/imagine/pkg/git"
 )
 
@@ -16,6 +24,113 @@ type ImageScope interface {
 	DockerfilePath() string
 	ContextPath() string
 	MakeTag() (string, error)
+	FindRevisions(tag string) ([]TagRevisions, error)
+	SourceInfo() (*SourceInfo, error)
+}
+
+// TagRevisions describes commits that make the same tag, which is either
+// a single commit, or a commit and its descendants up to the nearest
+// descendants that change the tag again, there can be more than one
+// of these on parallel branches (Until is empty when there are none)
+type TagRevisions struct {
+	From   string
+	Until  []string
+	Single bool
+}
+
+// SourceInfo describes where an image was built from, it is used
+// to populate image labels and annotations
+type SourceInfo struct {
+	// Revision is the full commit hash
+	Revision string
+	// Source is the URL of origin remote with any credentials removed
+	Source string
+	// Version is set only when semver tag is used as image tag
+	Version string
+	// Created is the time of the last commit that changed the scope,
+	// as opposed to build time, so that labels are the same when the
+	// image is rebuilt; it is also used as SOURCE_DATE_EPOCH
+	Created time.Time
+	// Scope is either 'root' or path of the image sub-directory
+	Scope string
+}
+
+const RootScope = "root"
+
+func newSourceInfo(g git.Git, rev, path, scope string) (*SourceInfo, error) {
+	// same commit as the one creation time is taken from, so that labels
+	// don't change for the same tree, when other paths are changed
+	revision, err := g.LastCommit(rev, path)
+	if err != nil {
+		return nil, err
+	}
+	originURL, err := g.OriginURL()
+	if err != nil {
+		return nil, err
+	}
+	created, err := g.CommitTime(rev, path)
+	if err != nil {
+		return nil, err
+	}
+	return &SourceInfo{
+		Revision: revision,
+		Source:   SourceURL(originURL),
+		Created:  created,
+		Scope:    scope,
+	}, nil
+}
+
+var scpLikeURL = regexp.MustCompile(`^(?:[^@/]+@)?([^:/]+):(.+)$`)
+
+// SourceURL converts git remote URL to a URL that can be published
+// in image metadata, i.e. credentials are removed and SSH URLs are
+// converted to HTTPS
+func SourceURL(remoteURL string) string {
+	if remoteURL == "" {
+		return ""
+	}
+	if !strings.Contains(remoteURL, "://") {
+		if m := scpLikeURL.FindStringSubmatch(remoteURL); m != nil {
+			remoteURL = "https://" + m[1] + "/" + strings.TrimPrefix(m[2], "/")
+		}
+	}
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return ""
+	}
+	switch u.Scheme {
+	case "ssh", "git", "git+ssh":
+		u.Scheme = "https"
+		u.Host = u.Hostname()
+	}
+	u.User = nil
+	u.Path = strings.TrimSuffix(u.Path, ".git")
+	return u.String()
+}
+
+func revisionOrHead(rev string) string {
+	if rev == "" {
+		return git.Head
+	}
+	return rev
+}
+
+// BaseRevision returns the commit where HEAD diverged from the base
+// branch, or the previous commit when HEAD is on the base branch, tags
+// made for it are the tags of the image published before the changes
+func BaseRevision(g git.Git, baseBranch string) (string, error) {
+	mergeBase, err := g.MergeBase(baseBranch)
+	if err != nil {
+		return "", err
+	}
+	head, err := g.CommitHash(git.Head, false)
+	if err != nil {
+		return "", err
+	}
+	if mergeBase == head {
+		return g.CommitHash(head+"^", false)
+	}
+	return mergeBase, nil
 }
 
 var (
@@ -27,6 +142,10 @@ type ImageScopeRootDir struct {
 	BaseDir                string
 	RelativeDockerfilePath string
 
+	// Revision is the commit to make the tag for, HEAD is used when it's
+	// empty, in which case uncommitted changes are also taken into account
+	Revision string
+
 	BaseBranch    string
 	WithoutSuffix bool
 	Git           git.Git
@@ -41,7 +160,9 @@ func (i *ImageScopeRootDir) ContextPath() string {
 }
 
 func (i *ImageScopeRootDir) MakeTag() (string, error) {
-	commitHash, err := i.Git.CommitHashForHead(true)
+	rev := revisionOrHead(i.Revision)
+
+	commitHash, err := i.Git.CommitHash(rev, true)
 	if err != nil {
 		return "", err
 	}
@@ -50,7 +171,7 @@ func (i *ImageScopeRootDir) MakeTag() (string, error) {
 		return commitHash, nil
 	}
 
-	isDev, err := i.Git.IsDev(i.BaseBranch)
+	isDev, err := i.Git.IsDev(rev, i.BaseBranch)
 	if err != nil {
 		return "", err
 	}
@@ -58,9 +179,11 @@ func (i *ImageScopeRootDir) MakeTag() (string, error) {
 		commitHash += "-dev"
 	}
 
-	isWIP, err := i.Git.IsWIP("")
-	if err != nil {
-		return "", err
+	isWIP := false
+	if i.Revision == "" {
+		if isWIP, err = i.Git.IsWIP(""); err != nil {
+			return "", err
+		}
 	}
 	if isWIP {
 		commitHash += "-wip"
@@ -68,7 +191,7 @@ func (i *ImageScopeRootDir) MakeTag() (string, error) {
 
 	// it doens't make sense to use a tag when tree is not clean, or
 	// it is a development branch
-	if semVerTag, _ := i.Git.SemVerTagForHead(false); semVerTag != nil {
+	if semVerTag, _ := i.Git.SemVerTag(rev, false); semVerTag != nil {
 		if !isDev && !isWIP {
 			return "v" + semVerTag.String(), nil
 		}
@@ -78,11 +201,48 @@ func (i *ImageScopeRootDir) MakeTag() (string, error) {
 	return commitHash, nil
 }
 
+// FindRevisions returns the commit the tag was made for, tag is
+// either a commit hash or a semver tag, and it must not have any
+// suffixes; no revisions are returned when it doesn't resolve
+func (i *ImageScopeRootDir) FindRevisions(tag string) ([]TagRevisions, error) {
+	candidates := []string{tag}
+	if version, err := semver.NewVersion(tag); err == nil && strings.HasPrefix(tag, "v") {
+		// semver tags may not have 'v' prefix in git
+		candidates = append(candidates, version.String())
+	}
+	for _, candidate := range candidates {
+		if commitHash, err := i.Git.CommitHash(candidate, false); err == nil {
+			return []TagRevisions{{From: commitHash, Single: true}}, nil
+		}
+	}
+	return []TagRevisions{}, nil
+}
+
+func (i *ImageScopeRootDir) SourceInfo() (*SourceInfo, error) {
+	rev := revisionOrHead(i.Revision)
+	sourceInfo, err := newSourceInfo(i.Git, rev, "", RootScope)
+	if err != nil {
+		return nil, err
+	}
+	tag, err := i.MakeTag()
+	if err != nil {
+		return nil, err
+	}
+	if semVerTag, _ := i.Git.SemVerTag(rev, false); semVerTag != nil && tag == "v"+semVerTag.String() {
+		sourceInfo.Version = semVerTag.String()
+	}
+	return sourceInfo, nil
+}
+
 type ImageScopeSubDir struct {
 	BaseDir              string
 	RelativeImageDirPath string
 	Dockerfile           string
 
+	// Revision is the commit to make the tag for, HEAD is used when it's
+	// empty, in which case uncommitted changes are also taken into account
+	Revision string
+
 	BaseBranch    string
 	WithoutSuffix bool
 	Git           git.Git
@@ -96,7 +256,9 @@ func (i *ImageScopeSubDir) ContextPath() string {
 }
 
 func (i *ImageScopeSubDir) MakeTag() (string, error) {
-	treeHash, err := i.Git.TreeHashForHead(i.RelativeImageDirPath)
+	rev := revisionOrHead(i.Revision)
+
+	treeHash, err := i.Git.TreeHash(rev, i.RelativeImageDirPath)
 	if err != nil {
 		return "", err
 	}
@@ -105,7 +267,7 @@ func (i *ImageScopeSubDir) MakeTag() (string, error) {
 		return treeHash, nil
 	}
 
-	isDev, err := i.Git.IsDev(i.BaseBranch)
+	isDev, err := i.Git.IsDev(rev, i.BaseBranch)
 	if err != nil {
 		return "", err
 	}
@@ -113,9 +275,11 @@ func (i *ImageScopeSubDir) MakeTag() (string, error) {
 		treeHash += "-dev"
 	}
 
-	isWIP, err := i.Git.IsWIP(i.RelativeImageDirPath)
-	if err != nil {
-		return "", err
+	isWIP := false
+	if i.Revision == "" {
+		if isWIP, err = i.Git.IsWIP(i.RelativeImageDirPath); err != nil {
+			return "", err
+		}
 	}
 	if isWIP {
 		treeHash += "-wip"
@@ -124,9 +288,88 @@ func (i *ImageScopeSubDir) MakeTag() (string, error) {
 	return treeHash, nil
 }
 
+// FindRevisions returns commits that changed the image directory to
+// have the tree hash given as tag, which must not have any suffixes
+func (i *ImageScopeSubDir) FindRevisions(tag string) ([]TagRevisions, error) {
+	revs, err := i.Git.PathRevisions(i.RelativeImageDirPath)
+	if err != nil {
+		return nil, err
+	}
+	commits := make([]string, 0, len(revs))
+	children := map[string][]string{}
+	for _, rev := range revs {
+		commits = append(commits, rev.Commit)
+		for _, parent := range rev.Parents {
+			children[parent] = append(children[parent], rev.Commit)
+		}
+	}
+	// directory doesn't exist in commits that removed it,
+	// so these don't have a tree hash
+	treeHashes, err := i.Git.TreeHashes(commits, i.RelativeImageDirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []TagRevisions{}
+	for _, rev := range revs {
+		if treeHashes[rev.Commit] != tag || anyHasTreeHash(treeHashes, tag, rev.Parents) {
+			// commits that keep the tag of one of the parents
+			// (e.g. merges) are part of the parent's revisions
+			continue
+		}
+		r := TagRevisions{From: rev.Commit}
+		visited := map[string]bool{}
+		next := children[rev.Commit]
+		for len(next) != 0 {
+			child := next[0]
+			next = next[1:]
+			if visited[child] {
+				continue
+			}
+			visited[child] = true
+			if treeHashes[child] == tag {
+				next = append(next, children[child]...)
+				continue
+			}
+			r.Until = append(r.Until, child)
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+func anyHasTreeHash(treeHashes map[string]string, treeHash string, revs []string) bool {
+	for _, rev := range revs {
+		if treeHashes[rev] == treeHash {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *ImageScopeSubDir) SourceInfo() (*SourceInfo, error) {
+	return newSourceInfo(i.Git, revisionOrHead(i.Revision), i.RelativeImageDirPath, i.RelativeImageDirPath)
+}
+
+// DevTagSuffixes are appended to tags of images built from development
+// branches or from trees with uncommitted changes
+var DevTagSuffixes = []string{"-dev-wip", "-dev", "-wip"}
+
+// DevTagSuffix returns the development suffix the given tag or ref has,
+// or an empty string if it has none
+func DevTagSuffix(ref string) string {
+	for _, suffix := range DevTagSuffixes {
+		if strings.HasSuffix(ref, suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
+
 const (
-	TestBakeTargetNameSuffix = "-test"
-	TestImageBuildTargetName = "test"
+	TestBakeTargetNameSuffix        = "-test"
+	TestImageBuildTargetName        = "test"
+	LocalExportBakeTargetNameSuffix = "-local"
 )
 
 type ImagineRecipe struct {
@@ -137,12 +380,258 @@ type ImagineRecipe struct {
 	Platforms []string
 	Args      map[string]string
 	HasTests  bool
-	Push      bool
-	Export    bool
+	// TestStages are build stages that are used for tests, each
+	// of them becomes a separate target, TestImageBuildTargetName
+	// is used when none are set
+	TestStages []string
+	// TestReports are paths inside test stages, such as JUnit or
+	// coverage files, that are copied to TestReportsDir once tests
+	// have run, DefaultTestReportsDir in BaseDir is used by default
+	TestReports    []string
+	TestReportsDir string
+	// TestStatus is a path inside test stages of a file with exit
+	// status of the tests, it lets test stages succeed when tests
+	// fail, so that reports of failing tests can be copied too
+	TestStatus string
+
+	Push bool
+	// PushFromArchive makes buildx write the image to a temporary
+	// OCI tarball instead of pushing it, so that the image can be
+	// checked before it gets pushed from PushArchive
+	PushFromArchive bool
+	Export          bool
+	ExportFormat    string
+	ExportDir       string
+	Cache           *CacheConfig
+
+	// InsecureRegistries are hosts that use plain HTTP or self-signed
+	// certificates, BuildKit needs to be told to push to them insecurely
+	InsecureRegistries []string
+
+	// WithoutLabels disables OCI labels that are otherwise set based
+	// on git metadata, Annotations sets the same key-value pairs as
+	// manifest annotations in addition to labels
+	WithoutLabels bool
+	Annotations   bool
+
+	// NormaliseTimestamps sets creation time in image config and history
+	// to the time of the last commit, which is also passed to the build
+	// as SOURCE_DATE_EPOCH argument; BuildKit cannot do this, so it is
+	// done once the build is complete
+	NormaliseTimestamps bool
 
 	CustomTagSuffix string
 }
 
+// SourceDateEpochArg is set to the time of the last commit, unless
+// it is set explicitly
+const SourceDateEpochArg = "SOURCE_DATE_EPOCH"
+
+func (r *ImagineRecipe) buildArgs(sourceInfo *SourceInfo) map[string]string {
+	if sourceInfo.Created.IsZero() {
+		return r.Args
+	}
+	if _, ok := r.Args[SourceDateEpochArg]; ok {
+		return r.Args
+	}
+	args := map[string]string{
+		SourceDateEpochArg: strconv.FormatInt(sourceInfo.Created.Unix(), 10),
+	}
+	for k, v := range r.Args {
+		args[k] = v
+	}
+	return args
+}
+
+const (
+	LabelPrefix = "org.opencontainers.image."
+
+	LabelRevision = LabelPrefix + "revision"
+	LabelSource   = LabelPrefix + "source"
+	LabelVersion  = LabelPrefix + "version"
+	LabelCreated  = LabelPrefix + "created"
+	LabelTitle    = LabelPrefix + "title"
+	LabelRefName  = LabelPrefix + "ref.name"
+
+	ImagineLabelPrefix = "com.github.errordeveloper.imagine."
+
+	LabelImagineTag   = ImagineLabelPrefix + "tag"
+	LabelImagineScope = ImagineLabelPrefix + "scope"
+)
+
+func (r *ImagineRecipe) sourceInfo() (*SourceInfo, error) {
+	sourceInfo, err := r.Scope.SourceInfo()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get source info: %w", err)
+	}
+	return sourceInfo, nil
+}
+
+// Labels returns labels describing the source of the image, empty
+// values are omitted
+func (r *ImagineRecipe) Labels() (map[string]string, error) {
+	sourceInfo, err := r.sourceInfo()
+	if err != nil {
+		return nil, err
+	}
+	return r.labels(sourceInfo)
+}
+
+// BuildArgs returns build args that are passed to the build,
+// including SOURCE_DATE_EPOCH that is based on source info
+func (r *ImagineRecipe) BuildArgs() (map[string]string, error) {
+	sourceInfo, err := r.sourceInfo()
+	if err != nil {
+		return nil, err
+	}
+	return r.buildArgs(sourceInfo), nil
+}
+
+func (r *ImagineRecipe) labels(sourceInfo *SourceInfo) (map[string]string, error) {
+	tag, err := r.imageTag()
+	if err != nil {
+		return nil, err
+	}
+
+	labels := map[string]string{
+		LabelRevision:     sourceInfo.Revision,
+		LabelSource:       sourceInfo.Source,
+		LabelVersion:      sourceInfo.Version,
+		LabelTitle:        r.Name,
+		LabelRefName:      tag,
+		LabelImagineTag:   tag,
+		LabelImagineScope: sourceInfo.Scope,
+	}
+	if !sourceInfo.Created.IsZero() {
+		labels[LabelCreated] = sourceInfo.Created.UTC().Format(time.RFC3339)
+	}
+	for k, v := range labels {
+		if v == "" {
+			delete(labels, k)
+		}
+	}
+	return labels, nil
+}
+
+const (
+	CacheModeNone     = "none"
+	CacheModeRegistry = "registry"
+	CacheModeInline   = "inline"
+	CacheModeLocal    = "local"
+
+	CacheExportModeMin = "min"
+	CacheExportModeMax = "max"
+
+	CacheTag = "buildcache"
+)
+
+// CacheConfig defines how build cache is imported and exported,
+// with registry and inline modes the cache is stored in the first
+// registry as '<registry>/<name>:buildcache' (or with a branch suffix
+// when per-branch cache is used, with fallback to base branch cache)
+type CacheConfig struct {
+	Mode       string
+	ExportMode string
+	LocalDir   string
+
+	PerBranch  bool
+	Branch     string
+	BaseBranch string
+}
+
+var invalidTagChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+func (c *CacheConfig) branchTagSuffix() string {
+	if !c.PerBranch || c.Branch == "" || c.Branch == c.baseBranchName() {
+		return ""
+	}
+	suffix := "-" + strings.Trim(invalidTagChars.ReplaceAllString(c.Branch, "-"), "-.")
+	// tags cannot be longer then 128 characters
+	if maxLen := 128 - len(CacheTag); len(suffix) > maxLen {
+		suffix = suffix[:maxLen]
+	}
+	return suffix
+}
+
+// baseBranchName strips remote name, e.g. 'origin/master' becomes 'master'
+func (c *CacheConfig) baseBranchName() string {
+	if parts := strings.SplitN(c.BaseBranch, "/", 2); len(parts) == 2 {
+		return parts[1]
+	}
+	return c.BaseBranch
+}
+
+func (c *CacheConfig) exportMode() string {
+	if c.ExportMode == "" {
+		return CacheExportModeMin
+	}
+	return c.ExportMode
+}
+
+func (r *ImagineRecipe) cacheRefs(registries ...string) (string, string) {
+	if len(registries) == 0 {
+		return "", ""
+	}
+	baseRef := fmt.Sprintf("%s/%s:%s", registries[0], r.Name, CacheTag)
+	return baseRef, baseRef + r.Cache.branchTagSuffix()
+}
+
+// cacheOptions returns values for cache-from and cache-to, as well as
+// any additional image tags (used for inline cache)
+func (r *ImagineRecipe) cacheOptions(registries ...string) ([]string, []string, []string, error) {
+	if r.Cache == nil {
+		return nil, nil, nil, nil
+	}
+
+	switch r.Cache.exportMode() {
+	case CacheExportModeMin, CacheExportModeMax:
+	default:
+		return nil, nil, nil, fmt.Errorf("unsupported cache export mode %q", r.Cache.ExportMode)
+	}
+
+	cacheFrom := func(baseRef, branchRef string) []string {
+		cacheFrom := []string{"type=registry,ref=" + branchRef}
+		if branchRef != baseRef {
+			cacheFrom = append(cacheFrom, "type=registry,ref="+baseRef)
+		}
+		return cacheFrom
+	}
+
+	switch r.Cache.Mode {
+	case "", CacheModeNone:
+		return nil, nil, nil, nil
+	case CacheModeRegistry:
+		baseRef, branchRef := r.cacheRefs(registries...)
+		if baseRef == "" {
+			return nil, nil, nil, nil
+		}
+		cacheTo := []string{}
+		if r.Push {
+			cacheTo = append(cacheTo, fmt.Sprintf("type=registry,ref=%s,mode=%s", branchRef, r.Cache.exportMode()))
+		}
+		return cacheFrom(baseRef, branchRef), cacheTo, nil, nil
+	case CacheModeInline:
+		baseRef, branchRef := r.cacheRefs(registries...)
+		if baseRef == "" {
+			return nil, nil, nil, nil
+		}
+		if !r.Push {
+			return cacheFrom(baseRef, branchRef), nil, nil, nil
+		}
+		return cacheFrom(baseRef, branchRef), []string{"type=inline"}, []string{branchRef}, nil
+	case CacheModeLocal:
+		if r.Cache.LocalDir == "" {
+			return nil, nil, nil, fmt.Errorf("local cache directory must be set")
+		}
+		dir := filepath.Join(r.Cache.LocalDir, r.Name)
+		return []string{"type=local,src=" + dir},
+			[]string{fmt.Sprintf("type=local,dest=%s,mode=%s", dir, r.Cache.exportMode())},
+			nil, nil
+	default:
+		return nil, nil, nil, fmt.Errorf("unsupported cache mode %q", r.Cache.Mode)
+	}
+}
+
 type RepoManifest struct {
 	Images []ImageManifest `json:"images"`
 }
@@ -194,32 +683,152 @@ type BakeManifest struct {
 	Group  bakeGroupMap  `json:"group"`
 	Target bakeTargetMap `json:"target"`
 
-	mainTargetName string
+	mainTargetName      string
+	testTargets         []string
+	testReportExports   []TestReportExport
+	imageTargets        []string
+	registryTags        []string
+	annotations         map[string]string
+	normaliseTimestamps time.Time
+	postBuildExports    []PostBuildExport
+	pushArchive         string
+}
+
+// PostBuildExport is an export that buildx cannot do natively, it
+// is done once the build is complete by either pulling the pushed image
+// from Ref or reading temporary OCI tarball written by buildx from
+// Archive, and writing OCI image layout to Dest with RefNames as
+// 'org.opencontainers.image.ref.name' annotations, any Annotations
+// are added to the same descriptors; unless NormaliseTimestamps is
+// zero, it is set as creation time in image configs before writing
+type PostBuildExport struct {
+	Ref     string
+	Archive string
+
+	Dest                string
+	Format              string
+	RefNames            []string
+	Annotations         map[string]string
+	NormaliseTimestamps time.Time
+}
+
+// TestReportExport describes test reports to copy from the filesystem of
+// a test stage that buildx exported to Source, Paths are relative to
+// Source and are copied to the same relative paths in Dest; StatusPaths
+// are relative to Source as well, these are files with exit status of
+// the tests, one for each platform
+type TestReportExport struct {
+	Target      string
+	Source      string
+	Dest        string
+	Paths       []string
+	StatusPaths []string
+}
+
+// DefaultTestReportsDir is used unless TestReportsDir is set
+const DefaultTestReportsDir = "test-reports"
+
+func (r *ImagineRecipe) testReportExport(testStage, testTargetName string) TestReportExport {
+	dest := r.TestReportsDir
+	if dest == "" {
+		dest = filepath.Join(r.BaseDir, DefaultTestReportsDir)
+	}
+
+	// local exporter writes a directory for each platform
+	// when there is more than one
+	prefixes := []string{""}
+	if len(r.Platforms) > 1 {
+		prefixes = []string{}
+		for _, platform := range r.Platforms {
+			prefixes = append(prefixes, strings.ReplaceAll(platform, "/", "_"))
+		}
+	}
+	paths := []string{}
+	statusPaths := []string{}
+	for _, prefix := range prefixes {
+		for _, testReport := range r.TestReports {
+			paths = append(paths, strings.TrimPrefix(path.Join(prefix, path.Clean("/"+testReport)), "/"))
+		}
+		if r.TestStatus != "" {
+			statusPaths = append(statusPaths, strings.TrimPrefix(path.Join(prefix, path.Clean("/"+r.TestStatus)), "/"))
+		}
+	}
+
+	return TestReportExport{
+		Target:      testTargetName,
+		Source:      filepath.Join(r.BaseDir, fmt.Sprintf(".%s.tmp", testTargetName)),
+		Dest:        filepath.Join(dest, testStage),
+		Paths:       paths,
+		StatusPaths: statusPaths,
+	}
 }
 
-func (r *ImagineRecipe) newBakeTarget() *bake.Target {
+func (r *ImagineRecipe) newBakeTarget(args map[string]string) *bake.Target {
 	target := &bake.Target{
 		Context:    new(string),
 		Dockerfile: new(string),
 		Platforms:  r.Platforms,
-		Args:       r.Args,
+		Args:       args,
 	}
 	*target.Context = r.Scope.ContextPath()
 	*target.Dockerfile = r.Scope.DockerfilePath()
 	return target
 }
 
-func (r *ImagineRecipe) RegistryTags(registries ...string) ([]string, error) {
-	registryTags := []string{}
+// ArchivePath returns path of the OCI image layout (tarball or
+// directory) that is written when export is enabled
+func (r *ImagineRecipe) ArchivePath() string {
+	return filepath.Join(r.BaseDir, fmt.Sprintf("image-%s.oci", r.Name))
+}
+
+func (r *ImagineRecipe) tempArchivePath() string {
+	return filepath.Join(r.BaseDir, fmt.Sprintf(".image-%s.oci.tmp", r.Name))
+}
+
+// ReproducibilityCheckArchivePath returns path of the temporary OCI
+// tarball written by n-th build made for reproducibility check
+func (r *ImagineRecipe) ReproducibilityCheckArchivePath(n int) string {
+	return filepath.Join(r.BaseDir, fmt.Sprintf(".image-%s-%d.oci.tmp", r.Name, n))
+}
+
+func (r *ImagineRecipe) exportFormat() string {
+	if r.ExportFormat == "" {
+		return export.FormatOCITar
+	}
+	return r.ExportFormat
+}
 
+func (r *ImagineRecipe) imageTag() (string, error) {
 	tag, err := r.Scope.MakeTag()
 	if err != nil {
-		return nil, fmt.Errorf("unable make image tag: %w", err)
+		return "", fmt.Errorf("unable make image tag: %w", err)
 	}
 
 	if r.CustomTagSuffix != "" {
 		tag += "-" + r.CustomTagSuffix
 	}
+	return tag, nil
+}
+
+func (r *ImagineRecipe) hasInsecureRegistry(registries ...string) bool {
+	for _, registry := range registries {
+		host := strings.SplitN(registry, "/", 2)[0]
+		for _, insecureHost := range r.InsecureRegistries {
+			if host == insecureHost {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *ImagineRecipe) RegistryTags(registries ...string) ([]string, error) {
+	registryTags := []string{}
+
+	tag, err := r.imageTag()
+	if err != nil {
+		return nil, err
+	}
 
 	for _, registry := range registries {
 		registryTag := fmt.Sprintf("%s/%s:%s", registry, r.Name, tag)
@@ -229,49 +838,190 @@ func (r *ImagineRecipe) RegistryTags(registries ...string) ([]string, error) {
 	return registryTags, nil
 }
 
+// ParseRegistryTag is the reverse of RegistryTags, it returns the tag
+// without custom and development suffixes, along with the latter; ref
+// can also be just a tag
+func (r *ImagineRecipe) ParseRegistryTag(ref string) (tag, devSuffix string, err error) {
+	if strings.Contains(ref, "@") {
+		return "", "", fmt.Errorf("digest reference %q is not supported", ref)
+	}
+	repo, tag := "", ref
+	if i := strings.LastIndex(ref, ":"); i != -1 && !strings.Contains(ref[i:], "/") {
+		repo, tag = ref[:i], ref[i+1:]
+	}
+	if strings.Contains(tag, "/") || tag == "" {
+		return "", "", fmt.Errorf("%q has no tag", ref)
+	}
+	if repo != "" && path.Base(repo) != r.Name {
+		return "", "", fmt.Errorf("%q is not a tag of %q image", ref, r.Name)
+	}
+
+	if r.CustomTagSuffix != "" {
+		if !strings.HasSuffix(tag, "-"+r.CustomTagSuffix) {
+			return "", "", fmt.Errorf("tag %q doesn't have %q suffix", tag, r.CustomTagSuffix)
+		}
+		tag = strings.TrimSuffix(tag, "-"+r.CustomTagSuffix)
+	}
+	devSuffix = DevTagSuffix(tag)
+	return strings.TrimSuffix(tag, devSuffix), devSuffix, nil
+}
+
 func (r *ImagineRecipe) ToBakeManifest(registries ...string) (*BakeManifest, error) {
 	group := &bake.Group{
 		Targets: []string{r.Name},
 	}
 
-	mainTarget := r.newBakeTarget()
+	registryTags, err := r.RegistryTags(registries...)
+	if err != nil {
+		return nil, err
+	}
+
+	sourceInfo, err := r.sourceInfo()
+	if err != nil {
+		return nil, err
+	}
+	args := r.buildArgs(sourceInfo)
+
+	mainTarget := r.newBakeTarget(args)
 
 	targets := bakeTargetMap{
 		r.Name: mainTarget,
 	}
 
-	registryTags, err := r.RegistryTags(registries...)
+	mainTarget.Tags = registryTags
+
+	var annotations map[string]string
+	if !r.WithoutLabels || r.Annotations {
+		labels, err := r.labels(sourceInfo)
+		if err != nil {
+			return nil, err
+		}
+		if !r.WithoutLabels {
+			mainTarget.Labels = labels
+		}
+		if r.Annotations {
+			annotations = labels
+		}
+	}
+
+	cacheFrom, cacheTo, cacheTags, err := r.cacheOptions(registries...)
 	if err != nil {
 		return nil, err
 	}
-
-	mainTarget.Tags = registryTags
+	mainTarget.CacheFrom = cacheFrom
+	mainTarget.CacheTo = cacheTo
+	if len(cacheTags) != 0 {
+		mainTarget.Tags = append(append([]string{}, registryTags...), cacheTags...)
+	}
 
 	push := (r.Push && len(registries) != 0)
 
 	// this is a slice, but buildx doesn't support multiple outputs
-	// at present (https://github.com/docker/buildx/issues/316)
+	// at present (https://github.com/docker/buildx/issues/316),
+	// so any additional outputs are either done after the build
+	// or with additional targets
 	mainTarget.Outputs = []string{
 		fmt.Sprintf("type=image,push=%v", push),
 	}
+	if push && r.hasInsecureRegistry(registries...) {
+		mainTarget.Outputs[0] += ",registry.insecure=true"
+	}
+	if push && r.Annotations {
+		// Docker media types that BuildKit uses by default have
+		// no annotations, so these have to be OCI manifests
+		mainTarget.Outputs[0] += ",oci-mediatypes=true"
+	}
 
-	if r.Export {
+	var pushArchive string
+	if push && r.PushFromArchive {
+		pushArchive = r.tempArchivePath()
 		mainTarget.Outputs = []string{
-			fmt.Sprintf("type=docker,dest=%s",
-				filepath.Join(r.BaseDir, fmt.Sprintf("image-%s.oci", r.Name))),
+			fmt.Sprintf("type=oci,dest=%s", pushArchive),
+		}
+	}
+
+	var normaliseTimestamps time.Time
+	if r.NormaliseTimestamps {
+		normaliseTimestamps = sourceInfo.Created
+	}
+
+	postBuildExports := []PostBuildExport{}
+
+	if r.Export {
+		postBuildExport := PostBuildExport{
+			Dest:                r.ArchivePath(),
+			Format:              r.exportFormat(),
+			RefNames:            registryTags,
+			Annotations:         annotations,
+			NormaliseTimestamps: normaliseTimestamps,
+		}
+		if len(registryTags) == 0 {
+			tag, err := r.imageTag()
+			if err != nil {
+				return nil, err
+			}
+			postBuildExport.RefNames = []string{r.Name + ":" + tag}
+		}
+		if push {
+			postBuildExport.Ref = registryTags[0]
+		} else {
+			postBuildExport.Archive = r.tempArchivePath()
+			mainTarget.Outputs = []string{
+				fmt.Sprintf("type=oci,dest=%s", postBuildExport.Archive),
+			}
 		}
+		postBuildExports = append(postBuildExports, postBuildExport)
 	}
 
+	if r.ExportDir != "" {
+		localTarget := r.newBakeTarget(args)
+		localTarget.CacheFrom = cacheFrom
+		localTarget.Outputs = []string{
+			fmt.Sprintf("type=local,dest=%s", r.ExportDir),
+		}
+		targets[r.Name+LocalExportBakeTargetNameSuffix] = localTarget
+	}
+
+	imageTargets := []string{r.Name}
+	testTargets := []string{}
+	testReportExports := []TestReportExport{}
 	if r.HasTests {
-		testTarget := r.newBakeTarget()
-		testTarget.Target = new(string)
-		*testTarget.Target = TestImageBuildTargetName
-		targets[r.Name+TestBakeTargetNameSuffix] = testTarget
-		group.Targets = []string{r.Name + TestBakeTargetNameSuffix, r.Name}
+		for _, testStage := range r.testStages() {
+			testTargetName := r.testBakeTargetName(testStage)
+			if _, ok := targets[testTargetName]; ok {
+				return nil, fmt.Errorf("test stage %q conflicts with target %q", testStage, testTargetName)
+			}
+			testTarget := r.newBakeTarget(args)
+			testTarget.Target = new(string)
+			*testTarget.Target = testStage
+			testTarget.CacheFrom = cacheFrom
+			if len(r.TestReports) != 0 || r.TestStatus != "" {
+				testReportExport := r.testReportExport(testStage, testTargetName)
+				testTarget.Outputs = []string{
+					fmt.Sprintf("type=local,dest=%s", testReportExport.Source),
+				}
+				testReportExports = append(testReportExports, testReportExport)
+			}
+			targets[testTargetName] = testTarget
+			testTargets = append(testTargets, testTargetName)
+		}
+		group.Targets = append(append([]string{}, testTargets...), r.Name)
+	}
+	if r.ExportDir != "" {
+		group.Targets = append(group.Targets, r.Name+LocalExportBakeTargetNameSuffix)
+		imageTargets = append(imageTargets, r.Name+LocalExportBakeTargetNameSuffix)
 	}
 
 	return &BakeManifest{
-		mainTargetName: r.Name,
+		mainTargetName:      r.Name,
+		testTargets:         testTargets,
+		testReportExports:   testReportExports,
+		imageTargets:        imageTargets,
+		registryTags:        registryTags,
+		annotations:         annotations,
+		normaliseTimestamps: normaliseTimestamps,
+		postBuildExports:    postBuildExports,
+		pushArchive:         pushArchive,
 		Group: bakeGroupMap{
 			"default": group,
 		},
@@ -280,7 +1030,105 @@ func (r *ImagineRecipe) ToBakeManifest(registries ...string) (*BakeManifest, err
 }
 
 func (m *BakeManifest) RegistryTags() []string {
-	return m.Target[m.mainTargetName].Tags
+	return m.registryTags
+}
+
+// TestTargets returns names of test targets in the order test
+// stages were given, these are meant to be built one by one
+// before the image targets
+func (m *BakeManifest) TestTargets() []string {
+	return m.testTargets
+}
+
+// TestReportExports returns test reports to copy once tests have run
+func (m *BakeManifest) TestReportExports() []TestReportExport {
+	return m.testReportExports
+}
+
+// ImageTargets returns names of the main target and any other targets
+// that produce the image, these should only be built once tests pass
+func (m *BakeManifest) ImageTargets() []string {
+	return m.imageTargets
+}
+
+func (r *ImagineRecipe) testStages() []string {
+	if len(r.TestStages) == 0 {
+		return []string{TestImageBuildTargetName}
+	}
+	return r.TestStages
+}
+
+// testBakeTargetName returns name of the target for the given test
+// stage, the default test stage gets TestBakeTargetNameSuffix
+func (r *ImagineRecipe) testBakeTargetName(testStage string) string {
+	if testStage == TestImageBuildTargetName {
+		return r.Name + TestBakeTargetNameSuffix
+	}
+	return r.Name + "-" + testStage
+}
+
+// ToReproducibilityCheckBakeManifest returns a manifest for building
+// the main target without cache and writing it to an OCI tarball, so
+// that digests of two such builds can be compared
+func (r *ImagineRecipe) ToReproducibilityCheckBakeManifest(dest string) (*BakeManifest, error) {
+	sourceInfo, err := r.sourceInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	target := r.newBakeTarget(r.buildArgs(sourceInfo))
+	if !r.WithoutLabels {
+		if target.Labels, err = r.labels(sourceInfo); err != nil {
+			return nil, err
+		}
+	}
+	target.NoCache = new(bool)
+	*target.NoCache = true
+	target.Outputs = []string{
+		fmt.Sprintf("type=oci,dest=%s", dest),
+	}
+
+	var normaliseTimestamps time.Time
+	if r.NormaliseTimestamps {
+		normaliseTimestamps = sourceInfo.Created
+	}
+
+	return &BakeManifest{
+		mainTargetName:      r.Name,
+		normaliseTimestamps: normaliseTimestamps,
+		Group: bakeGroupMap{
+			"default": &bake.Group{Targets: []string{r.Name}},
+		},
+		Target: bakeTargetMap{
+			r.Name: target,
+		},
+	}, nil
+}
+
+// NormaliseTimestamps returns the time that should be set as creation
+// time in configs of the images once the build is complete, it returns
+// zero time when timestamps should be left as they are
+func (m *BakeManifest) NormaliseTimestamps() time.Time {
+	return m.normaliseTimestamps
+}
+
+// Annotations returns annotations that should be added to manifests
+// of pushed images, these cannot be set by buildx and have to be
+// added once the build is complete
+func (m *BakeManifest) Annotations() map[string]string {
+	return m.annotations
+}
+
+func (m *BakeManifest) PostBuildExports() []PostBuildExport {
+	return m.postBuildExports
+}
+
+// PushArchive returns path of the OCI tarball that buildx writes
+// instead of pushing the image, the image should be pushed from it
+// to all of the registry tags once the build is complete; it
+// returns an empty string when buildx pushes the image itself
+func (m *BakeManifest) PushArchive() string {
+	return m.pushArchive
 }
 
 func (m *BakeManifest) ToJSON() (string, error) {
@@ -0,0 +1,110 @@
+package registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// buildKitSettings returns settings that go into 'registry' section
+// of BuildKit daemon config for the given host
+func (h *HostConfig) buildKitSettings() (map[string]interface{}, error) {
+	settings := map[string]interface{}{}
+	if h.PlainHTTP {
+		settings["http"] = true
+	}
+	if h.Insecure {
+		settings["insecure"] = true
+	}
+	if h.CACert != "" {
+		caCert, err := filepath.Abs(h.CACert)
+		if err != nil {
+			return nil, err
+		}
+		settings["ca"] = []interface{}{caCert}
+	}
+	if len(h.Mirrors) != 0 {
+		mirrors := make([]interface{}, 0, len(h.Mirrors))
+		for _, mirror := range h.Mirrors {
+			mirrors = append(mirrors, mirror)
+		}
+		settings["mirrors"] = mirrors
+	}
+	return settings, nil
+}
+
+// WriteBuildKitConfig writes BuildKit daemon config (buildkitd.toml) with
+// settings for each of the configured registries, merged with the given
+// base config (if any) to a temporary file; if there are no settings that
+// BuildKit needs to know about, base config is returned as is
+func (c *Config) WriteBuildKitConfig(baseConfigFile string) (string, func(), error) {
+	cleanup := func() {}
+
+	registries := map[string]map[string]interface{}{}
+	if c != nil {
+		for host, hostConfig := range c.Registries {
+			if hostConfig == nil {
+				continue
+			}
+			settings, err := hostConfig.buildKitSettings()
+			if err != nil {
+				return "", cleanup, err
+			}
+			if len(settings) == 0 {
+				continue
+			}
+			// BuildKit only recognises the canonical name of Docker Hub
+			if authKey(host) == authKey(name.DefaultRegistry) {
+				host = "docker.io"
+			}
+			registries[host] = settings
+		}
+	}
+	if len(registries) == 0 {
+		return baseConfigFile, cleanup, nil
+	}
+
+	buildKitConfig := map[string]interface{}{}
+	if baseConfigFile != "" {
+		if _, err := toml.DecodeFile(baseConfigFile, &buildKitConfig); err != nil {
+			return "", cleanup, fmt.Errorf("unable to parse BuildKit config %q: %w", baseConfigFile, err)
+		}
+	}
+
+	registrySection, ok := buildKitConfig["registry"].(map[string]interface{})
+	if !ok {
+		registrySection = map[string]interface{}{}
+		buildKitConfig["registry"] = registrySection
+	}
+	for host, settings := range registries {
+		hostSection, ok := registrySection[host].(map[string]interface{})
+		if !ok {
+			hostSection = map[string]interface{}{}
+			registrySection[host] = hostSection
+		}
+		for k, v := range settings {
+			if values, ok := v.([]interface{}); ok {
+				if existing, ok := hostSection[k].([]interface{}); ok {
+					v = append(existing, values...)
+				}
+			}
+			hostSection[k] = v
+		}
+	}
+
+	f, err := ioutil.TempFile("", "imagine-buildkitd-*.toml")
+	if err != nil {
+		return "", cleanup, err
+	}
+	cleanup = func() { os.Remove(f.Name()) }
+	defer f.Close()
+
+	if err := toml.NewEncoder(f).Encode(buildKitConfig); err != nil {
+		return "", cleanup, err
+	}
+	return f.Name(), cleanup, nil
+}
@@ -0,0 +1,86 @@
+package registry_test
+
+import (
+	"io/ioutil"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/BurntSushi/toml"
+
+	. "github.com/errordeveloper/imagine/pkg/registry"
+)
+
+func TestWriteBuildKitConfig(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir := t.TempDir()
+
+	{
+		c := &Config{
+			Registries: map[string]*HostConfig{
+				"reg1.example.com": {Auth: &AuthConfig{TokenEnv: "FOO"}},
+			},
+		}
+
+		configFile, cleanup, err := c.WriteBuildKitConfig("")
+		g.Expect(err).ToNot(HaveOccurred())
+		cleanup()
+		g.Expect(configFile).To(BeEmpty())
+
+		configFile, cleanup, err = (*Config)(nil).WriteBuildKitConfig("/etc/buildkitd.toml")
+		g.Expect(err).ToNot(HaveOccurred())
+		cleanup()
+		g.Expect(configFile).To(Equal("/etc/buildkitd.toml"))
+	}
+
+	{
+		baseConfigFile := writeFile(t, dir, "buildkitd.toml", `
+debug = true
+
+[registry."reg1.example.com"]
+  ca = ["/etc/ssl/reg1.pem"]
+
+[registry."reg3.example.com"]
+  mirrors = ["mirror.example.com"]
+`)
+
+		c := &Config{
+			Registries: map[string]*HostConfig{
+				"reg1.example.com":       {CACert: "/etc/ssl/reg1-extra.pem"},
+				"registry.internal:5000": {PlainHTTP: true, Insecure: true},
+				"index.docker.io":        {Mirrors: []string{"registry.internal:5000", "mirror.gcr.io"}},
+			},
+		}
+
+		configFile, cleanup, err := c.WriteBuildKitConfig(baseConfigFile)
+		g.Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+		g.Expect(configFile).ToNot(Equal(baseConfigFile))
+
+		data, err := ioutil.ReadFile(configFile)
+		g.Expect(err).ToNot(HaveOccurred())
+
+		type registryConfig struct {
+			Mirrors   []string `toml:"mirrors"`
+			PlainHTTP *bool    `toml:"http"`
+			Insecure  *bool    `toml:"insecure"`
+			RootCAs   []string `toml:"ca"`
+		}
+		written := struct {
+			Debug      bool                      `toml:"debug"`
+			Registries map[string]registryConfig `toml:"registry"`
+		}{}
+		_, err = toml.Decode(string(data), &written)
+		g.Expect(err).ToNot(HaveOccurred())
+
+		yes := true
+		g.Expect(written.Debug).To(BeTrue())
+		g.Expect(written.Registries).To(Equal(map[string]registryConfig{
+			"reg1.example.com":       {RootCAs: []string{"/etc/ssl/reg1.pem", "/etc/ssl/reg1-extra.pem"}},
+			"reg3.example.com":       {Mirrors: []string{"mirror.example.com"}},
+			"registry.internal:5000": {PlainHTTP: &yes, Insecure: &yes},
+			"docker.io":              {Mirrors: []string{"registry.internal:5000", "mirror.gcr.io"}},
+		}))
+	}
+}
@@ -0,0 +1,427 @@
+package registry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/docker/cli/cli/config/types"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// Config holds per-registry settings, it is loaded from a JSON file, e.g.
+//
+//	{
+//	  "dockerConfig": "/path/to/docker/config/dir",
+//	  "registries": {
+//	    "ghcr.io": {
+//	      "auth": {"username": "bot", "passwordEnv": "GHCR_TOKEN"}
+//	    },
+//	    "123456789012.dkr.ecr.us-east-1.amazonaws.com": {
+//	      "auth": {"credHelper": "ecr-login"}
+//	    },
+//	    "registry.internal:5000": {
+//	      "plainHTTP": true
+//	    },
+//	    "docker.io": {
+//	      "mirrors": ["registry.internal:5000"]
+//	    }
+//	  }
+//	}
+//
+// Registries that are not listed use credentials from docker config
+type Config struct {
+	// DockerConfig is a directory with docker 'config.json' to use
+	// instead of the default one
+	DockerConfig string                 `json:"dockerConfig,omitempty"`
+	Registries   map[string]*HostConfig `json:"registries,omitempty"`
+
+	mergedOnce sync.Once
+	merged     *configfile.ConfigFile
+	mergedErr  error
+
+	transportsLock sync.Mutex
+	transports     map[string]http.RoundTripper
+}
+
+// HostConfig holds settings for a single registry host
+type HostConfig struct {
+	Auth *AuthConfig `json:"auth,omitempty"`
+
+	// PlainHTTP allows using HTTP instead of HTTPS
+	PlainHTTP bool `json:"plainHTTP,omitempty"`
+	// Insecure disables TLS certificate verification
+	Insecure bool `json:"insecure,omitempty"`
+	// CACert is a path to PEM bundle with CA certificates that
+	// are trusted in addition to the system ones
+	CACert string `json:"caCert,omitempty"`
+
+	// Mirrors are hosts of registries that images are pulled from before
+	// trying this registry, e.g. pull-through caches for Docker Hub
+	Mirrors []string `json:"mirrors,omitempty"`
+}
+
+// AuthConfig defines where credentials for a registry come from, only
+// one of basic credentials, a bearer token or a credential helper can
+// be used; secrets can only be read from environment variables or files,
+// so that the config itself can be checked in
+type AuthConfig struct {
+	Username     string `json:"username,omitempty"`
+	UsernameEnv  string `json:"usernameEnv,omitempty"`
+	PasswordEnv  string `json:"passwordEnv,omitempty"`
+	PasswordFile string `json:"passwordFile,omitempty"`
+
+	TokenEnv  string `json:"tokenEnv,omitempty"`
+	TokenFile string `json:"tokenFile,omitempty"`
+
+	// CredHelper is a name of docker credential helper, i.e.
+	// 'docker-credential-<CredHelper>' must be in PATH
+	CredHelper string `json:"credHelper,omitempty"`
+}
+
+// LoadConfig reads registry config from the given file
+func LoadConfig(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("unable to parse registry config %q: %w", filename, err)
+	}
+	for host, hostConfig := range c.Registries {
+		if hostConfig == nil {
+			continue
+		}
+		if hostConfig.Auth != nil {
+			if err := hostConfig.Auth.validate(); err != nil {
+				return nil, fmt.Errorf("invalid auth config for registry %q: %w", host, err)
+			}
+		}
+		if hostConfig.Insecure && hostConfig.CACert != "" {
+			return nil, fmt.Errorf("invalid config for registry %q: caCert cannot be used with insecure", host)
+		}
+		for _, mirror := range hostConfig.Mirrors {
+			if _, err := name.NewRegistry(mirror); err != nil || strings.Contains(mirror, "/") {
+				return nil, fmt.Errorf("invalid mirror %q for registry %q: only a host name (with optional port) is allowed", mirror, host)
+			}
+		}
+	}
+	return c, nil
+}
+
+// Host returns settings for the given registry host, or nil
+// if there are none
+func (c *Config) Host(host string) *HostConfig {
+	if c == nil {
+		return nil
+	}
+	if hostConfig, ok := c.Registries[host]; ok {
+		return hostConfig
+	}
+	for configuredHost, hostConfig := range c.Registries {
+		if authKey(configuredHost) == authKey(host) {
+			return hostConfig
+		}
+	}
+	return nil
+}
+
+// MirrorRefs returns refs that the given ref can be pulled from
+// through mirrors of its registry, in order of preference
+func (c *Config) MirrorRefs(ref name.Reference) []string {
+	hostConfig := c.Host(ref.Context().RegistryStr())
+	if hostConfig == nil {
+		return nil
+	}
+	delimiter := ":"
+	if _, ok := ref.(name.Digest); ok {
+		delimiter = "@"
+	}
+	refs := make([]string, 0, len(hostConfig.Mirrors))
+	for _, mirror := range hostConfig.Mirrors {
+		refs = append(refs, mirror+"/"+ref.Context().RepositoryStr()+delimiter+ref.Identifier())
+	}
+	return refs
+}
+
+// InsecureHosts returns sorted list of registry hosts that use
+// plain HTTP or have TLS verification disabled
+func (c *Config) InsecureHosts() []string {
+	hosts := []string{}
+	if c == nil {
+		return hosts
+	}
+	for host, hostConfig := range c.Registries {
+		if hostConfig != nil && (hostConfig.PlainHTTP || hostConfig.Insecure) {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// transport returns HTTP transport for the given registry host,
+// transports are reused so connections to the same host are too
+func (c *Config) transport(host string) (http.RoundTripper, error) {
+	hostConfig := c.Host(host)
+	if hostConfig == nil || (!hostConfig.Insecure && hostConfig.CACert == "") {
+		return http.DefaultTransport, nil
+	}
+
+	c.transportsLock.Lock()
+	defer c.transportsLock.Unlock()
+
+	if t, ok := c.transports[host]; ok {
+		return t, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: hostConfig.Insecure,
+	}
+	if hostConfig.CACert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := ioutil.ReadFile(hostConfig.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA certificate for registry %q: %w", host, err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %q", hostConfig.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsConfig
+
+	if c.transports == nil {
+		c.transports = map[string]http.RoundTripper{}
+	}
+	c.transports[host] = t
+	return t, nil
+}
+
+func (a *AuthConfig) isBasic() bool {
+	return a.Username != "" || a.UsernameEnv != "" || a.PasswordEnv != "" || a.PasswordFile != ""
+}
+
+func (a *AuthConfig) isToken() bool {
+	return a.TokenEnv != "" || a.TokenFile != ""
+}
+
+func (a *AuthConfig) validate() error {
+	kinds := 0
+	for _, set := range []bool{a.isBasic(), a.isToken(), a.CredHelper != ""} {
+		if set {
+			kinds++
+		}
+	}
+	switch {
+	case kinds == 0:
+		return fmt.Errorf("no credentials are set")
+	case kinds > 1:
+		return fmt.Errorf("only one of username/password, token or credHelper can be set")
+	}
+	if a.isBasic() {
+		if (a.Username == "") == (a.UsernameEnv == "") {
+			return fmt.Errorf("exactly one of username or usernameEnv must be set")
+		}
+		if (a.PasswordEnv == "") == (a.PasswordFile == "") {
+			return fmt.Errorf("exactly one of passwordEnv or passwordFile must be set")
+		}
+	}
+	if a.TokenEnv != "" && a.TokenFile != "" {
+		return fmt.Errorf("only one of tokenEnv or tokenFile can be set")
+	}
+	return nil
+}
+
+func readSecret(env, file string) (string, error) {
+	if env != "" {
+		value, ok := os.LookupEnv(env)
+		if !ok || value == "" {
+			return "", fmt.Errorf("environment variable %q is not set", env)
+		}
+		return value, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (a *AuthConfig) resolve(serverAddress string) (types.AuthConfig, error) {
+	authConfig := types.AuthConfig{ServerAddress: serverAddress}
+	if a.isToken() {
+		token, err := readSecret(a.TokenEnv, a.TokenFile)
+		if err != nil {
+			return authConfig, err
+		}
+		authConfig.RegistryToken = token
+		return authConfig, nil
+	}
+
+	username := a.Username
+	if a.UsernameEnv != "" {
+		var err error
+		if username, err = readSecret(a.UsernameEnv, ""); err != nil {
+			return authConfig, err
+		}
+	}
+	password, err := readSecret(a.PasswordEnv, a.PasswordFile)
+	if err != nil {
+		return authConfig, err
+	}
+	authConfig.Username = username
+	authConfig.Password = password
+	return authConfig, nil
+}
+
+// authKey returns the key used for the given registry host in docker config,
+// Docker Hub uses a legacy URL for historical reasons
+func authKey(host string) string {
+	switch host {
+	case name.DefaultRegistry, "docker.io", "registry-1.docker.io":
+		return authn.DefaultAuthKey
+	}
+	return host
+}
+
+// DockerConfigFile returns docker config with credentials for each of the
+// configured registries merged in, credentials of other registries are
+// left as they are; the result is computed once and it is never saved
+func (c *Config) DockerConfigFile() (*configfile.ConfigFile, error) {
+	if c == nil {
+		return dockerconfig.Load("")
+	}
+	c.mergedOnce.Do(func() {
+		c.merged, c.mergedErr = c.mergeDockerConfig()
+	})
+	return c.merged, c.mergedErr
+}
+
+func (c *Config) mergeDockerConfig() (*configfile.ConfigFile, error) {
+	cf, err := dockerconfig.Load(c.DockerConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load docker config: %w", err)
+	}
+	if cf.AuthConfigs == nil {
+		cf.AuthConfigs = map[string]types.AuthConfig{}
+	}
+	if cf.CredentialHelpers == nil {
+		cf.CredentialHelpers = map[string]string{}
+	}
+
+	for host, hostConfig := range c.Registries {
+		if hostConfig == nil || hostConfig.Auth == nil {
+			continue
+		}
+		key := authKey(host)
+		if hostConfig.Auth.CredHelper != "" {
+			cf.CredentialHelpers[key] = hostConfig.Auth.CredHelper
+			continue
+		}
+		authConfig, err := hostConfig.Auth.resolve(key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get credentials for registry %q: %w", host, err)
+		}
+		cf.AuthConfigs[key] = authConfig
+		// an empty helper forces use of the credentials set above even
+		// when docker config has 'credsStore' set
+		cf.CredentialHelpers[key] = ""
+	}
+	return cf, nil
+}
+
+// Keychain returns a keychain that resolves credentials in the same way as
+// they are passed to buildx
+func (c *Config) Keychain() authn.Keychain {
+	return &keychain{config: c}
+}
+
+type keychain struct {
+	config *Config
+}
+
+func (k *keychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	cf, err := k.config.DockerConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	authConfig, err := cf.GetAuthConfig(authKey(target.RegistryStr()))
+	if err != nil {
+		return nil, err
+	}
+	authConfig.ServerAddress = ""
+	if authConfig == (types.AuthConfig{}) {
+		return authn.Anonymous, nil
+	}
+	return authn.FromConfig(authn.AuthConfig{
+		Username:      authConfig.Username,
+		Password:      authConfig.Password,
+		Auth:          authConfig.Auth,
+		IdentityToken: authConfig.IdentityToken,
+		RegistryToken: authConfig.RegistryToken,
+	}), nil
+}
+
+// WriteDockerConfig writes merged docker config to a new temporary directory,
+// so it can be passed to docker CLI via DOCKER_CONFIG; all other entries of
+// the original config directory (e.g. buildx state and CLI plugins) are
+// symlinked, the returned function removes the directory
+func (c *Config) WriteDockerConfig() (string, func(), error) {
+	cleanup := func() {}
+
+	cf, err := c.DockerConfigFile()
+	if err != nil {
+		return "", cleanup, err
+	}
+
+	dir, err := ioutil.TempDir("", "imagine-docker-config-")
+	if err != nil {
+		return "", cleanup, err
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+
+	origDir := dockerconfig.Dir()
+	if c.DockerConfig != "" {
+		origDir = c.DockerConfig
+	}
+	entries, err := ioutil.ReadDir(origDir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", cleanup, err
+	}
+	for _, entry := range entries {
+		if entry.Name() == dockerconfig.ConfigFileName {
+			continue
+		}
+		if err := os.Symlink(filepath.Join(origDir, entry.Name()), filepath.Join(dir, entry.Name())); err != nil {
+			return "", cleanup, err
+		}
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, dockerconfig.ConfigFileName), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", cleanup, err
+	}
+	defer f.Close()
+	if err := cf.SaveToWriter(f); err != nil {
+		return "", cleanup, err
+	}
+	return dir, cleanup, nil
+}
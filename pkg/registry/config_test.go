@@ -0,0 +1,200 @@
+package registry_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+
+	"github.com/errordeveloper/imagine/pkg/export"
+
+	. "github.com/errordeveloper/imagine/pkg/registry"
+)
+
+func writeFile(t *testing.T, dir, filename string, data interface{}) string {
+	path := filepath.Join(dir, filename)
+	var content []byte
+	switch data := data.(type) {
+	case string:
+		content = []byte(data)
+	default:
+		var err error
+		if content, err = json.Marshal(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func authorization(g *WithT, keychain authn.Keychain, registry string) *authn.AuthConfig {
+	reg, err := name.NewRegistry(registry)
+	g.Expect(err).ToNot(HaveOccurred())
+	auth, err := keychain.Resolve(reg)
+	g.Expect(err).ToNot(HaveOccurred())
+	authConfig, err := auth.Authorization()
+	g.Expect(err).ToNot(HaveOccurred())
+	return authConfig
+}
+
+func TestLoadConfig(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir := t.TempDir()
+
+	for config, expectedErr := range map[string]string{
+		`{"registries": {"reg1.example.com": {"auth": {}}}}`:                                                                   `invalid auth config for registry "reg1.example.com": no credentials are set`,
+		`{"registries": {"reg1.example.com": {"auth": {"username": "foo"}}}}`:                                                  `invalid auth config for registry "reg1.example.com": exactly one of passwordEnv or passwordFile must be set`,
+		`{"registries": {"reg1.example.com": {"auth": {"passwordEnv": "FOO"}}}}`:                                               `invalid auth config for registry "reg1.example.com": exactly one of username or usernameEnv must be set`,
+		`{"registries": {"reg1.example.com": {"auth": {"tokenEnv": "FOO", "credHelper": "foo"}}}}`:                             `invalid auth config for registry "reg1.example.com": only one of username/password, token or credHelper can be set`,
+		`{"registries": {"reg1.example.com": {"auth": {"tokenEnv": "FOO", "tokenFile": "/foo"}}}}`:                             `invalid auth config for registry "reg1.example.com": only one of tokenEnv or tokenFile can be set`,
+		`{"registries": {"reg1.example.com": {"auth": {"username": "foo", "passwordFile": "/foo"}}}}`:                          ``,
+		`{"registries": {"reg1.example.com": {"auth": {"credHelper": "foo"}}, "reg2.example.com": {}}}`:                        ``,
+		`{"dockerConfig": "/foo", "registries": {"reg1.example.com": {"auth": {"usernameEnv": "FOO", "passwordEnv": "BAR"}}}}`: ``,
+	} {
+		_, err := LoadConfig(writeFile(t, dir, "config.json", config))
+		if expectedErr == "" {
+			g.Expect(err).ToNot(HaveOccurred())
+		} else {
+			g.Expect(err).To(MatchError(expectedErr))
+		}
+	}
+}
+
+func TestKeychain(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir := t.TempDir()
+
+	dockerConfigDir := filepath.Join(dir, "docker")
+	g.Expect(os.MkdirAll(filepath.Join(dockerConfigDir, "buildx"), 0700)).To(Succeed())
+	writeFile(t, dockerConfigDir, "config.json", map[string]interface{}{
+		"auths": map[string]interface{}{
+			"reg1.example.com": map[string]string{"auth": "b2xkOm9sZA=="}, // old:old
+			"reg3.example.com": map[string]string{"auth": "Zm9vOmJhcg=="}, // foo:bar
+		},
+		// would fail when used, as the helper doesn't exist
+		"credsStore": "imagine-test-nonexistent",
+	})
+
+	os.Setenv("IMAGINE_TEST_PASSWORD", "secret1")
+	defer os.Unsetenv("IMAGINE_TEST_PASSWORD")
+
+	c, err := LoadConfig(writeFile(t, dir, "registries.json", map[string]interface{}{
+		"dockerConfig": dockerConfigDir,
+		"registries": map[string]interface{}{
+			"reg1.example.com": map[string]interface{}{
+				"auth": map[string]string{"username": "bot", "passwordEnv": "IMAGINE_TEST_PASSWORD"},
+			},
+			"reg2.example.com": map[string]interface{}{
+				"auth": map[string]string{"tokenFile": writeFile(t, dir, "token", "secret2\n")},
+			},
+			"docker.io": map[string]interface{}{
+				"auth": map[string]string{"username": "bot", "passwordFile": writeFile(t, dir, "password", "secret3")},
+			},
+		},
+	}))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	keychain := c.Keychain()
+
+	g.Expect(authorization(g, keychain, "reg1.example.com")).To(Equal(&authn.AuthConfig{Username: "bot", Password: "secret1"}))
+	g.Expect(authorization(g, keychain, "reg2.example.com")).To(Equal(&authn.AuthConfig{RegistryToken: "secret2"}))
+	g.Expect(authorization(g, keychain, "index.docker.io")).To(Equal(&authn.AuthConfig{Username: "bot", Password: "secret3"}))
+
+	reg, err := name.NewRegistry("reg3.example.com")
+	g.Expect(err).ToNot(HaveOccurred())
+	_, err = keychain.Resolve(reg)
+	g.Expect(err).To(HaveOccurred())
+
+	configDir, cleanup, err := c.WriteDockerConfig()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	target, err := os.Readlink(filepath.Join(configDir, "buildx"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(target).To(Equal(filepath.Join(dockerConfigDir, "buildx")))
+
+	written, err := LoadConfig(writeFile(t, dir, "written.json", map[string]string{"dockerConfig": configDir}))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(authorization(g, written.Keychain(), "reg1.example.com")).To(Equal(&authn.AuthConfig{Username: "bot", Password: "secret1"}))
+	g.Expect(authorization(g, written.Keychain(), "reg2.example.com")).To(Equal(&authn.AuthConfig{RegistryToken: "secret2"}))
+
+	cleanup()
+	_, err = os.Stat(configDir)
+	g.Expect(os.IsNotExist(err)).To(BeTrue())
+
+	os.Unsetenv("IMAGINE_TEST_PASSWORD")
+	c, err = LoadConfig(writeFile(t, dir, "registries.json", map[string]interface{}{
+		"dockerConfig": dockerConfigDir,
+		"registries": map[string]interface{}{
+			"reg1.example.com": map[string]interface{}{
+				"auth": map[string]string{"username": "bot", "passwordEnv": "IMAGINE_TEST_PASSWORD"},
+			},
+		},
+	}))
+	g.Expect(err).ToNot(HaveOccurred())
+	_, err = c.DockerConfigFile()
+	g.Expect(err).To(MatchError(`unable to get credentials for registry "reg1.example.com": environment variable "IMAGINE_TEST_PASSWORD" is not set`))
+}
+
+func TestRegistryWithAuth(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	handler := ggcrregistry.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "bot" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+	host := u.Host
+
+	img, err := random.Image(64, 1)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	dir := t.TempDir()
+
+	ref := host + "/imagine/image-1:16c315"
+
+	g.Expect((&Registry{Config: &Config{DockerConfig: dir}}).Push(ref, &export.Artifact{Image: img})).ToNot(Succeed())
+
+	c, err := LoadConfig(writeFile(t, dir, "registries.json", map[string]interface{}{
+		"dockerConfig": dir,
+		"registries": map[string]interface{}{
+			host: map[string]interface{}{
+				"auth": map[string]string{"username": "bot", "passwordFile": writeFile(t, dir, "password", "secret")},
+			},
+		},
+	}))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	reg := &Registry{Config: c}
+
+	g.Expect(reg.Push(ref, &export.Artifact{Image: img})).To(Succeed())
+
+	expectedDigest, err := img.Digest()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	digest, err := reg.Digest(ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(digest).To(Equal(expectedDigest.String()))
+}
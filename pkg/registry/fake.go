@@ -2,6 +2,7 @@ package registry
 
 import (
 	"fmt"
+	"strings"
 )
 
 type FakeRegistry struct {
@@ -11,7 +12,30 @@ type FakeRegistry struct {
 func (f *FakeRegistry) Digest(ref string) (string, error) {
 	v, ok := f.DigestValues[ref]
 	if !ok {
-		return "", fmt.Errorf("%s is not in fake registry", ref)
+		return "", fmt.Errorf("%s is not in fake registry: %w", ref, ErrNotFound)
 	}
 	return v, nil
 }
+
+func (f *FakeRegistry) Copy(src, dst string) error {
+	v, ok := f.DigestValues[src]
+	if !ok {
+		// refs by digest are resolved to the digest itself, as long as
+		// some tag is pointing to it
+		if i := strings.LastIndex(src, "@"); i != -1 {
+			for _, d := range f.DigestValues {
+				if d == src[i+1:] {
+					v, ok = d, true
+				}
+			}
+		}
+	}
+	if !ok {
+		return fmt.Errorf("%s is not in fake registry: %w", src, ErrNotFound)
+	}
+	if f.DigestValues == nil {
+		f.DigestValues = map[string]string{}
+	}
+	f.DigestValues[dst] = v
+	return nil
+}
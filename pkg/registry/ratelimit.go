@@ -0,0 +1,111 @@
+package registry
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultMaxRetries     = 5
+	defaultInitialBackoff = 500 * time.Millisecond
+	defaultMaxBackoff     = 30 * time.Second
+	// some registries ask to retry in a matter of hours,
+	// it's better to fail than to wait for so long
+	defaultMaxRetryAfter = 2 * time.Minute
+)
+
+// rateLimitTransport retries requests that were rejected due to rate
+// limiting, it waits for as long as 'Retry-After' header says, or backs
+// off exponentially when the header is not set
+type rateLimitTransport struct {
+	inner http.RoundTripper
+
+	maxRetries     int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	maxRetryAfter  time.Duration
+}
+
+func newRateLimitTransport(inner http.RoundTripper) http.RoundTripper {
+	return &rateLimitTransport{
+		inner:          inner,
+		maxRetries:     defaultMaxRetries,
+		initialBackoff: defaultInitialBackoff,
+		maxBackoff:     defaultMaxBackoff,
+		maxRetryAfter:  defaultMaxRetryAfter,
+	}
+}
+
+func isRateLimited(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusServiceUnavailable:
+		return resp.Header.Get("Retry-After") != ""
+	}
+	return false
+}
+
+// retryAfter parses 'Retry-After' header, which is either
+// a number of seconds or an HTTP date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backoff := t.initialBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := t.inner.RoundTrip(req)
+		if err != nil || !isRateLimited(resp) || attempt == t.maxRetries {
+			return resp, err
+		}
+		// requests with body can only be retried when it can be read again
+		if req.Body != nil && req.GetBody == nil {
+			return resp, nil
+		}
+
+		wait, ok := retryAfter(resp)
+		if !ok {
+			wait = backoff
+			if backoff *= 2; backoff > t.maxBackoff {
+				backoff = t.maxBackoff
+			}
+		}
+		if wait > t.maxRetryAfter {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
@@ -1,16 +1,366 @@
 package registry
 
 import (
-	"github.com/google/go-containerregistry/pkg/crane"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/errordeveloper/imagine/pkg/export"
 )
 
+// ErrNotFound can be wrapped by implementations of RegistryAPI
+// to indicate that an image doesn't exist
+var ErrNotFound = errors.New("image not found")
+
+// ErrAnnotationsNotSupported is returned when annotations cannot
+// be added to a manifest, which is the case for Docker media types
+var ErrAnnotationsNotSupported = errors.New("annotations are not supported")
+
 type RegistryAPI interface {
 	Digest(string) (string, error)
 }
 
+// IsNotFound checks if the error means that an image doesn't exist,
+// as opposed to the registry being unreachable or denying access
+func IsNotFound(err error) bool {
+	if errors.Is(err, ErrNotFound) {
+		return true
+	}
+	var transportErr *transport.Error
+	if errors.As(err, &transportErr) {
+		if transportErr.StatusCode == http.StatusNotFound {
+			return true
+		}
+		for _, diagnostic := range transportErr.Errors {
+			switch diagnostic.Code {
+			case transport.ManifestUnknownErrorCode, transport.NameUnknownErrorCode:
+				return true
+			}
+		}
+	}
+	return false
+}
+
 type Registry struct {
+	// Config is optional, when it's not set credentials are
+	// taken from the default docker config
+	Config *Config
+
+	cacheLock  sync.Mutex
+	digests    map[string]string
+	transports map[string]http.RoundTripper
 }
 
+func (r *Registry) transport(host string) (http.RoundTripper, error) {
+	t, err := r.Config.transport(host)
+	if err != nil {
+		return nil, err
+	}
+	return newRateLimitTransport(t), nil
+}
+
+// parseReference parses the ref and returns options to use
+// for remote calls based on the registry host
+func (r *Registry) parseReference(ref string) (name.Reference, []remote.Option, error) {
+	parsedRef, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	host := parsedRef.Context().RegistryStr()
+	if hostConfig := r.Config.Host(host); hostConfig != nil && hostConfig.PlainHTTP {
+		if parsedRef, err = name.ParseReference(ref, name.Insecure); err != nil {
+			return nil, nil, err
+		}
+	}
+	t, err := r.transport(host)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parsedRef, []remote.Option{
+		remote.WithAuthFromKeychain(r.Config.Keychain()),
+		remote.WithTransport(t),
+	}, nil
+}
+
+// Digest returns digest of a remote image or index, digests are cached,
+// so the same ref is only looked up once, unless it gets pushed to;
+// errors are not cached, as images may get pushed by other means, and
+// Forget has to be called for refs that were pushed by other means
 func (r *Registry) Digest(ref string) (string, error) {
-	return crane.Digest(ref)
+	r.cacheLock.Lock()
+	digest, ok := r.digests[ref]
+	r.cacheLock.Unlock()
+	if ok {
+		return digest, nil
+	}
+
+	digest, err := r.headDigest(ref)
+	if err != nil {
+		return "", err
+	}
+
+	r.cacheLock.Lock()
+	if r.digests == nil {
+		r.digests = map[string]string{}
+	}
+	r.digests[ref] = digest
+	r.cacheLock.Unlock()
+
+	return digest, nil
+}
+
+// Forget drops cached digests of the refs, it should be called when
+// they are pushed by other means (e.g. by BuildKit)
+func (r *Registry) Forget(refs ...string) {
+	r.cacheLock.Lock()
+	for _, ref := range refs {
+		delete(r.digests, ref)
+	}
+	r.cacheLock.Unlock()
+}
+
+var manifestMediaTypes = []types.MediaType{
+	types.OCIImageIndex,
+	types.OCIManifestSchema1,
+	types.DockerManifestList,
+	types.DockerManifestSchema2,
+	types.DockerManifestSchema1,
+	types.DockerManifestSchema1Signed,
+}
+
+// BaseImageDigest returns digest of a base image, mirrors of the registry
+// are tried first (if any are configured), the same way BuildKit pulls
+// base images through them; it is not cached and should not be used
+// for images that imagine pushes, as these are never in mirrors
+func (r *Registry) BaseImageDigest(ref string) (string, error) {
+	mirrorRefs, err := r.mirrorRefs(ref)
+	if err != nil {
+		return "", err
+	}
+	for _, mirrorRef := range mirrorRefs {
+		digest, err := r.headDigest(mirrorRef)
+		if err == nil {
+			return digest, nil
+		}
+		logMirrorError(mirrorRef, err)
+	}
+	return r.headDigest(ref)
+}
+
+func (r *Registry) mirrorRefs(ref string) ([]string, error) {
+	parsedRef, _, err := r.parseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	return r.Config.MirrorRefs(parsedRef), nil
+}
+
+// logMirrorError reports mirror failures other than missing images,
+// as these are not fatal, but may slow builds down
+func logMirrorError(mirrorRef string, err error) {
+	if !IsNotFound(err) {
+		fmt.Printf("unable to use mirror %q: %s\n", mirrorRef, err)
+	}
+}
+
+// headDigest makes a HEAD request, which doesn't count towards
+// Docker Hub pull rate limit, and falls back to GET if the registry
+// doesn't return a digest
+func (r *Registry) headDigest(ref string) (string, error) {
+	parsedRef, _, err := r.parseReference(ref)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := r.client(parsedRef.Context())
+	if err != nil {
+		return "", err
+	}
+
+	u := url.URL{
+		Scheme: parsedRef.Context().Registry.Scheme(),
+		Host:   parsedRef.Context().RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/manifests/%s", parsedRef.Context().RepositoryStr(), parsedRef.Identifier()),
+	}
+	req, err := http.NewRequest(http.MethodHead, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	accept := make([]string, 0, len(manifestMediaTypes))
+	for _, mediaType := range manifestMediaTypes {
+		accept = append(accept, string(mediaType))
+	}
+	req.Header.Set("Accept", strings.Join(accept, ","))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+			return digest, nil
+		}
+	case http.StatusNotFound:
+		return "", transport.CheckError(resp, http.StatusOK)
+	}
+
+	desc, err := r.get(ref)
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest.String(), nil
+}
+
+// client returns HTTP client that is authenticated for pulling from
+// the given repository, clients are reused to avoid repeating
+// authentication handshake
+func (r *Registry) client(repo name.Repository) (*http.Client, error) {
+	key := repo.String()
+
+	r.cacheLock.Lock()
+	t, ok := r.transports[key]
+	r.cacheLock.Unlock()
+
+	if !ok {
+		auth, err := r.Config.Keychain().Resolve(repo)
+		if err != nil {
+			return nil, err
+		}
+		base, err := r.transport(repo.RegistryStr())
+		if err != nil {
+			return nil, err
+		}
+		t, err = transport.New(repo.Registry, auth, base, []string{repo.Scope(transport.PullScope)})
+		if err != nil {
+			return nil, err
+		}
+
+		r.cacheLock.Lock()
+		if r.transports == nil {
+			r.transports = map[string]http.RoundTripper{}
+		}
+		r.transports[key] = t
+		r.cacheLock.Unlock()
+	}
+
+	return &http.Client{Transport: t}, nil
+}
+
+// Get fetches descriptor of a remote image or index
+func (r *Registry) Get(ref string) (*remote.Descriptor, error) {
+	return r.get(ref)
+}
+
+func (r *Registry) get(ref string) (*remote.Descriptor, error) {
+	parsedRef, options, err := r.parseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	return remote.Get(parsedRef, options...)
+}
+
+// Push writes image or index to the given ref
+func (r *Registry) Push(ref string, artifact *export.Artifact) error {
+	parsedRef, options, err := r.parseReference(ref)
+	if err != nil {
+		return err
+	}
+	defer r.Forget(ref)
+	if artifact.Index != nil {
+		return remote.WriteIndex(parsedRef, artifact.Index, options...)
+	}
+	return remote.Write(parsedRef, artifact.Image, options...)
+}
+
+type rawManifest struct {
+	mediaType types.MediaType
+	manifest  []byte
+}
+
+func (m *rawManifest) RawManifest() ([]byte, error) { return m.manifest, nil }
+
+func (m *rawManifest) MediaType() (types.MediaType, error) { return m.mediaType, nil }
+
+// Annotate adds annotations to the manifest or index that ref points
+// to, existing annotations with the same keys are overwritten; as
+// this changes the digest, the tag is updated to point to the new
+// manifest, while the layers are left untouched; only OCI media types
+// can be annotated, ErrAnnotationsNotSupported is returned otherwise
+func (r *Registry) Annotate(ref string, annotations map[string]string) error {
+	if len(annotations) == 0 {
+		return nil
+	}
+	parsedRef, options, err := r.parseReference(ref)
+	if err != nil {
+		return err
+	}
+	tag, ok := parsedRef.(name.Tag)
+	if !ok {
+		return fmt.Errorf("unable to annotate %q as it is not a tag", ref)
+	}
+	desc, err := r.get(ref)
+	if err != nil {
+		return err
+	}
+	switch desc.MediaType {
+	case types.OCIImageIndex, types.OCIManifestSchema1:
+	default:
+		// Docker manifests have no annotations field, so it
+		// would either be dropped or break strict parsers
+		return fmt.Errorf("unable to annotate %q with media type %q: %w", ref, desc.MediaType, ErrAnnotationsNotSupported)
+	}
+
+	manifest := map[string]json.RawMessage{}
+	if err := json.Unmarshal(desc.Manifest, &manifest); err != nil {
+		return fmt.Errorf("unable to parse manifest of %q: %w", ref, err)
+	}
+	merged := map[string]string{}
+	if existing, ok := manifest["annotations"]; ok {
+		if err := json.Unmarshal(existing, &merged); err != nil {
+			return fmt.Errorf("unable to parse annotations of %q: %w", ref, err)
+		}
+	}
+	for k, v := range annotations {
+		merged[k] = v
+	}
+	if manifest["annotations"], err = json.Marshal(merged); err != nil {
+		return err
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	defer r.Forget(ref)
+	return remote.Tag(tag, &rawManifest{mediaType: desc.MediaType, manifest: data}, options...)
+}
+
+// Copy copies image or index from src to dst, including all
+// of the manifests it references
+func (r *Registry) Copy(src, dst string) error {
+	desc, err := r.Get(src)
+	if err != nil {
+		return err
+	}
+	switch desc.MediaType {
+	case types.DockerManifestSchema1, types.DockerManifestSchema1Signed:
+		return fmt.Errorf("unable to copy %q as schema 1 images are not supported", src)
+	}
+	artifact, err := export.FromRemote(desc)
+	if err != nil {
+		return err
+	}
+	return r.Push(dst, artifact)
 }
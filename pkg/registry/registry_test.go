@@ -0,0 +1,421 @@
+package registry_test
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+
+	"github.com/errordeveloper/imagine/pkg/export"
+	"github.com/errordeveloper/imagine/pkg/internal/testutil"
+
+	. "github.com/errordeveloper/imagine/pkg/registry"
+)
+
+func TestPushAndGet(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	host := testutil.StartRegistry(t)
+
+	idx, err := random.Index(64, 1, 2)
+	g.Expect(err).ToNot(HaveOccurred())
+	expectedDigest, err := idx.Digest()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	reg := &Registry{}
+
+	ref := host + "/imagine/image-1:16c315"
+
+	_, err = reg.Digest(ref)
+	g.Expect(err).To(HaveOccurred())
+
+	g.Expect(reg.Push(ref, &export.Artifact{Index: idx})).To(Succeed())
+
+	digest, err := reg.Digest(ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(digest).To(Equal(expectedDigest.String()))
+
+	desc, err := reg.Get(ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(desc.Digest).To(Equal(expectedDigest))
+
+	artifact, err := export.FromRemote(desc)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(artifact.Index).ToNot(BeNil())
+}
+
+func TestCopy(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	host := testutil.StartRegistry(t)
+
+	idx, err := random.Index(64, 1, 2)
+	g.Expect(err).ToNot(HaveOccurred())
+	expectedDigest, err := idx.Digest()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	reg := &Registry{}
+
+	src := host + "/staging/image-1:16c315"
+	dst := host + "/release/image-1:v1.0.0"
+
+	g.Expect(reg.Copy(src, dst)).ToNot(Succeed())
+
+	g.Expect(reg.Push(src, &export.Artifact{Index: idx})).To(Succeed())
+
+	g.Expect(reg.Copy(host+"/staging/image-1@"+expectedDigest.String(), dst)).To(Succeed())
+
+	digest, err := reg.Digest(dst)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(digest).To(Equal(expectedDigest.String()))
+}
+
+func TestAnnotate(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	host := testutil.StartRegistry(t)
+
+	idx, err := random.Index(64, 1, 2)
+	g.Expect(err).ToNot(HaveOccurred())
+	originalDigest, err := idx.Digest()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	reg := &Registry{}
+
+	ref := host + "/imagine/image-1:16c315"
+
+	g.Expect(reg.Annotate(ref, map[string]string{"foo": "bar"})).ToNot(Succeed())
+
+	g.Expect(reg.Push(ref, &export.Artifact{Index: idx})).To(Succeed())
+
+	g.Expect(reg.Annotate(host+"/imagine/image-1@"+originalDigest.String(), map[string]string{"foo": "bar"})).ToNot(Succeed())
+
+	g.Expect(reg.Annotate(ref, map[string]string{"foo": "bar"})).To(Succeed())
+	g.Expect(reg.Annotate(ref, map[string]string{"foo": "baz", "org.opencontainers.image.revision": "16c315243fd31c00b80c188123099501ae2ccf91"})).To(Succeed())
+
+	desc, err := reg.Get(ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(desc.Digest.String()).ToNot(Equal(originalDigest.String()))
+
+	annotated, err := desc.ImageIndex()
+	g.Expect(err).ToNot(HaveOccurred())
+	manifest, err := annotated.IndexManifest()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(manifest.Annotations).To(Equal(map[string]string{
+		"foo":                               "baz",
+		"org.opencontainers.image.revision": "16c315243fd31c00b80c188123099501ae2ccf91",
+	}))
+
+	originalManifest, err := idx.IndexManifest()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(manifest.Manifests).To(Equal(originalManifest.Manifests))
+
+	digest, err := reg.Digest(ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(digest).To(Equal(desc.Digest.String()))
+
+	img, err := random.Image(64, 1)
+	g.Expect(err).ToNot(HaveOccurred())
+	imgDigest, err := img.Digest()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	dockerRef := host + "/imagine/image-2:16c315"
+	g.Expect(reg.Push(dockerRef, &export.Artifact{Image: img})).To(Succeed())
+
+	err = reg.Annotate(dockerRef, map[string]string{"foo": "bar"})
+	g.Expect(errors.Is(err, ErrAnnotationsNotSupported)).To(BeTrue())
+
+	digest, err = reg.Digest(dockerRef)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(digest).To(Equal(imgDigest.String()))
+}
+
+func TestIsNotFound(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	host := testutil.StartRegistry(t)
+
+	reg := &Registry{}
+
+	_, err := reg.Digest(host + "/imagine/image-1:16c315")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(IsNotFound(err)).To(BeTrue())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	_, err = reg.Digest(u.Host + "/imagine/image-1:16c315")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(IsNotFound(err)).To(BeFalse())
+
+	_, err = (&FakeRegistry{}).Digest("reg1.example.com/imagine/image-1:16c315")
+	g.Expect(IsNotFound(err)).To(BeTrue())
+}
+
+func TestRegistryWithCustomCA(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	server := httptest.NewTLSServer(ggcrregistry.New())
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+	host := u.Host
+
+	dir := t.TempDir()
+	caCert := writeFile(t, dir, "ca.pem", string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	})))
+
+	img, err := random.Image(64, 1)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	ref := host + "/imagine/image-1:16c315"
+
+	g.Expect((&Registry{}).Push(ref, &export.Artifact{Image: img})).ToNot(Succeed())
+
+	for _, hostConfig := range []map[string]interface{}{
+		{"caCert": caCert},
+		{"insecure": true},
+	} {
+		c, err := LoadConfig(writeFile(t, dir, "registries.json", map[string]interface{}{
+			"dockerConfig": dir,
+			"registries": map[string]interface{}{
+				host: hostConfig,
+			},
+		}))
+		g.Expect(err).ToNot(HaveOccurred())
+
+		reg := &Registry{Config: c}
+
+		g.Expect(reg.Push(ref, &export.Artifact{Image: img})).To(Succeed())
+
+		_, err = reg.Digest(ref)
+		g.Expect(err).ToNot(HaveOccurred())
+
+		_, err = reg.Digest(host + "/imagine/image-1:16c315-dev")
+		g.Expect(IsNotFound(err)).To(BeTrue())
+	}
+
+	_, err = LoadConfig(writeFile(t, dir, "registries.json", map[string]interface{}{
+		"registries": map[string]interface{}{
+			host: map[string]interface{}{"caCert": caCert, "insecure": true},
+		},
+	}))
+	g.Expect(err).To(MatchError(fmt.Sprintf("invalid config for registry %q: caCert cannot be used with insecure", host)))
+
+	c, err := LoadConfig(writeFile(t, dir, "registries.json", map[string]interface{}{
+		"dockerConfig": dir,
+		"registries": map[string]interface{}{
+			host: map[string]interface{}{"caCert": filepath.Join(dir, "registries.json")},
+		},
+	}))
+	g.Expect(err).ToNot(HaveOccurred())
+	_, err = (&Registry{Config: c}).Digest(ref)
+	g.Expect(err).To(MatchError(fmt.Sprintf("no certificates found in %q", filepath.Join(dir, "registries.json"))))
+}
+
+func TestRegistryWithPlainHTTP(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	host := testutil.StartRegistry(t)
+
+	dir := t.TempDir()
+
+	c, err := LoadConfig(writeFile(t, dir, "registries.json", map[string]interface{}{
+		"dockerConfig": dir,
+		"registries": map[string]interface{}{
+			host: map[string]interface{}{"plainHTTP": true},
+		},
+	}))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(c.InsecureHosts()).To(Equal([]string{host}))
+
+	img, err := random.Image(64, 1)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	reg := &Registry{Config: c}
+
+	ref := host + "/imagine/image-1:16c315"
+
+	g.Expect(reg.Push(ref, &export.Artifact{Image: img})).To(Succeed())
+	g.Expect(reg.Copy(ref, host+"/imagine/image-1:v1.0.0")).To(Succeed())
+}
+
+type requestCounter struct {
+	sync.Mutex
+	requests map[string]int
+}
+
+func (c *requestCounter) count(method, path string) int {
+	c.Lock()
+	defer c.Unlock()
+	return c.requests[method+" "+path]
+}
+
+func (c *requestCounter) add(r *http.Request) int {
+	c.Lock()
+	defer c.Unlock()
+	if c.requests == nil {
+		c.requests = map[string]int{}
+	}
+	c.requests[r.Method+" "+r.URL.Path]++
+	return c.requests[r.Method+" "+r.URL.Path]
+}
+
+func TestDigestLookups(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	const manifestPath = "/v2/imagine/image-1/manifests/16c315"
+
+	counter := &requestCounter{}
+	rateLimited := 0
+	retryAfter := "0"
+
+	handler := ggcrregistry.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := counter.add(r)
+		if r.URL.Path == manifestPath && n <= rateLimited {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	ref := u.Host + "/imagine/image-1:16c315"
+
+	reg := &Registry{}
+
+	_, err = reg.Digest(ref)
+	g.Expect(IsNotFound(err)).To(BeTrue())
+	g.Expect(counter.count(http.MethodHead, manifestPath)).To(Equal(1))
+
+	// not found result is not cached
+	_, err = reg.Digest(ref)
+	g.Expect(IsNotFound(err)).To(BeTrue())
+	g.Expect(counter.count(http.MethodHead, manifestPath)).To(Equal(2))
+
+	img, err := random.Image(64, 1)
+	g.Expect(err).ToNot(HaveOccurred())
+	expectedDigest, err := img.Digest()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// image is pushed by other means, e.g. by buildx
+	g.Expect((&Registry{}).Push(ref, &export.Artifact{Image: img})).To(Succeed())
+
+	// lookup is retried when rate-limited
+	rateLimited = counter.count(http.MethodHead, manifestPath) + 2
+
+	digest, err := reg.Digest(ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(digest).To(Equal(expectedDigest.String()))
+	g.Expect(counter.count(http.MethodHead, manifestPath)).To(Equal(rateLimited + 1))
+	g.Expect(counter.count(http.MethodGet, manifestPath)).To(Equal(0))
+
+	digest, err = reg.Digest(ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(digest).To(Equal(expectedDigest.String()))
+	g.Expect(counter.count(http.MethodHead, manifestPath)).To(Equal(rateLimited + 1))
+
+	// pushing invalidates the cache
+	img, err = random.Image(64, 1)
+	g.Expect(err).ToNot(HaveOccurred())
+	expectedDigest, err = img.Digest()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	g.Expect(reg.Push(ref, &export.Artifact{Image: img})).To(Succeed())
+
+	digest, err = reg.Digest(ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(digest).To(Equal(expectedDigest.String()))
+
+	// waiting for too long is not an option
+	rateLimited = counter.count(http.MethodHead, manifestPath) + 1
+	retryAfter = "3600"
+
+	_, err = (&Registry{}).Digest(ref)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(IsNotFound(err)).To(BeFalse())
+}
+
+func TestMirrors(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	upstream := httptest.NewServer(ggcrregistry.New())
+	upstreamHost := upstream.Listener.Addr().String()
+	mirrorHost := testutil.StartRegistry(t)
+
+	dir := t.TempDir()
+
+	c, err := LoadConfig(writeFile(t, dir, "registries.json", map[string]interface{}{
+		"dockerConfig": dir,
+		"registries": map[string]interface{}{
+			upstreamHost: map[string]interface{}{"mirrors": []string{mirrorHost}},
+		},
+	}))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	ref, err := name.ParseReference(upstreamHost + "/library/alpine:3.12")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(c.MirrorRefs(ref)).To(Equal([]string{mirrorHost + "/library/alpine:3.12"}))
+
+	img, err := random.Image(64, 1)
+	g.Expect(err).ToNot(HaveOccurred())
+	expectedDigest, err := img.Digest()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	reg := &Registry{Config: c}
+
+	g.Expect(reg.Push(upstreamHost+"/library/alpine:3.12", &export.Artifact{Image: img})).To(Succeed())
+	g.Expect(reg.Push(mirrorHost+"/library/alpine:3.12", &export.Artifact{Image: img})).To(Succeed())
+
+	// upstream is not needed when the base image is in the mirror
+	upstream.Close()
+
+	digest, err := reg.BaseImageDigest(upstreamHost + "/library/alpine:3.12")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(digest).To(Equal(expectedDigest.String()))
+
+	// upstream is used when the base image is not in the mirror
+	_, err = reg.BaseImageDigest(upstreamHost + "/library/alpine:3.13")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(IsNotFound(err)).To(BeFalse())
+
+	// mirrors are not used for other lookups, e.g. of images
+	// that imagine pushes, as these have to be up-to-date
+	_, err = reg.Digest(upstreamHost + "/library/alpine:3.12")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(IsNotFound(err)).To(BeFalse())
+
+	_, err = reg.Get(upstreamHost + "/library/alpine@" + expectedDigest.String())
+	g.Expect(err).To(HaveOccurred())
+
+	_, err = LoadConfig(writeFile(t, dir, "registries.json", map[string]interface{}{
+		"registries": map[string]interface{}{
+			"docker.io": map[string]interface{}{"mirrors": []string{"mirror.example.com/dockerhub"}},
+		},
+	}))
+	g.Expect(err).To(MatchError(`invalid mirror "mirror.example.com/dockerhub" for registry "docker.io": only a host name (with optional port) is allowed`))
+}
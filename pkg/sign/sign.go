@@ -0,0 +1,380 @@
+package sign
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/errordeveloper/imagine/pkg/attest"
+)
+
+const (
+	// SignatureTagSuffix is appended to the tag of the image that holds
+	// signatures, it follows the same convention as cosign
+	SignatureTagSuffix = ".sig"
+
+	// PayloadMediaType is media type of signature layers, the payload
+	// is signed as is and signature is stored in SignatureAnnotation
+	PayloadMediaType types.MediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+	SignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+	PayloadType = "cosign container image signature"
+)
+
+var (
+	// ErrNoSignatures is returned by Verify when image has not been signed
+	ErrNoSignatures = errors.New("no signatures found")
+	// ErrNoValidSignatures is returned by Verify when none of the
+	// signatures are valid for the image and the key
+	ErrNoValidSignatures = errors.New("no valid signatures found")
+)
+
+// Payload is the simple signing payload that binds manifest
+// digest to a repository
+type Payload struct {
+	Critical Critical          `json:"critical"`
+	Optional map[string]string `json:"optional"`
+}
+
+type Critical struct {
+	Identity Identity `json:"identity"`
+	Image    Image    `json:"image"`
+	Type     string   `json:"type"`
+}
+
+type Identity struct {
+	DockerReference string `json:"docker-reference"`
+}
+
+type Image struct {
+	DockerManifestDigest string `json:"docker-manifest-digest"`
+}
+
+// Registry is the subset of registry API that is used to
+// sign images and verify signatures
+type Registry interface {
+	attest.Registry
+	Digest(string) (string, error)
+}
+
+// Signer signs images with a private key
+type Signer struct {
+	key crypto.Signer
+}
+
+// Verifier verifies image signatures with a public key
+type Verifier struct {
+	key crypto.PublicKey
+}
+
+// LoadSigner reads PEM-encoded ECDSA, ed25519 or RSA private key,
+// encrypted keys are not supported
+func LoadSigner(path string) (*Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read signing key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %q", path)
+	}
+	key, err := parsePrivateKey(block)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse signing key %q: %w", path, err)
+	}
+	return &Signer{key: key}, nil
+}
+
+// LoadVerifier reads PEM-encoded public key, a private key is
+// also accepted, in which case its public part is used
+func LoadVerifier(path string) (*Verifier, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read verification key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %q", path)
+	}
+	if block.Type == "PUBLIC KEY" {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse verification key %q: %w", path, err)
+		}
+		return &Verifier{key: key}, nil
+	}
+	key, err := parsePrivateKey(block)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse verification key %q: %w", path, err)
+	}
+	return &Verifier{key: key.Public()}, nil
+}
+
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	if _, ok := block.Headers["DEK-Info"]; ok || block.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, fmt.Errorf("encrypted keys are not supported")
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case *ecdsa.PrivateKey:
+			return key, nil
+		case ed25519.PrivateKey:
+			return key, nil
+		case *rsa.PrivateKey:
+			return key, nil
+		default:
+			return nil, fmt.Errorf("unsupported key type %T", key)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+}
+
+// NewSigner returns a signer for the given ECDSA, ed25519 or RSA key
+func NewSigner(key crypto.Signer) *Signer { return &Signer{key: key} }
+
+// NewVerifier returns a verifier for the given ECDSA, ed25519 or RSA key
+func NewVerifier(key crypto.PublicKey) *Verifier { return &Verifier{key: key} }
+
+// Verifier returns a verifier for signatures made by the signer
+func (s *Signer) Verifier() *Verifier { return &Verifier{key: s.key.Public()} }
+
+func (s *Signer) sign(payload []byte) ([]byte, error) {
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		return s.key.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(payload)
+	return s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+func (v *Verifier) verify(payload, sig []byte) error {
+	ok := false
+	switch key := v.key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(payload)
+		ok = ecdsa.VerifyASN1(key, digest[:], sig)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(key, payload, sig)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(payload)
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+	if !ok {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// NewPayload returns payload for the image with the given digest in repo
+func NewPayload(repo string, digest v1.Hash) ([]byte, error) {
+	return json.Marshal(&Payload{
+		Critical: Critical{
+			Identity: Identity{DockerReference: repo},
+			Image:    Image{DockerManifestDigest: digest.String()},
+			Type:     PayloadType,
+		},
+	})
+}
+
+// Sign pushes a signature of the image with the given digest to each
+// of the repositories refs belong to and returns refs of signature images
+// that were pushed; repositories that already have a valid signature of
+// the image are skipped, so that signatures don't accumulate
+func (s *Signer) Sign(reg Registry, digest v1.Hash, refs ...string) ([]string, error) {
+	verifier := s.Verifier()
+	return attest.AttachTo(reg, digest, SignatureTagSuffix, func(repo string) ([]attest.Attachment, error) {
+		err := verifier.verifyDigest(reg, repo, digest)
+		switch {
+		case err == nil:
+			return nil, nil
+		case !errors.Is(err, ErrNoSignatures) && !errors.Is(err, ErrNoValidSignatures):
+			return nil, err
+		}
+		payload, err := NewPayload(repo, digest)
+		if err != nil {
+			return nil, err
+		}
+		sig, err := s.sign(payload)
+		if err != nil {
+			return nil, fmt.Errorf("unable to sign %q: %w", repo, err)
+		}
+		return []attest.Attachment{{
+			Data:      payload,
+			MediaType: PayloadMediaType,
+			Annotations: map[string]string{
+				SignatureAnnotation: base64.StdEncoding.EncodeToString(sig),
+			},
+			Comment: PayloadType,
+		}}, nil
+	}, refs...)
+}
+
+// SignRefs signs the image each of the refs points to, refs may
+// point to different images
+func (s *Signer) SignRefs(reg Registry, refs ...string) error {
+	for _, ref := range refs {
+		digest, err := digestOf(reg, ref)
+		if err != nil {
+			return err
+		}
+		signatureRefs, err := s.Sign(reg, digest, ref)
+		if err != nil {
+			return err
+		}
+		if len(signatureRefs) == 0 {
+			fmt.Printf("%q (%s) is already signed\n", ref, digest)
+		}
+		for _, signatureRef := range signatureRefs {
+			fmt.Printf("signed %q (%s) as %q\n", ref, digest, signatureRef)
+		}
+	}
+	return nil
+}
+
+// Verify checks that the image ref points to has at least one signature
+// that is valid for the image and the key, ErrNoSignatures is returned
+// when there are no signatures at all, and ErrNoValidSignatures when
+// none of them are valid
+func (v *Verifier) Verify(reg Registry, ref string) error {
+	digest, err := digestOf(reg, ref)
+	if err != nil {
+		return err
+	}
+	return v.verifyDigest(reg, ref, digest)
+}
+
+func (v *Verifier) verifyDigest(reg Registry, ref string, digest v1.Hash) error {
+	payloads, err := signedPayloads(reg, ref, digest)
+	if err != nil {
+		return err
+	}
+	if len(payloads) == 0 {
+		return fmt.Errorf("unable to verify %q: %w", ref, ErrNoSignatures)
+	}
+
+	repo := attest.RepoName(ref)
+	errs := []error{}
+	for _, p := range payloads {
+		if err := v.verify(p.data, p.sig); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		payload := &Payload{}
+		if err := json.Unmarshal(p.data, payload); err != nil {
+			errs = append(errs, fmt.Errorf("unable to parse payload: %w", err))
+			continue
+		}
+		if payload.Critical.Image.DockerManifestDigest != digest.String() {
+			errs = append(errs, fmt.Errorf("signature is for %q", payload.Critical.Image.DockerManifestDigest))
+			continue
+		}
+		if payload.Critical.Identity.DockerReference != repo {
+			errs = append(errs, fmt.Errorf("signature is for %q", payload.Critical.Identity.DockerReference))
+			continue
+		}
+		return nil
+	}
+	reasons := make([]string, 0, len(errs))
+	for _, err := range errs {
+		reasons = append(reasons, err.Error())
+	}
+	return fmt.Errorf("unable to verify %q: %w (%s)", ref, ErrNoValidSignatures, strings.Join(reasons, "; "))
+}
+
+// SignatureChecker checks that images have valid signatures, it
+// is used with rebuilder to find images that need to be signed
+type SignatureChecker struct {
+	Registry Registry
+	Verifier *Verifier
+}
+
+func (c *SignatureChecker) IsSigned(ref string) (bool, error) {
+	err := c.Verifier.Verify(c.Registry, ref)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, ErrNoSignatures), errors.Is(err, ErrNoValidSignatures):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func digestOf(reg Registry, ref string) (v1.Hash, error) {
+	digest, err := reg.Digest(ref)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("unable to get digest of %q: %w", ref, err)
+	}
+	return v1.NewHash(digest)
+}
+
+type signedPayload struct {
+	data, sig []byte
+}
+
+func signedPayloads(reg Registry, ref string, digest v1.Hash) ([]signedPayload, error) {
+	signatureRef, err := attest.AttachmentRef(ref, digest, SignatureTagSuffix)
+	if err != nil {
+		return nil, err
+	}
+	img, err := attest.GetAttachmentImage(reg, signatureRef)
+	if err != nil || img == nil {
+		return nil, err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+
+	payloads := []signedPayload{}
+	for _, desc := range manifest.Layers {
+		if desc.MediaType != PayloadMediaType {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(desc.Annotations[SignatureAnnotation])
+		if err != nil || len(sig) == 0 {
+			continue
+		}
+		layer, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		rc, err := layer.Compressed()
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, signedPayload{data: data, sig: sig})
+	}
+	return payloads, nil
+}
@@ -0,0 +1,264 @@
+package sign_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+
+	"github.com/errordeveloper/imagine/pkg/export"
+	"github.com/errordeveloper/imagine/pkg/git"
+	"github.com/errordeveloper/imagine/pkg/internal/testutil"
+	"github.com/errordeveloper/imagine/pkg/rebuilder"
+	"github.com/errordeveloper/imagine/pkg/recipe"
+	"github.com/errordeveloper/imagine/pkg/registry"
+	. "github.com/errordeveloper/imagine/pkg/sign"
+)
+
+func signatureLayers(g *WithT, reg *registry.Registry, signatureRef string) int {
+	desc, err := reg.Get(signatureRef)
+	g.Expect(err).ToNot(HaveOccurred())
+	img, err := desc.Image()
+	g.Expect(err).ToNot(HaveOccurred())
+	layers, err := img.Layers()
+	g.Expect(err).ToNot(HaveOccurred())
+	return len(layers)
+}
+
+func writeKeys(t *testing.T, key crypto.Signer) (string, string) {
+	dir := t.TempDir()
+
+	privateKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privateKeyPath := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(privateKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKey}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	publicKeyPath := filepath.Join(dir, "key.pub")
+	if err := ioutil.WriteFile(publicKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return privateKeyPath, publicKeyPath
+}
+
+func TestSignAndVerify(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	host := testutil.StartRegistry(t)
+	reg := &registry.Registry{}
+
+	img, err := random.Image(256, 1)
+	g.Expect(err).ToNot(HaveOccurred())
+	digest, err := img.Digest()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	refs := []string{host + "/imagine/image-1:16c315", host + "/release/image-1:16c315"}
+	for _, ref := range refs {
+		g.Expect(reg.Push(ref, &export.Artifact{Image: img})).To(Succeed())
+	}
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).ToNot(HaveOccurred())
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	ecdsaPrivateKeyPath, ecdsaPublicKeyPath := writeKeys(t, ecdsaKey)
+	ed25519PrivateKeyPath, ed25519PublicKeyPath := writeKeys(t, ed25519Key)
+
+	ecdsaVerifier, err := LoadVerifier(ecdsaPublicKeyPath)
+	g.Expect(err).ToNot(HaveOccurred())
+	ed25519Verifier, err := LoadVerifier(ed25519PublicKeyPath)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	ecdsaChecker := &SignatureChecker{Registry: reg, Verifier: ecdsaVerifier}
+	ed25519Checker := &SignatureChecker{Registry: reg, Verifier: ed25519Verifier}
+
+	signed, err := ecdsaChecker.IsSigned(refs[0])
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(signed).To(BeFalse())
+
+	err = ecdsaVerifier.Verify(reg, refs[0])
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(errors.Is(err, ErrNoSignatures)).To(BeTrue())
+
+	ecdsaSigner, err := LoadSigner(ecdsaPrivateKeyPath)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	signatureRefs, err := ecdsaSigner.Sign(reg, digest, refs...)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(signatureRefs).To(Equal([]string{
+		host + "/imagine/image-1:sha256-" + digest.Hex + ".sig",
+		host + "/release/image-1:sha256-" + digest.Hex + ".sig",
+	}))
+
+	for _, ref := range refs {
+		signed, err := ecdsaChecker.IsSigned(ref)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(signed).To(BeTrue())
+
+		g.Expect(ecdsaVerifier.Verify(reg, ref)).To(Succeed())
+
+		// signatures made with another key don't count
+		signed, err = ed25519Checker.IsSigned(ref)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(signed).To(BeFalse())
+
+		err = ed25519Verifier.Verify(reg, ref)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(errors.Is(err, ErrNoValidSignatures)).To(BeTrue())
+	}
+
+	// signing again doesn't add another signature
+	signatureRefs, err = ecdsaSigner.Sign(reg, digest, refs...)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(signatureRefs).To(BeEmpty())
+	g.Expect(signatureLayers(g, reg, host+"/imagine/image-1:sha256-"+digest.Hex+".sig")).To(Equal(1))
+
+	ed25519Signer, err := LoadSigner(ed25519PrivateKeyPath)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	signatureRefs, err = ed25519Signer.Sign(reg, digest, refs[0])
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(signatureRefs).To(HaveLen(1))
+	g.Expect(signatureLayers(g, reg, signatureRefs[0])).To(Equal(2))
+
+	g.Expect(ed25519Verifier.Verify(reg, refs[0])).To(Succeed())
+	g.Expect(ecdsaVerifier.Verify(reg, refs[0])).To(Succeed())
+	g.Expect(ed25519Verifier.Verify(reg, refs[1])).ToNot(Succeed())
+
+	// a signature for one repository is not valid for another
+	signatureRef := host + "/imagine/image-1:sha256-" + digest.Hex + ".sig"
+	otherRef := host + "/other/image-1:16c315"
+	g.Expect(reg.Push(otherRef, &export.Artifact{Image: img})).To(Succeed())
+	g.Expect(reg.Copy(signatureRef, host+"/other/image-1:sha256-"+digest.Hex+".sig")).To(Succeed())
+	err = ecdsaVerifier.Verify(reg, otherRef)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("signature is for"))
+
+	// private key can be used for verification
+	verifier, err := LoadVerifier(ecdsaPrivateKeyPath)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(verifier.Verify(reg, refs[1])).To(Succeed())
+}
+
+func TestLoadSigner(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	dir := t.TempDir()
+
+	encryptedKeyPath := filepath.Join(dir, "encrypted.pem")
+	g.Expect(ioutil.WriteFile(encryptedKeyPath, pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: []byte("foo")}), 0600)).To(Succeed())
+	_, err := LoadSigner(encryptedKeyPath)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("encrypted keys are not supported"))
+
+	notPEMPath := filepath.Join(dir, "key.txt")
+	g.Expect(ioutil.WriteFile(notPEMPath, []byte("foo"), 0600)).To(Succeed())
+	_, err = LoadSigner(notPEMPath)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("no PEM data found"))
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).ToNot(HaveOccurred())
+	ecKey, err := x509.MarshalECPrivateKey(ecdsaKey)
+	g.Expect(err).ToNot(HaveOccurred())
+	ecKeyPath := filepath.Join(dir, "ec.pem")
+	g.Expect(ioutil.WriteFile(ecKeyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecKey}), 0600)).To(Succeed())
+	_, err = LoadSigner(ecKeyPath)
+	g.Expect(err).ToNot(HaveOccurred())
+
+}
+
+func TestNewPayload(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	payload, err := NewPayload("reg1.example.com/imagine/image-1", v1.Hash{Algorithm: "sha256", Hex: "16c315"})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(payload).To(MatchJSON(`{
+		"critical": {
+			"identity": {"docker-reference": "reg1.example.com/imagine/image-1"},
+			"image": {"docker-manifest-digest": "sha256:16c315"},
+			"type": "cosign container image signature"
+		},
+		"optional": null
+	}`))
+}
+
+func TestSignRefsAfterBuild(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	host := testutil.StartRegistry(t)
+	reg := &registry.Registry{}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).ToNot(HaveOccurred())
+	signer := NewSigner(key)
+
+	ir := &recipe.ImagineRecipe{
+		Name: "image-1",
+		Scope: &recipe.ImageScopeRootDir{
+			RelativeDockerfilePath: "examples/image-1/Dockerfile",
+			Git: &git.FakeRepo{
+				CommitHashForHeadVal: "16c315243fd31c00b80c188123099501ae2ccf91",
+			},
+		},
+	}
+	m, err := ir.ToBakeManifest(host + "/imagine")
+	g.Expect(err).ToNot(HaveOccurred())
+	refs := m.RegistryTags()
+
+	rb := &rebuilder.Rebuilder{
+		RegistryAPI: reg,
+		Signatures:  &SignatureChecker{Registry: reg, Verifier: signer.Verifier()},
+	}
+
+	// images are pushed by BuildKit, not through reg
+	build := func() {
+		img, err := random.Image(256, 1)
+		g.Expect(err).ToNot(HaveOccurred())
+		for _, ref := range refs {
+			g.Expect((&registry.Registry{}).Push(ref, &export.Artifact{Image: img})).To(Succeed())
+		}
+		reg.Forget(refs...)
+	}
+
+	rebuild, _, err := rb.ShouldRebuild(m)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(rebuild).To(BeTrue())
+
+	build()
+	g.Expect(signer.SignRefs(reg, refs...)).To(Succeed())
+	for _, ref := range refs {
+		g.Expect(signer.Verifier().Verify(&registry.Registry{}, ref)).To(Succeed())
+	}
+
+	// rebuild is forced, digest that was looked up before is replaced
+	rebuild, _, err = rb.ShouldRebuild(m)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(rebuild).To(BeFalse())
+
+	build()
+	g.Expect(signer.SignRefs(reg, refs...)).To(Succeed())
+	for _, ref := range refs {
+		g.Expect(signer.Verifier().Verify(&registry.Registry{}, ref)).To(Succeed())
+	}
+}